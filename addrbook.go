@@ -0,0 +1,208 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Every node keeps an address book of the nodes it heard of, with the node it heard it from (the source)
+// and the last time the node was seen. Connected nodes exchange addresses periodically (getaddr and addr
+// messages); the connection manager picks the nodes to connect to from the address book.
+
+// The maximum number of addresses in the address book
+const maxAddresses = 1000
+
+// The maximum number of addresses in the address book from one source, so one peer can't fill the book
+const maxAddrPerSource = 100
+
+// The time after which an address that is not seen is dropped
+const maxAddressAge = 24 * time.Hour
+
+// The maximum number of addresses in an addr message
+const maxAddrPerMessage = 250
+
+// The time between two requests for addresses of the connected nodes
+const addrInterval = 10 * time.Minute
+
+// KnownAddress is a node in the address book
+type KnownAddress struct {
+	Node
+	Source    string `json:"source"`    // the address of the node we heard it from, or oracle, greeting or peer
+	LastSeen  int64  `json:"lastSeen"`  // UnixNano
+	LastTried int64  `json:"lastTried"` // UnixNano, 0 if never tried
+	Attempts  int    `json:"attempts"`  // failed connection attempts since it was last connected
+}
+
+// PeerAddress is a node in an addr message
+type PeerAddress struct {
+	Node
+	LastSeen int64 `json:"lastSeen"` // UnixNano
+}
+
+// addressBook holds the known addresses by their address
+type addressBook struct {
+	sync.Mutex
+	addresses map[string]*KnownAddress
+}
+
+func newAddressBook() *addressBook {
+	return &addressBook{addresses: make(map[string]*KnownAddress)}
+}
+
+// addressBook returns the address book of the network
+func (nodes *Nodes) addressBook() *addressBook {
+	return nodes.addrs
+}
+
+// add adds a node to the address book, or refreshes it if it is seen more recently. Addresses that are too old
+// are ignored. A source that has the maximum number of addresses replaces the one of it's addresses that was
+// seen the longest ago, when the book is full the source with the most addresses does.
+// Returns true if the address is new.
+func (book *addressBook) add(node Node, source string, lastSeen int64) bool {
+	now := time.Now().UnixNano()
+	if lastSeen > now {
+		lastSeen = now // no addresses from the future
+	}
+	if now-lastSeen > int64(maxAddressAge) || node.Hostname == "" || node.Port == 0 {
+		return false
+	}
+	book.Lock()
+	defer book.Unlock()
+	if known, ok := book.addresses[node.getAddress()]; ok {
+		if lastSeen > known.LastSeen {
+			known.Node, known.LastSeen = node, lastSeen
+		}
+		return false
+	}
+	sources := book.sources()
+	if sources[source] >= maxAddrPerSource {
+		book.dropOldest(source)
+	} else if len(book.addresses) >= maxAddresses {
+		largest := source
+		for s, n := range sources {
+			if n > sources[largest] {
+				largest = s
+			}
+		}
+		book.dropOldest(largest)
+	}
+	book.addresses[node.getAddress()] = &KnownAddress{Node: node, Source: source, LastSeen: lastSeen}
+	return true
+}
+
+// sources returns the number of addresses by their source. The book should be locked.
+func (book *addressBook) sources() map[string]int {
+	sources := make(map[string]int)
+	for _, known := range book.addresses {
+		sources[known.Source]++
+	}
+	return sources
+}
+
+// dropOldest removes the address of the source that was seen the longest ago. The book should be locked.
+func (book *addressBook) dropOldest(source string) {
+	var oldest *KnownAddress
+	for _, known := range book.addresses {
+		if known.Source == source && (oldest == nil || known.LastSeen < oldest.LastSeen) {
+			oldest = known
+		}
+	}
+	if oldest != nil {
+		delete(book.addresses, oldest.getAddress())
+	}
+}
+
+// markAttempt records a connection attempt to the node
+func (book *addressBook) markAttempt(node Node) {
+	book.Lock()
+	defer book.Unlock()
+	if known, ok := book.addresses[node.getAddress()]; ok {
+		known.LastTried = time.Now().UnixNano()
+		known.Attempts++
+	}
+}
+
+// markConnected records that the node is connected, it is added to the book if it is not in it
+func (book *addressBook) markConnected(node Node, source string) {
+	book.add(node, source, time.Now().UnixNano())
+	book.Lock()
+	defer book.Unlock()
+	if known, ok := book.addresses[node.getAddress()]; ok {
+		known.Node, known.LastSeen, known.Attempts = node, time.Now().UnixNano(), 0
+	}
+}
+
+// remove removes the node from the address book
+func (book *addressBook) remove(address string) {
+	book.Lock()
+	defer book.Unlock()
+	delete(book.addresses, address)
+}
+
+// attempts returns the number of failed connection attempts to the node
+func (book *addressBook) attempts(node Node) int {
+	book.Lock()
+	defer book.Unlock()
+	if known, ok := book.addresses[node.getAddress()]; ok {
+		return known.Attempts
+	}
+	return 0
+}
+
+// list returns the known addresses, the most recently seen first. Addresses that are too old are dropped.
+func (book *addressBook) list() []KnownAddress {
+	book.Lock()
+	defer book.Unlock()
+	list := make([]KnownAddress, 0, len(book.addresses))
+	now := time.Now().UnixNano()
+	for address, known := range book.addresses {
+		if now-known.LastSeen > int64(maxAddressAge) {
+			delete(book.addresses, address)
+			continue
+		}
+		list = append(list, *known)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastSeen > list[j].LastSeen })
+	return list
+}
+
+// recent returns at most max addresses to share with other nodes, the most recently seen first
+func (book *addressBook) recent(max int) []PeerAddress {
+	list := book.list()
+	if len(list) > max {
+		list = list[:max]
+	}
+	addresses := make([]PeerAddress, 0, len(list))
+	for _, known := range list {
+		addresses = append(addresses, PeerAddress{Node: known.Node, LastSeen: known.LastSeen})
+	}
+	return addresses
+}
+
+// addressMessage returns the addresses to send to another node, with ourself as the first address
+func (nodes *Nodes) addressMessage(self Node) []PeerAddress {
+	addresses := []PeerAddress{{Node: self, LastSeen: time.Now().UnixNano()}}
+	for _, address := range nodes.addressBook().recent(maxAddrPerMessage) {
+		if address.getAddress() != self.getAddress() && len(addresses) < maxAddrPerMessage {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// requestAddresses asks all connected nodes for the addresses they know
+func (nodes *Nodes) requestAddresses() {
+	for _, p := range nodes.connections() {
+		if nodes.hasFeature(p.node, "addr") {
+			go p.sendMessage(msgGetAddr, 0, nil)
+		}
+	}
+}
+
+// shareAddresses asks the connected nodes for addresses every interval, it runs forever.
+func (nodes *Nodes) shareAddresses(interval time.Duration) {
+	for range time.Tick(interval) {
+		nodes.requestAddresses()
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddressBook(t *testing.T) {
+	book := newAddressBook()
+	node := Node{Protocol: "http://", Hostname: "127.0.0.1", Port: 8001, P2PPort: 9001}
+	now := time.Now().UnixNano()
+
+	if !book.add(node, "oracle", now-int64(time.Hour)) {
+		t.Error("New address should be added")
+	}
+	if book.add(node, "other", now) || book.list()[0].LastSeen != now || book.list()[0].Source != "oracle" {
+		t.Error("Known address should be refreshed, keeping it's source")
+	}
+	if book.add(Node{Protocol: "http://", Hostname: "127.0.0.1", Port: 8002}, "oracle", now-int64(maxAddressAge)-1) {
+		t.Error("Address that is too old should be ignored")
+	}
+
+	for i := 0; i < maxAddresses; i++ {
+		source := fmt.Sprintf("http://10.0.%d.1:8000", i%(maxAddresses/maxAddrPerSource))
+		book.add(Node{Protocol: "http://", Hostname: "10.0.0.1", Port: uint16(10000 + i)}, source, now-int64(i)-1)
+	}
+	if len(book.list()) != maxAddresses {
+		t.Errorf("Address book should be bounded to %d addresses, got %d", maxAddresses, len(book.list()))
+	}
+	if recent := book.recent(maxAddrPerMessage); len(recent) != maxAddrPerMessage || recent[0].getAddress() != node.getAddress() {
+		t.Errorf("Expected the %d most recent addresses, got %d", maxAddrPerMessage, len(recent))
+	}
+
+	// a peer that sends many fresh addresses can't get more than the other sources
+	flooder := "http://10.0.99.1:8000"
+	for i := 0; i < maxAddresses; i++ {
+		book.add(Node{Protocol: "http://", Hostname: "10.0.0.2", Port: uint16(10000 + i)}, flooder, now)
+	}
+	book.Lock()
+	sources := book.sources()
+	book.Unlock()
+	if sources[flooder] > maxAddrPerSource || sources["oracle"] != 1 || len(book.list()) != maxAddresses {
+		t.Errorf("Expected at most %d addresses of the flooding peer, got %v", maxAddrPerSource, sources)
+	}
+	for source, n := range sources {
+		if source != "oracle" && n < sources[flooder]-1 {
+			t.Errorf("Source %s lost it's addresses to the flooding peer, got %v", source, sources)
+		}
+	}
+}
+
+func TestFillOutbound(t *testing.T) {
+	nodes := initNodes()
+	self := Node{Protocol: "http://", Hostname: "127.0.0.1", Port: 8000, P2PPort: 9000}
+	nodes.addressBook().add(self, "oracle", time.Now().UnixNano())
+	nodes.addressBook().add(Node{Protocol: "http://", Hostname: "127.0.0.1", Port: 8001}, "oracle", time.Now().UnixNano())
+	for i := 0; i < targetOutbound+2; i++ {
+		nodes.addressBook().add(Node{Protocol: "http://", Hostname: "10.0.0.1", Port: uint16(8100 + i), P2PPort: uint16(9100 + i)}, "oracle", time.Now().UnixNano())
+	}
+	failing := Node{Protocol: "http://", Hostname: "10.0.0.2", Port: 8200, P2PPort: 9200}
+	nodes.addressBook().add(failing, "oracle", time.Now().Add(time.Minute).UnixNano())
+
+	var tried []string
+	connect := func(node Node) error {
+		tried = append(tried, node.getAddress())
+		if node.getAddress() == failing.getAddress() {
+			return errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		defer server.Close()
+		nodes.register(newPeerConn(node, client))
+		return nil
+	}
+
+	if connected := nodes.fillOutbound(self, connect); connected != targetOutbound {
+		t.Errorf("Expected %d connections, got %d", targetOutbound, connected)
+	}
+	if tried[0] != failing.getAddress() || strings.Contains(strings.Join(tried, ","), ":8001") || strings.Contains(strings.Join(tried, ","), ":8000") {
+		t.Errorf("Expected the most recent address first, without ourself and nodes without a peer port, got %v", tried)
+	}
+	if _, outbound := nodes.countConnections(); outbound != targetOutbound {
+		t.Errorf("Expected %d outbound connections, got %d", targetOutbound, outbound)
+	}
+
+	// a failed node is retried after a while, and dropped when it keeps failing
+	tried = nil
+	if nodes.fillOutbound(self, connect) != 0 || len(tried) != 0 {
+		t.Errorf("No connections should be made when the target is met, tried %v", tried)
+	}
+	for _, p := range nodes.connections() {
+		nodes.disconnect(p)
+	}
+	tried = nil
+	nodes.fillOutbound(self, connect)
+	if strings.Contains(strings.Join(tried, ","), failing.getAddress()) {
+		t.Error("Failed node should not be retried right away")
+	}
+	for _, p := range nodes.connections() {
+		nodes.disconnect(p)
+	}
+	nodes.addressBook().addresses[failing.getAddress()].Attempts = maxConnectAttempts - 1
+	nodes.addressBook().addresses[failing.getAddress()].LastTried = 0
+	nodes.addressBook().addresses[failing.getAddress()].LastSeen = time.Now().UnixNano()
+	nodes.fillOutbound(self, connect)
+	if _, ok := nodes.addressBook().addresses[failing.getAddress()]; ok {
+		t.Errorf("Node should be dropped after %d failed attempts", maxConnectAttempts)
+	}
+}
+
+func TestAddressGossip(t *testing.T) {
+	saveGlobals(t)
+
+	a := newTestChain("addr-a")
+	b := a.newPeer("addr-b")
+	c := a.newPeer("addr-c")
+	for _, chain := range []*testChain{a, b, c} {
+		defer chain.listenPeers(t).Close()
+	}
+	connect(a, b)
+	connect(b, c)
+	b.nodes.addressBook().markConnected(c.me, "inbound")
+
+	// a asks b for addresses once it is connected, and hears of c
+	if err := a.nodes.dialPeer(b.me, a.bc, a.me); err != nil {
+		t.Fatalf("Could not connect to b: %s", err)
+	}
+	if !waitFor(func() bool { return len(a.nodes.addressBook().list()) == 2 }) {
+		t.Fatalf("Expected b and c in the address book of a, got %v", a.nodes.addressBook().list())
+	}
+	for _, known := range a.nodes.addressBook().list() {
+		if known.getAddress() == c.me.getAddress() && known.Source != b.me.getAddress() {
+			t.Errorf("Source of c should be b, got %s", known.Source)
+		}
+	}
+
+	// the connection manager connects to c, which knows a
+	connect(a, c)
+	dial := func(node Node) error { return a.nodes.dialPeer(node, a.bc, a.me) }
+	if connected := a.nodes.fillOutbound(a.me, dial); connected != 1 {
+		t.Errorf("Expected a connection with c, got %d connections", connected)
+	}
+	if _, outbound := a.nodes.countConnections(); outbound != 2 {
+		t.Errorf("Expected 2 outbound connections, got %d", outbound)
+	}
+	if !waitFor(func() bool { inbound, _ := c.nodes.countConnections(); return inbound == 1 }) {
+		t.Error("Connection of a should be inbound at c")
+	}
+
+	var resp struct {
+		List     []KnownAddress `json:"list"`
+		Outbound int            `json:"outbound"`
+	}
+	a.call(t, "GET", "/addr", nil, &resp)
+	if len(resp.List) != 2 || resp.Outbound != 2 {
+		t.Errorf("Expected the address book with 2 outbound connections, got %v", resp)
+	}
+}
+
+func TestMaxInbound(t *testing.T) {
+	saveGlobals(t)
+
+	a := newTestChain("inbound-a")
+	b := a.newPeer("inbound-b")
+	defer a.listenPeers(t).Close()
+	defer b.listenPeers(t).Close()
+	connect(a, b)
+
+	for i := 0; i < maxInbound; i++ {
+		client, server := net.Pipe()
+		defer server.Close()
+		p := newPeerConn(Node{Protocol: "http://", Hostname: "10.0.0.1", Port: uint16(8000 + i)}, client)
+		p.inbound = true
+		a.nodes.register(p)
+	}
+	err := b.nodes.dialPeer(a.me, b.bc, b.me)
+	if err == nil || !strings.Contains(err.Error(), "too many") {
+		t.Errorf("Connection should be refused when there are %d inbound connections, got %v", maxInbound, err)
+	}
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"crypto/tls"
 	"database/sql"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 
 	"os"
@@ -37,21 +39,29 @@ func (a *App) Initialize() {
 
 	// add the Node to the stack
 	nodes = initNodes()
+	nodes.bans = newBanList(banFile)
 	cl := Node{
-		Protocol: "http://",
+		Protocol: protocol(),
 		Hostname: name,
 		Port:     nodePort,
 		Name:     *nodeName,
+		P2PPort:  p2pPort,
 	}
 	cl.createWallet()
+	if identityFile != "" {
+		if err := cl.loadIdentity(identityFile); err != nil {
+			glog.Panicf("Could not load the identity of the node: %s", err)
+		}
+	}
+	cl.createIdentity()
 
 	me = cl
 	// register me as the first node
 	nodes.addNode(&cl)
 	// fetch a list of existing Nodes
 	nodes.syncNodes()
-	// register me at all other Nodes
-	nodes.greetNodes()
+	// check the health of the Nodes, dead Nodes are removed
+	go nodes.watchHealth(me, pingInterval)
 
 	bc = initBlockchain()
 	bc.getCurrentTransactions()
@@ -67,7 +77,35 @@ func (a *App) Run() {
 	p := fmt.Sprintf("%d", nodePort)
 	fmt.Println("Starting server")
 	fmt.Printf("Running on Port %s\n", p)
-	log.Fatal(http.ListenAndServe(":"+p, a.Router))
+	listener, err := net.Listen("tcp", ":"+p)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if serverTLS != nil {
+		fmt.Println("Serving over TLS")
+		listener = tls.NewListener(listener, serverTLS)
+	}
+	if p2pPort != 0 {
+		peerListener, err := net.Listen("tcp", fmt.Sprintf(":%d", p2pPort))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if serverTLS != nil {
+			peerListener = tls.NewListener(peerListener, serverTLS)
+		}
+		fmt.Printf("Accepting peer connections on Port %d\n", p2pPort)
+		go nodes.listenPeers(peerListener, bc, me)
+	}
+	// register me at all other Nodes, they challenge this node at it's address once it listens
+	nodes.greetNodes()
+	// keep the outbound peer connections filled with nodes of the address book
+	go nodes.manageConnections(bc, me, connectInterval)
+	go nodes.shareAddresses(addrInterval)
+	// a signer or staker seals blocks when it is it's turn
+	if producer, ok := bc.consensus().(blockProducer); ok {
+		go producer.produceBlocks(bc)
+	}
+	log.Fatal(http.Serve(listener, a.Router))
 }
 
 func (a *App) initializeRoutes() {
@@ -79,18 +117,54 @@ func (a *App) initializeRoutes() {
 	a.Router.HandleFunc("/transactions", a.currentTransactions).Methods("GET")
 	// wallet
 	a.Router.HandleFunc("/wallet/{hash}", a.wallet).Methods("GET")
+	a.Router.HandleFunc("/wallet/{hash}/tokens", a.walletTokens).Methods("GET")
+	// tokens
+	a.Router.HandleFunc("/token/{id}", a.token).Methods("GET")
+	// hash time-locked contracts
+	a.Router.HandleFunc("/htlc", a.createHTLC).Methods("POST")
+	a.Router.HandleFunc("/htlc/{address}/claim", a.claimHTLC).Methods("POST")
+	a.Router.HandleFunc("/htlc/{address}/refund", a.refundHTLC).Methods("POST")
+	a.Router.HandleFunc("/htlc/{address}/preimage", a.htlcPreimage).Methods("GET")
+	// payment channels
+	a.Router.HandleFunc("/channel", a.openChannel).Methods("POST")
+	a.Router.HandleFunc("/channel/{action:open}", a.channelMessage).Methods("POST")
+	a.Router.HandleFunc("/channel/{address}", a.channel).Methods("GET")
+	a.Router.HandleFunc("/channel/{address}/{action:update|cooperate}", a.channelMessage).Methods("POST")
+	a.Router.HandleFunc("/channel/{address}/{action:pay|close|force-close|settle}", a.channelAction).Methods("POST")
 	// blocks
 	a.Router.HandleFunc("/block", a.lastblock).Methods("GET")
 	a.Router.HandleFunc("/block/{hash}", a.block).Methods("GET")
 	a.Router.HandleFunc("/block/index/{index}", a.blockByIndex).Methods("GET")
 	a.Router.HandleFunc("/block/distributed", a.distributedBlock).Methods("POST")
+	a.Router.HandleFunc("/headers", a.headers).Methods("GET")
+	a.Router.HandleFunc("/blocks", a.blocks).Methods("POST")
+	a.Router.HandleFunc("/blocks/locator", a.blocksAfterLocator).Methods("POST")
+	a.Router.HandleFunc("/inv", a.inventory).Methods("POST")
+	a.Router.HandleFunc("/getdata", a.getData).Methods("POST")
 	// mining and chaining
 	a.Router.HandleFunc("/mine", a.mine).Methods("GET")
+	a.Router.HandleFunc("/generate", a.generate).Methods("POST")
+	a.Router.HandleFunc("/deployments", a.deployments).Methods("GET")
 	a.Router.HandleFunc("/chain", a.chain).Methods("GET")
 	a.Router.HandleFunc("/validate", a.validate).Methods("GET")
 	a.Router.HandleFunc("/resolve", a.resolve).Methods("GET")
 	a.Router.HandleFunc("/status", a.chainStatus).Methods("GET")
+	a.Router.HandleFunc("/signers", a.signers).Methods("GET")
+	a.Router.HandleFunc("/signers/vote", a.voteSigner).Methods("POST")
+	a.Router.HandleFunc("/stake", a.getStakes).Methods("GET")
+	a.Router.HandleFunc("/stake", a.stake).Methods("POST")
+	a.Router.HandleFunc("/unstake", a.unstake).Methods("POST")
 	// Nodes
 	a.Router.HandleFunc("/node", a.connectNode).Methods("POST")
 	a.Router.HandleFunc("/node", a.getNodes).Methods("GET")
+	a.Router.HandleFunc("/ping", a.ping).Methods("GET")
+	a.Router.HandleFunc("/addr", a.addresses).Methods("GET")
+	a.Router.HandleFunc("/identity", a.identity).Methods("POST")
+	// Bans
+	a.Router.HandleFunc("/bans", adminOnly(a.getBans)).Methods("GET")
+	a.Router.HandleFunc("/bans", adminOnly(a.clearBans)).Methods("DELETE")
+	a.Router.HandleFunc("/bans/{address}", adminOnly(a.clearBans)).Methods("DELETE")
+	a.Router.HandleFunc("/reorgs", a.getReorgs).Methods("GET")
+	a.Router.HandleFunc("/reorgs", adminOnly(a.clearReorgs)).Methods("DELETE")
+	a.Router.Use(rejectBanned)
 }
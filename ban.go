@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grrrben/glog"
+)
+
+// Peers that send invalid data get a misbehaviour score. Once the score of a peer crosses the threshold,
+// it is banned for a while; requests from it are refused and the data it announces is not requested.
+// Bans are stored in a file so they survive a restart. Peers are identified by their host (IP address).
+
+// The misbehaviour score after which a peer is banned
+const banThreshold = 100
+
+// The time a peer is banned
+const banDuration = 24 * time.Hour
+
+// Misbehaviour scores
+const (
+	scoreInvalidPayload     = 20
+	scoreInvalidBlock       = 50
+	scoreInvalidTransaction = 10
+)
+
+// The file in which the bans are stored, set by a flag
+var banFile string
+
+// Ban is a peer that is banned until a given time
+type Ban struct {
+	Address string `json:"address"`
+	Until   int64  `json:"until"` // UnixNano
+	Reason  string `json:"reason"`
+}
+
+// banList holds the misbehaviour scores and bans of peers by their host
+type banList struct {
+	sync.Mutex
+	file   string
+	scores map[string]int
+	bans   map[string]Ban
+}
+
+// newBanList creates a ban list that is stored in the file. Existing bans are loaded from it.
+// Without a file the bans are kept in memory only.
+func newBanList(file string) *banList {
+	list := &banList{file: file, scores: make(map[string]int), bans: make(map[string]Ban)}
+	if err := list.load(); err != nil {
+		glog.Warningf("Could not load the bans from %s: %s", file, err)
+	}
+	return list
+}
+
+// banList returns the bans of the network
+func (nodes *Nodes) banList() *banList {
+	if nodes.bans == nil {
+		nodes.bans = newBanList("")
+	}
+	return nodes.bans
+}
+
+// peerAddress returns the host of an address, which is either an url (http://host:port) or host:port.
+func peerAddress(address string) string {
+	if strings.Contains(address, "://") {
+		if u, err := url.Parse(address); err == nil {
+			return u.Hostname()
+		}
+	}
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+// misbehave increases the score of a peer. Returns true if the peer is banned because of it.
+func (list *banList) misbehave(address string, score int, reason string) bool {
+	host := peerAddress(address)
+	list.Lock()
+	defer list.Unlock()
+	list.scores[host] += score
+	glog.Warningf("Peer %s misbehaved (%s), score %d", host, reason, list.scores[host])
+	if list.scores[host] < banThreshold {
+		return false
+	}
+
+	delete(list.scores, host)
+	list.bans[host] = Ban{Address: host, Until: time.Now().Add(banDuration).UnixNano(), Reason: reason}
+	glog.Warningf("Peer %s is banned until %s", host, time.Now().Add(banDuration))
+	if err := list.save(); err != nil {
+		glog.Errorf("Could not save the bans: %s", err)
+	}
+	return true
+}
+
+// isBanned tells if a peer is banned. Expired bans are removed.
+func (list *banList) isBanned(address string) bool {
+	host := peerAddress(address)
+	list.Lock()
+	defer list.Unlock()
+	ban, ok := list.bans[host]
+	if ok && ban.Until < time.Now().UnixNano() {
+		delete(list.bans, host)
+		return false
+	}
+	return ok
+}
+
+// all returns the bans, sorted by address, and the misbehaviour scores of peers that are not banned
+func (list *banList) all() ([]Ban, map[string]int) {
+	list.Lock()
+	defer list.Unlock()
+	bans := []Ban{}
+	for _, ban := range list.bans {
+		bans = append(bans, ban)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Address < bans[j].Address })
+	scores := make(map[string]int, len(list.scores))
+	for host, score := range list.scores {
+		scores[host] = score
+	}
+	return bans, scores
+}
+
+// clear lifts the ban and resets the score of a peer, or of all peers if the address is empty.
+// Returns the number of bans lifted.
+func (list *banList) clear(address string) int {
+	host := peerAddress(address)
+	list.Lock()
+	defer list.Unlock()
+	cleared := 0
+	if address == "" {
+		cleared = len(list.bans)
+		list.bans = make(map[string]Ban)
+		list.scores = make(map[string]int)
+	} else {
+		if _, ok := list.bans[host]; ok {
+			cleared = 1
+		}
+		delete(list.bans, host)
+		delete(list.scores, host)
+	}
+	if err := list.save(); err != nil {
+		glog.Errorf("Could not save the bans: %s", err)
+	}
+	return cleared
+}
+
+// load reads the bans from the file. The list should be locked.
+func (list *banList) load() error {
+	if list.file == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(list.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var bans []Ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return err
+	}
+	for _, ban := range bans {
+		list.bans[ban.Address] = ban
+	}
+	return nil
+}
+
+// save writes the bans to the file. The list should be locked.
+func (list *banList) save() error {
+	if list.file == "" {
+		return nil
+	}
+	bans := make([]Ban, 0, len(list.bans))
+	for _, ban := range list.bans {
+		bans = append(bans, ban)
+	}
+	data, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(list.file, data, 0600)
+}
+
+// rejectBanned is a middleware that refuses requests from banned peers. Requests with the admin token are
+// always allowed, so the bans can be managed from any host.
+func rejectBanned(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasAdminToken(r) && nodes.banList().isBanned(r.RemoteAddr) {
+			respondWithError(w, http.StatusForbidden, "Banned")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The token that authorizes requests to the admin endpoints from other hosts, set by a flag. Without a token
+// only requests from the node's own host (loopback) are authorized.
+var adminToken string
+
+// adminOnly refuses requests to an admin endpoint (e.g. to lift bans) that come from another host without the
+// admin token, so peers can't manage the node
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := net.ParseIP(peerAddress(r.RemoteAddr))
+		if (ip == nil || !ip.IsLoopback()) && !hasAdminToken(r) {
+			respondWithError(w, http.StatusForbidden, "Admin only")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// hasAdminToken tells if the request is authorized with the admin token (Authorization: Bearer {token})
+func hasAdminToken(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
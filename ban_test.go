@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPeerAddress(t *testing.T) {
+	for address, expected := range map[string]string{
+		"http://127.0.0.1:8001": "127.0.0.1",
+		"192.0.2.1:1234":        "192.0.2.1",
+		"[::1]:8000":            "::1",
+		"localhost":             "localhost",
+	} {
+		if host := peerAddress(address); host != expected {
+			t.Errorf("Expected host %s of %s, got %s", expected, address, host)
+		}
+	}
+}
+
+func TestBanMisbehavingPeer(t *testing.T) {
+	saveGlobals(t)
+
+	a := newTestChain("ban")
+	genesis := a.bc.Chain[0]
+	invalid := Block{Index: 2, PreviousHash: hash(genesis)}
+	for a.bc.consensus().verifySeal(genesis.header(), invalid.header()) == nil {
+		invalid.Proof++
+	}
+
+	sender := a.newPeer("ban-sender").me
+	for i := 0; i < banThreshold/scoreInvalidBlock; i++ {
+		code := a.announceBlock(t, sender, invalid, nil)
+		if code != http.StatusConflict {
+			t.Fatalf("Invalid block should be refused, got %d", code)
+		}
+	}
+	// requests of the test recorder come from 192.0.2.1
+	if code := a.call(t, "GET", "/status", nil, nil); code != http.StatusForbidden {
+		t.Errorf("Requests of a banned peer should be refused, got %d", code)
+	}
+
+	// a peer can't lift it's own ban, or the bans of others
+	if code := a.call(t, "DELETE", "/bans/192.0.2.1", nil, nil); code != http.StatusForbidden {
+		t.Errorf("Banned peer should not lift it's own ban, got %d", code)
+	}
+	other := httptest.NewRequest("DELETE", "/bans", nil)
+	other.RemoteAddr = "192.0.2.2:1234"
+	if code := a.serve(t, other, nil); code != http.StatusForbidden {
+		t.Errorf("Peer should not lift the bans, got %d", code)
+	}
+
+	var resp struct {
+		Bans []Ban `json:"bans"`
+	}
+	local := httptest.NewRequest("GET", "/bans", nil)
+	local.RemoteAddr = "127.0.0.1:1234"
+	a.serve(t, local, &resp)
+	if len(resp.Bans) != 1 || resp.Bans[0].Address != "192.0.2.1" {
+		t.Fatalf("Expected a ban of 192.0.2.1, got %v", resp.Bans)
+	}
+
+	prevToken := adminToken
+	t.Cleanup(func() { adminToken = prevToken })
+	adminToken = "s3cret"
+	admin := httptest.NewRequest("DELETE", "/bans/192.0.2.1", nil)
+	admin.Header.Set("Authorization", "Bearer s3cret")
+	if code := a.serve(t, admin, nil); code != http.StatusOK {
+		t.Errorf("Admin should lift the ban from another host, got %d", code)
+	}
+	if code := a.call(t, "GET", "/status", nil, nil); code != http.StatusOK {
+		t.Errorf("Ban should be lifted, got %d", code)
+	}
+}
+
+func TestBansPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "bans.json")
+
+	list := newBanList(file)
+	if list.misbehave("http://10.0.0.1:8000", scoreInvalidTransaction, "invalid transaction") {
+		t.Error("Peer should not be banned below the threshold")
+	}
+	if !list.misbehave("10.0.0.1:1234", banThreshold, "invalid block") {
+		t.Error("Peer should be banned above the threshold")
+	}
+
+	reloaded := newBanList(file)
+	if !reloaded.isBanned("10.0.0.1:5678") {
+		t.Error("Ban should be loaded from the file")
+	}
+	if cleared := reloaded.clear(""); cleared != 1 {
+		t.Errorf("Expected 1 ban cleared, got %d", cleared)
+	}
+	if newBanList(file).isBanned("10.0.0.1") {
+		t.Error("Cleared ban should be removed from the file")
+	}
+
+	list.bans["10.0.0.2"] = Ban{Address: "10.0.0.2", Until: time.Now().Add(-time.Second).UnixNano()}
+	if list.isBanned("10.0.0.2") {
+		t.Error("Expired ban should be lifted")
+	}
+}
@@ -2,48 +2,124 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/gob"
 	"fmt"
-	"net/http"
 
 	"github.com/grrrben/glog"
 )
 
 type Block struct {
 	Index        int64         `json:"index"`
+	Version      int32         `json:"version"` // signals for deployments, see versionbits
 	Timestamp    int64         `json:"timestamp"`
 	Transactions []Transaction `json:"transactions"`
 	Proof        int64         `json:"proof"`
 	PreviousHash string        `json:"previousHash"`
+	Seal
 }
 
-// announceMinedBlock shares the block with other nodes. It is done in a goroutine.
-// Other nodes should check the validity of the new block on their chain and add it.
-func announceMinedBlock(cl Node, bl Block) {
-	url := fmt.Sprintf("%s/block/distributed", cl.getAddress())
+// Seal is the part of a block that is set by a consensus engine other than proof of work
+type Seal struct {
+	Slot       int64       `json:"slot,omitempty"`
+	Difficulty int64       `json:"difficulty,omitempty"`
+	Signer     string      `json:"signer,omitempty"`    // public key of the signer of the block
+	Signature  string      `json:"signature,omitempty"` // of the seal hash by the signer
+	Vote       *SignerVote `json:"vote,omitempty"`      // of the signer, to add or remove a signer
+}
+
+// BlockHeader is a Block without the transactions, it holds the hash of the transactions instead.
+// The hash of a block is the hash of it's header, so a chain of headers can be validated
+// before the blocks themselves are downloaded.
+type BlockHeader struct {
+	Index            int64  `json:"index"`
+	Version          int32  `json:"version"`
+	Timestamp        int64  `json:"timestamp"`
+	Proof            int64  `json:"proof"`
+	PreviousHash     string `json:"previousHash"`
+	TransactionsHash string `json:"transactionsHash"`
+	Seal
+}
 
-	blockAndSender := map[string]interface{}{"block": bl, "sender": me.getAddress()}
-	payload, err := json.Marshal(blockAndSender)
+// header returns the header of the block
+func (bl Block) header() BlockHeader {
+	return BlockHeader{
+		Index:            bl.Index,
+		Version:          bl.Version,
+		Timestamp:        bl.Timestamp,
+		Proof:            bl.Proof,
+		PreviousHash:     bl.PreviousHash,
+		TransactionsHash: transactionsHash(bl.Transactions),
+		Seal:             bl.Seal,
+	}
+}
+
+// hash Creates a SHA-256 hash of a header, which is the hash of it's block
+func (h BlockHeader) hash() string {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(h)
 	if err != nil {
-		glog.Panicf("Could not marshall block or node. Msg: %s", err)
+		glog.Errorf("Could not compute hash: %s", err)
 	}
+	return fmt.Sprintf("%x", sha256.Sum256(buf.Bytes()))
+}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
+// transactionsHash creates a SHA-256 hash of all transactions, including their scripts and witnesses
+func transactionsHash(trs []Transaction) string {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(trs)
 	if err != nil {
-		glog.Errorf("Request setup error: %s", err)
-	} else {
-		req.Header.Set("Content-Type", "application/json")
-
-		client := &http.Client{}
-		resp, err := client.Do(req)
-		if err != nil {
-			glog.Warningf("POST request error: %s", err)
-			// I don't want to panic here, but it might be a good idea to
-			// remove the node from the list
-		} else {
-			resp.Body.Close()
+		glog.Errorf("Could not compute hash: %s", err)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(buf.Bytes()))
+}
+
+// checkTransactions validates the transactions of a block that is placed after the given chain.
+// All transactions should be final, scripts should unlock the senders and the senders
+// should have enough spendable credits (or tokens), including the transactions before them in the block.
+// A transaction may occur only once in the chain, a block has at most one coinbase and no value may be negative.
+func (bl Block) checkTransactions(chain []Block) error {
+	seen := chainTransactions(chain)
+	coinbases := 0
+	for i, tr := range bl.Transactions {
+		if tr.Amount < 0 || tr.LockTime < 0 || tr.RelativeLock < 0 {
+			return fmt.Errorf("transaction %s has a negative value", tr.getHash())
+		}
+		if !tr.isFinal(bl.Index, bl.Timestamp) {
+			return fmt.Errorf("transaction %s is not final in block %d", tr.getHash(), bl.Index)
+		}
+		if seen[tr.getHash()] {
+			return fmt.Errorf("transaction %s is already in the chain", tr.getHash())
+		}
+		seen[tr.getHash()] = true
+		if tr.payloads() > 1 {
+			return fmt.Errorf("transaction %s carries more than one payload", tr.getHash())
+		}
+		if err := checkTokenTransaction(tr, chain, bl.Transactions[:i], bl.Index); err != nil {
+			return fmt.Errorf("transaction %s: %s", tr.getHash(), err)
+		}
+		if tr.Sender == zerohash && tr.Stake == nil {
+			if coinbases++; coinbases > 1 {
+				return fmt.Errorf("block %d has more than one coinbase", bl.Index)
+			}
+			continue
+		}
+		if tr.Channel != nil {
+			if err := checkChannelTransaction(tr, chain, bl.Transactions[:i], bl.Index); err != nil {
+				return fmt.Errorf("transaction %s: %s", tr.getHash(), err)
+			}
+		} else if tr.Stake != nil || tr.Sender == stakeAddress {
+			if err := checkStakeTransaction(tr, chain, bl.Transactions[:i], bl.Index); err != nil {
+				return fmt.Errorf("transaction %s: %s", tr.getHash(), err)
+			}
+		} else if err := checkTransactionScript(tr); err != nil {
+			return fmt.Errorf("transaction %s: %s", tr.getHash(), err)
+		}
+		if tr.Token == "" && walletCredits(tr.Sender, chain, bl.Transactions[:i], bl.Index) < tr.Amount {
+			return fmt.Errorf("transaction %s: insufficient spendable credit", tr.getHash())
 		}
 	}
+	return nil
 }
 
 // Block = {
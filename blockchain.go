@@ -1,31 +1,36 @@
 package main
 
 import (
-	"bytes"
-	"crypto/sha256"
-	"encoding/gob"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"net/http"
 	"sync"
 	"time"
 
 	"github.com/grrrben/glog"
 )
 
-// how many zero's do we want in the hash
-const hashDifficulty int8 = 4
+// how many zero's do we want in the hash of the proof of work
+const hashDifficulty = 4
 
-// This should be the hash ending in the proof of work
-const hashEndsWith string = "0000"
+// The proof of the genesis block, which is not sealed
+const genesisProof = 100
 
-// The incentive paid to the miner of a minted block
-const minersIncentive = 1
+// The incentive paid to the miner of a minted block, the subsidy of the network
+var minersIncentive = networks["mainnet"].Subsidy
 
+// Blockchain is locked while blocks are added or the chain is replaced, never during network requests.
 type Blockchain struct {
+	sync.Mutex
 	Chain        []Block
 	Transactions []Transaction
+	orphans      *orphanPool
+	index        *blockIndex
+	engine       ConsensusEngine
+	finality     *Finality
+	nodes        *Nodes       // the network of this node, the chain is gossiped and synced with
+	self         *Node        // this node
+	channels     *channelList // the payment channels of this node, watched as the chain changes
 }
 
 // StatusReport is used to fetch the information regarding the blockchain from other nodes in the network.
@@ -43,19 +48,26 @@ type NodeLength struct {
 // The Transaction is stored in the Blockchain obj.
 // Returns the Transation with an added Time property
 func (bc *Blockchain) newTransaction(transaction Transaction) (tr Transaction, err error) {
-	_, err = checkTransaction(transaction)
+	if transaction.Time == 0 {
+		transaction.Time = time.Now().UnixNano()
+	}
+	_, err = bc.checkTransaction(transaction)
 
 	if err != nil {
 		return transaction, err
 	} else {
-		if transaction.Time == 0 {
-			transaction.Time = time.Now().UnixNano()
-		}
 		bc.Transactions = append(bc.Transactions, transaction)
 		return transaction, nil
 	}
 }
 
+// addTransaction adds a new transaction of the API, it locks the chain while the transaction is checked and added
+func (bc *Blockchain) addTransaction(transaction Transaction) (Transaction, error) {
+	bc.Lock()
+	defer bc.Unlock()
+	return bc.newTransaction(transaction)
+}
+
 // isNonExistingTransaction loops the current list of Transactions
 // to check if the new Transactions is already known on this Node
 func (bc *Blockchain) isNonExistingTransaction(newTr Transaction) bool {
@@ -88,14 +100,9 @@ func (bc *Blockchain) clearTransactions(trs []Transaction) {
 	bc.Transactions = transactionsNotInMinedBlock
 }
 
-// Hash Creates a SHA-256 hash of a Block
+// Hash Creates a SHA-256 hash of a Block, which is the hash of it's header
 func hash(bl Block) string {
-	var buf bytes.Buffer
-	err := gob.NewEncoder(&buf).Encode(bl)
-	if err != nil {
-		glog.Errorf("Could not compute hash: %s", err)
-	}
-	return fmt.Sprintf("%x", sha256.Sum256(buf.Bytes())) // %x; base 16, with lower-case letters for a-f
+	return bl.header().hash()
 }
 
 // lastBlock returns the last Block in the Chain
@@ -103,49 +110,79 @@ func (bc *Blockchain) lastBlock() Block {
 	return bc.Chain[len(bc.Chain)-1]
 }
 
-// proofOfWork is a simple Proof of Work Algorithm:
-// Find a number p such that hash('lp') contains leading X zeroes, where
-// l is the previous Proof, and p is the new Proof
-func (bc *Blockchain) proofOfWork(lastProof int64) int64 {
-	var proof int64 = 0
-	for !bc.validProof(lastProof, proof) {
-		proof++
+// peers returns the network of the chain, the global network if it has none
+func (bc *Blockchain) peers() *Nodes {
+	if bc.nodes == nil {
+		return nodes
 	}
-	glog.Infof("Proof found in %d cycles (difficulty %d)\n", proof, hashDifficulty)
-	return proof
+	return bc.nodes
 }
 
-// validProof is called until it finds an acceptable hash and returns true
-func (bc *Blockchain) validProof(proof, lastProof int64) bool {
-	guess := fmt.Sprintf("%d%d", lastProof, proof)
-	guessHash := fmt.Sprintf("%x", sha256.Sum256([]byte(guess)))
-	return guessHash[:hashDifficulty] == hashEndsWith
+// node returns this node, the global node if the chain has none
+func (bc *Blockchain) node() Node {
+	if bc.self == nil {
+		return me
+	}
+	return *bc.self
 }
 
-// newBlock add's a new block to the chain and resets the transactions as new transactions will be added
-// to the next block
-func (bc *Blockchain) newBlock(proof int64) Block {
-	var prevHash string
-	if len(bc.Chain) == 0 {
-		// this is the genesis block
-		prevHash = zerohash
-	} else {
-		prevBlock := bc.Chain[len(bc.Chain)-1]
-		prevHash = hash(prevBlock)
+// channelList returns the payment channels of this node, the global channels if the chain has none
+func (bc *Blockchain) channelList() *channelList {
+	if bc.channels == nil {
+		return channels
 	}
+	return bc.channels
+}
 
+// length returns the length of the chain, it's locked as blocks are added in the background
+func (bc *Blockchain) length() int {
+	bc.Lock()
+	defer bc.Unlock()
+	return len(bc.Chain)
+}
+
+// newBlock add's a new block with the given transactions to the chain and removes them from the
+// pending transactions as new transactions will be added to the next block.
+// The block is sealed by the consensus engine, except for the genesis block.
+func (bc *Blockchain) newBlock(transactions []Transaction) (Block, error) {
 	block := Block{
 		Index:        int64(len(bc.Chain) + 1),
 		Timestamp:    time.Now().UnixNano(),
-		Transactions: bc.Transactions,
-		Proof:        proof,
-		PreviousHash: prevHash,
+		Transactions: transactions,
+	}
+	if len(bc.Chain) == 0 {
+		// this is the genesis block
+		block.Proof = genesisProof
+		block.PreviousHash = zerohash
+	} else {
+		prevBlock := bc.Chain[len(bc.Chain)-1]
+		block.PreviousHash = hash(prevBlock)
+		if mtp := medianTimePast(bc.Chain); block.Timestamp <= mtp {
+			block.Timestamp = mtp + 1 // our clock is behind
+		}
+		block.Version = blockVersion(bc.Chain)
+		if err := block.checkTransactions(bc.Chain); err != nil {
+			return block, err
+		}
+		if err := bc.consensus().seal(prevBlock.header(), &block); err != nil {
+			return block, err
+		}
+		if err := bc.consensus().verifyBlock(bc.Chain, block); err != nil {
+			return block, err
+		}
+		if err := checkDeployments(bc.Chain, block); err != nil {
+			return block, err
+		}
 	}
 
-	bc.Transactions = nil // reset transactions as the block will be added to the chain
+	bc.clearTransactions(transactions) // the transactions are added to the chain with the block
+	if len(bc.Chain) > 0 {
+		bc.accepted(bc.lastBlock().header(), block.header())
+	}
 	bc.Chain = append(bc.Chain, block)
-	nodes.announceMinedBlocks(block)
-	return block
+	bc.watchChannels()
+	bc.peers().announceMinedBlocks(bc.node(), block)
+	return block, nil
 }
 
 // addBlock performs a validity check on the new block, if valid it add's the block to the chain.
@@ -154,20 +191,63 @@ func (bc *Blockchain) addBlock(bl Block) (Block, error) {
 
 	lastBlock := bc.Chain[len(bc.Chain)-1]
 
-	if bc.validProof(lastBlock.Proof, bl.Proof) {
-		glog.Info("Added a new block due to an announcement.")
-		bc.Chain = append(bc.Chain, bl)
-		return bl, nil
+	if bl.PreviousHash != hash(lastBlock) {
+		return bl, errors.New("Block does not follow the last block.")
+	}
+	if err := bc.consensus().verifySeal(lastBlock.header(), bl.header()); err != nil {
+		return bl, err
+	}
+	if err := bc.consensus().verifyBlock(bc.Chain, bl); err != nil {
+		return bl, err
+	}
+	if err := bc.finalityRules().checkHeader(bl.header()); err != nil {
+		return bl, err
+	}
+	if err := bc.checkBlockTime(bc.Chain, bl.header()); err != nil {
+		return bl, err
 	}
-	return bl, errors.New("Could not add the newly announced block.")
+	if err := checkDeployments(bc.Chain, bl); err != nil {
+		return bl, err
+	}
+	if err := bl.checkTransactions(bc.Chain); err != nil {
+		return bl, err
+	}
+	glog.Info("Added a new block due to an announcement.")
+	bc.Chain = append(bc.Chain, bl)
+	bc.accepted(lastBlock.header(), bl.header())
+	return bl, nil
+}
+
+// receiveBlock adds a block announced by another node. A block of which the parent is unknown
+// is kept in the orphan pool. Returns true if the block is added to the chain.
+func (bc *Blockchain) receiveBlock(bl Block, sender string) (bool, error) {
+	bc.Lock()
+	defer bc.Unlock()
+	if bc.findFork([]string{hash(bl)}) >= 0 {
+		return false, nil // known already, e.g. it was synced meanwhile
+	}
+	if _, err := bc.addBlock(bl); err != nil {
+		if bc.findFork([]string{bl.PreviousHash}) >= 0 {
+			return false, err
+		}
+		bc.addOrphan(bl, sender)
+		return false, nil
+	}
+	bc.clearTransactions(bl.Transactions)
+	bc.connectOrphans()
+	bc.watchChannels()
+	return true, nil
 }
 
 // analyseInvalidBlock
 // shows us why a newly sent block could not be added to the chain.
-// and tries to add more blocks if we are missing multiple.
+// The fork point with the chain of the sender is found with a locator, the blocks we lack are fetched
+// from the sender and if they make a longer valid chain, our chain is replaced.
 func (bc *Blockchain) analyseInvalidBlock(bl Block, sender string) bool {
-
-	lastBlock := bc.Chain[len(bc.Chain)-1]
+	bc.Lock()
+	lastBlock := bc.lastBlock()
+	locator := bc.locator()
+	bc.Unlock()
 
 	glog.Info("----------------------------------")
 	defer glog.Info("----------------------------------")
@@ -176,62 +256,116 @@ func (bc *Blockchain) analyseInvalidBlock(bl Block, sender string) bool {
 	glog.Infof("Last block: index: %d", lastBlock.Index)
 	glog.Infof("%v", lastBlock)
 
-	if lastBlock.Index < (bl.Index - 1) {
-		var i int64 // 0
-		for {
-			i++
-			var nextBlock Block
-
-			url := fmt.Sprintf("%s/block/index/%d", sender, lastBlock.Index+i)
-			glog.Infof("Fetching block %d from $s", lastBlock.Index+i, sender)
+	if bl.Index < lastBlock.Index {
+		glog.Warningf("Block %d of %s does not make a longer chain", bl.Index, sender)
+		return false
+	}
 
-			resp, err := http.Get(url)
-			if err != nil {
-				glog.Warningf("Request error: %s", err)
-				return false
-			}
+	var forkHash string
+	var blocks []Block
+	for {
+		h, batch, err := fetchBlocksAfter(sender, locator)
+		if err != nil {
+			glog.Warningf("Could not fetch blocks from %s: %s", sender, err)
+			return false
+		}
+		if forkHash == "" {
+			forkHash = h
+		}
+		blocks = append(blocks, batch...)
+		if len(batch) < maxBlocksPerLocator {
+			break
+		}
+		locator = []string{hash(batch[len(batch)-1])}
+	}
+	glog.Infof("Fork point with %s at block %s, fetched %d blocks", sender, forkHash, len(blocks))
+	if len(blocks) == 0 {
+		return false
+	}
 
-			decodingErr := json.NewDecoder(resp.Body).Decode(&nextBlock)
-			if decodingErr != nil {
-				glog.Warningf("Decoding error: %s", err)
-				return false
-			}
+	candidate, err := bc.candidateAfter(forkHash, blocks, sender)
+	if err != nil {
+		glog.Warningf("Chain of %s is not accepted: %s", sender, err)
+		return false
+	}
+	if !candidate.validate() {
+		glog.Warningf("Chain of %s is invalid", sender)
+		return false
+	}
+	if !bc.replaceChain(candidate, blocks) {
+		return false
+	}
+	glog.Infof("Successfully added %d blocks", len(blocks))
+	return true
+}
 
-			_, err = bc.addBlock(nextBlock)
-			if err != nil {
-				glog.Warningf("Could not add block %d from %s: %s", lastBlock.Index+i, sender, err)
-				return false
-			}
-			defer resp.Body.Close()
+// candidateAfter returns a candidate chain made of our chain up to the fork point and the blocks of a peer that
+// follow it, or only the blocks of the peer if they start at a genesis block. The finality rules should allow the reorg and the consensus engine should prefer the candidate, which
+// is not validated yet. The chain is locked while the candidate is made, not while it's validated.
+func (bc *Blockchain) candidateAfter(forkHash string, blocks []Block, peer string) (*Blockchain, error) {
+	bc.Lock()
+	defer bc.Unlock()
+	fork := bc.findFork([]string{forkHash})
+	if fork < 0 && forkHash != zerohash {
+		return nil, errors.New("no common block")
+	}
+	if err := bc.finalityRules().checkReorg(bc.Chain, fork, peer, blocks[len(blocks)-1].header()); err != nil {
+		return nil, err
+	}
+	candidate := &Blockchain{Chain: append(append([]Block{}, bc.Chain[:fork+1]...), blocks...), engine: bc.engine, finality: bc.finality, nodes: bc.nodes}
+	if !bc.prefers(candidate.Chain) {
+		return nil, errors.New("the chain is not preferred")
+	}
+	return candidate, nil
+}
 
-			if (lastBlock.Index + i) == bl.Index {
-				glog.Infof("Successfully added %d blocks", i)
-				break
-			}
-		}
-	} else {
-		// something else went wrong.
-		glog.Warning("Unable to analyse")
+// replaceChain replaces the chain with a valid candidate the consensus engine prefers. The transactions of
+// the new blocks are removed from the pending transactions. Returns false if the chain has grown meanwhile and
+// the candidate is not preferred anymore.
+func (bc *Blockchain) replaceChain(candidate *Blockchain, blocks []Block) bool {
+	bc.Lock()
+	defer bc.Unlock()
+	if !bc.prefers(candidate.Chain) {
+		glog.Warningf("Blockchain not replaced, the chain has grown to %d blocks", len(bc.Chain))
 		return false
 	}
-
+	glog.Infof("Blockchain replaced. Found length of %d instead of current %d.", len(candidate.Chain), len(bc.Chain))
+	bc.Chain = candidate.Chain
+	for _, bl := range blocks {
+		bc.clearTransactions(bl.Transactions)
+	}
+	bc.connectOrphans()
+	bc.watchChannels()
 	return true
 }
 
 // initBlockchain initialises the blockchain
 // Returns a pointer to the blockchain object that the app can alter later on
 // If there already is a network, the chain is fetched from the network, otherwise a genesis block is created.
+// With a genesis spec every node starts with the genesis block of the spec.
 func initBlockchain() *Blockchain {
 	// init the blockchain
 	newBlockchain := &Blockchain{
 		Chain:        make([]Block, 0),
 		Transactions: make([]Transaction, 0),
+		orphans:      newOrphanPool(),
+		index:        newBlockIndex(),
+		engine:       engine,
+		finality:     finality,
+		nodes:        nodes,
+		self:         &me,
+		channels:     channels,
 	}
 	glog.Infof("init Blockchain\n %v", newBlockchain)
 
-	if me.Port == 8000 {
+	if genesis != nil {
+		// every node derives the genesis block from the spec, the blocks that follow are synced
+		newBlockchain.Chain = append(newBlockchain.Chain, genesis.block())
+		glog.Infof("Genesis Block of %s:\n %v", genesis.ChainID, newBlockchain.Chain[0])
+		newBlockchain.resolve()
+	} else if me.Port == network.Port {
 		// Mother node. Adding a first, Genesis, Block to the Chain
-		b := newBlockchain.newBlock(100)
+		b, _ := newBlockchain.newBlock(nil)
 		glog.Infof("Adding Genesis Block:\n %v", b)
 	} else {
 		newBlockchain.resolve()
@@ -245,15 +379,15 @@ func initBlockchain() *Blockchain {
 // it is used at the startup
 func (bc *Blockchain) getCurrentTransactions() bool {
 	defer glog.Flush()
-	if len(nodes.List) > 1 {
-		for _, node := range nodes.List {
+	if nodes.num() > 1 {
+		for _, node := range nodes.list() {
 			url := fmt.Sprintf("%s/transactions", node.getAddress())
 
 			if me.getAddress() == node.getAddress() {
 				// it is I, skip it
 				continue
 			}
-			resp, err := http.Get(url)
+			resp, err := httpClient.Get(url)
 			if err != nil {
 				glog.Warningf("Transactions request error: %s", err)
 				continue
@@ -283,6 +417,12 @@ func (bc *Blockchain) validate() bool {
 	defer glog.Flush()
 	chainLength := len(bc.Chain)
 
+	for _, bl := range bc.Chain {
+		if err := bc.finalityRules().checkHeader(bl.header()); err != nil {
+			glog.Warningf("Invalid chain: %s", err)
+			return false
+		}
+	}
 	if chainLength == 1 {
 		return true
 	}
@@ -297,95 +437,80 @@ func (bc *Blockchain) validate() bool {
 			return false
 		}
 
-		// Check that the Proof of Work is correct
-		if !bc.validProof(previous.Proof, current.Proof) {
-			glog.Warningf("Invalid proof of block %d, with previous block %d", current.Index, previous.Index)
+		// Check that the seal is correct, e.g. the Proof of Work
+		if err := bc.consensus().verifySeal(previous.header(), current.header()); err != nil {
+			glog.Warningf("Invalid seal of block %d, with previous block %d: %s", current.Index, previous.Index, err)
+			return false
+		}
+		if err := bc.consensus().verifyBlock(bc.Chain[:i], current); err != nil {
+			glog.Warningf("Invalid seal of block %d: %s", current.Index, err)
+			return false
+		}
+		if err := bc.checkBlockTime(bc.Chain[:i], current.header()); err != nil {
+			glog.Warningf("Invalid block %d: %s", current.Index, err)
+			return false
+		}
+		if err := checkDeployments(bc.Chain[:i], current); err != nil {
+			glog.Warningf("Invalid block %d: %s", current.Index, err)
+			return false
+		}
+
+		if err := current.checkTransactions(bc.Chain[:i]); err != nil {
+			glog.Warningf("Invalid transactions in block %d: %s", current.Index, err)
 			return false
 		}
+		bc.accepted(previous.header(), current.header())
 	}
 	return true
 }
 
-// mine Mines a block and puts all transactions in the block
-// An incentive is paid to the miner and the list of transactions is cleared
+// mine Mines a block and puts all final transactions in the block
+// An incentive is paid to the miner and the transactions are removed from the list,
+// transactions that are still time locked are kept for a later block.
 func (bc *Blockchain) mine() (Block, error) {
-	var block Block
+	bc.Lock()
+	defer bc.Unlock()
 	lastBlock := bc.lastBlock()
-	lastProof := lastBlock.Proof
+	self := bc.node()
 
-	proof := bc.proofOfWork(lastProof)
 	transaction := Transaction{
-		zerohash,
-		me.Hash,
-		minersIncentive,
-		fmt.Sprintf("Mined by %s", me.getAddress()),
-		time.Now().UnixNano(),
-	}
-	_, err := bc.newTransaction(transaction)
-	if err != nil {
-		return block, err
+		Sender:    zerohash,
+		Recipient: self.Hash,
+		Amount:    minersIncentive,
+		Message:   fmt.Sprintf("Mined by %s", self.getAddress()),
+		Time:      time.Now().UnixNano(),
 	}
-	block = bc.newBlock(proof)
-	return block, nil
-}
 
-// resolve is the Consensus Algorithm, it resolves conflicts by replacing our chain with the longest one in the network.
-// Returns bool. True if our chain was replaced, false if not
-func (bc *Blockchain) resolve() bool {
-	glog.Infof("Resolving conflicts (nodes %d):", len(nodes.List))
-	replaced := false
-
-	// first, let's grep some of the lengths of the different node chains.
-	nodes := bc.chainLengthPerNode()
-
-	for _, pair := range nodes {
-
-		var node Node
-		node = pair.Key.(Node) // getting the type back as the interface{} signature didn't give hints
-		if node == me {
+	index := lastBlock.Index + 1
+	now := time.Now().UnixNano()
+	var transactions, invalid []Transaction
+	for _, tr := range bc.Transactions {
+		if tr.Sender == zerohash && tr.Stake == nil {
+			invalid = append(invalid, tr) // only our coinbase may mint coins
 			continue
 		}
-		url := fmt.Sprintf("%s/chain", node.getAddress())
-		resp, err := http.Get(url)
-		if err != nil {
-			glog.Warningf("Chain request error: %s", err)
-			// I don't want to panic here, but it could be a good idea to
-			// remove the node from the list
+		if !tr.isFinal(index, now) {
 			continue
 		}
-
-		var extChain Blockchain
-		decodingErr := json.NewDecoder(resp.Body).Decode(&extChain)
-
-		if decodingErr != nil {
-			glog.Warningf("Could not decode JSON of external blockchain: %s", err)
+		// a pending transaction may be invalid after a reorg, or spend credits that are spent in the block already
+		candidate := Block{Index: index, Timestamp: now, Transactions: append(transactions[:len(transactions):len(transactions)], tr)}
+		if err := candidate.checkTransactions(bc.Chain); err != nil {
+			glog.Warningf("Removing pending transaction %s: %s", tr.getHash(), err)
+			invalid = append(invalid, tr)
 			continue
 		}
-
-		if len(extChain.Chain) > len(bc.Chain) {
-			// check if the chain is valid.
-			oldChain := bc.Chain
-			bc.Chain = extChain.Chain
-			valid := bc.validate()
-
-			if valid {
-				glog.Infof("Blockchain replaced. Found length of %d instead of current %d.", len(extChain.Chain), len(bc.Chain))
-				glog.Infof("Synced with %s\n", node.getAddress())
-				replaced = true
-			} else {
-				// reset to old blockchain
-				bc.Chain = oldChain
-			}
-
-		}
-		resp.Body.Close()
-
-		if replaced {
-			// we have a new, valid, chain.
-			break
-		}
+		transactions = append(transactions, tr)
 	}
-	return replaced
+	bc.clearTransactions(invalid)
+	return bc.newBlock(append(transactions, transaction))
+}
+
+// resolve is the Consensus Algorithm, it resolves conflicts by replacing our chain with the longest one in the network.
+// The chain is synced headers first, see sync.
+// Returns bool. True if our chain was replaced, false if not
+func (bc *Blockchain) resolve() bool {
+	glog.Infof("Resolving conflicts (nodes %d):", nodes.num())
+	return bc.sync()
 }
 
 // chainLengthPerNode get a map of nodes with their respective chain length
@@ -399,7 +524,7 @@ func (bc *Blockchain) chainLengthPerNode() PairList {
 
 	var wg sync.WaitGroup
 
-	for i, cl := range nodes.List {
+	for i, cl := range nodes.list() {
 		if cl == me {
 			continue
 		}
@@ -421,7 +546,7 @@ func (bc *Blockchain) chainLengthPerNode() PairList {
 	}
 
 	for err := range errChannel {
-		glog.Warningf("Error in fetching list of node statusses", err)
+		glog.Warningf("Error in fetching list of node statusses: %s", err)
 	}
 
 	glog.Infof("Length of nodes:\n%v\n", len(nodeLength))
@@ -436,7 +561,7 @@ func chainLengthOfNode(cl Node, wg *sync.WaitGroup, channel chan NodeLength, err
 	defer wg.Done()
 
 	url := fmt.Sprintf("%s/status", cl.getAddress())
-	resp, err := http.Get(url)
+	resp, err := httpClient.Get(url)
 	if err != nil {
 		select {
 		case errorChannel <- err:
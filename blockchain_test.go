@@ -1,7 +1,7 @@
 package main
 
 import (
-	"flag"
+	"strings"
 	"testing"
 	"time"
 
@@ -18,8 +18,6 @@ import (
 
 func init() {
 	// setup
-	flag.Parse()
-
 	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
 	if err != nil {
 		log.Fatalf("Could not set a logdir. Msg %s", err)
@@ -57,11 +55,11 @@ func TestInitBlockchain(t *testing.T) {
 
 func TestNewTransaction(t *testing.T) {
 	transaction := Transaction{
-		"sender",
-		"receiver",
-		1,
-		"",
-		time.Now().UnixNano(),
+		Sender:    "sender",
+		Recipient: "receiver",
+		Amount:    1,
+		Message:   "",
+		Time:      time.Now().UnixNano(),
 	}
 
 	_, e := bc.newTransaction(transaction)
@@ -86,3 +84,102 @@ func TestLastBlock(t *testing.T) {
 		t.Errorf("Last block index should be 2, got %d.", block.Index)
 	}
 }
+
+func TestMineKeepsLockedTransactions(t *testing.T) {
+	w, _ := getWallet(me.Hash)
+	if _, err := bc.mine(); err != nil {
+		t.Fatalf("Could not mine a block: %s", err)
+	}
+
+	tr := Transaction{
+		Sender:    me.Hash,
+		Recipient: "fad5e7a92f1c43b1523614336a07f98b894bb80fee06b6763b50ab03b597d5f4",
+		Amount:    minersIncentive,
+		Time:      time.Now().UnixNano(),
+		LockTime:  bc.lastBlock().Index + 2,
+	}
+	w.signTransaction(&tr)
+	if _, err := bc.newTransaction(tr); err != nil {
+		t.Fatalf("Could not add a time locked transaction: %s", err)
+	}
+
+	block, _ := bc.mine()
+	if len(block.Transactions) != 1 {
+		t.Errorf("Locked transaction should not be mined, got %d transactions in the block.", len(block.Transactions))
+	}
+	if len(bc.Transactions) != 1 {
+		t.Errorf("Locked transaction should be kept, got %d pending transactions.", len(bc.Transactions))
+	}
+
+	block, _ = bc.mine()
+	if len(block.Transactions) != 2 {
+		t.Errorf("Matured transaction should be mined, got %d transactions in the block.", len(block.Transactions))
+	}
+	if !bc.validate() {
+		t.Error("Blockchain with a matured transaction is invalid.")
+	}
+}
+
+func TestValidateRejectsImmatureTransaction(t *testing.T) {
+	last := bc.lastBlock()
+	tr := Transaction{
+		Sender:    zerohash,
+		Recipient: me.Hash,
+		Amount:    minersIncentive,
+		Time:      time.Now().UnixNano(),
+		LockTime:  last.Index + 10,
+	}
+	bl := Block{Index: last.Index + 1, Timestamp: time.Now().UnixNano(), Transactions: []Transaction{tr}}
+
+	if err := bl.checkTransactions(bc.Chain); err == nil {
+		t.Error("Block with a transaction that is not final should be invalid.")
+	}
+}
+
+func TestMineRemovesInvalidTransactions(t *testing.T) {
+	saveGlobals(t)
+
+	c := newTestChain("mine-invalid")
+	c.mine(t)
+	w, _ := getWallet(c.me.Hash)
+	// a pending transaction that became invalid, e.g. after a reorg, is never checked again when it's added
+	overspend := Transaction{Sender: w.hash, Recipient: strings.Repeat("ab", 32), Amount: 10 * minersIncentive, Time: time.Now().UnixNano()}
+	w.signTransaction(&overspend)
+	locked := Transaction{Sender: w.hash, Recipient: strings.Repeat("ab", 32), Amount: 1, Time: time.Now().UnixNano(), LockTime: 1000}
+	w.signTransaction(&locked)
+	c.bc.Transactions = append(c.bc.Transactions, overspend, locked)
+
+	c.mine(t)
+	if n := len(c.bc.lastBlock().Transactions); n != 1 {
+		t.Errorf("Expected only the coinbase in the block, got %d transactions", n)
+	}
+	if len(c.bc.Transactions) != 1 || c.bc.Transactions[0].getHash() != locked.getHash() {
+		t.Errorf("Expected only the locked transaction to be pending, got %v", c.bc.Transactions)
+	}
+	if !c.bc.validate() {
+		t.Error("Blockchain is invalid after removing the pending transaction")
+	}
+}
+
+func TestCheckTransactionsCoinbase(t *testing.T) {
+	coinbase := Transaction{Sender: zerohash, Recipient: strings.Repeat("ab", 32), Amount: minersIncentive}
+	second := coinbase
+	second.Message = "again"
+	negative := coinbase
+	negative.Amount = -1
+	blocks := map[string][]Transaction{
+		"two coinbases":       {coinbase, second},
+		"a negative coinbase": {negative},
+		"a negative lock":     {{Sender: zerohash, Recipient: coinbase.Recipient, RelativeLock: -1}},
+	}
+	for name, trs := range blocks {
+		bl := Block{Index: 2, Timestamp: time.Now().UnixNano(), Transactions: trs}
+		if err := bl.checkTransactions(nil); err == nil {
+			t.Errorf("Block with %s should be invalid", name)
+		}
+	}
+	bl := Block{Index: 2, Timestamp: time.Now().UnixNano(), Transactions: []Transaction{coinbase}}
+	if err := bl.checkTransactions(nil); err != nil {
+		t.Errorf("Block with one coinbase should be valid, got %s", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/grrrben/glog"
+)
+
+// The timestamp of a block is bounded on both sides. It should be later than the median time past, the median of
+// the timestamps of the blocks before it, so a miner can't backdate a block; the median moves forward even if a
+// few blocks are stamped too early. It may be at most the max drift ahead of the network-adjusted time: our clock,
+// corrected by the median offset of the clocks of our peers, which they send with their handshake.
+
+// The number of blocks of which the median time past is taken
+const medianTimeBlocks = 11
+
+// The default time a block may be ahead of the network-adjusted time
+const defaultMaxFutureDrift = 2 * time.Hour
+
+// The maximum correction of our clock by the clocks of the peers
+const maxTimeAdjustment = 70 * time.Minute
+
+// The time a block may be ahead of the network-adjusted time, set by a flag
+var maxFutureDrift = defaultMaxFutureDrift
+
+// medianTimePast returns the median of the timestamps of the last blocks of the chain
+func medianTimePast(chain []Block) int64 {
+	if len(chain) == 0 {
+		return 0
+	}
+	start := len(chain) - medianTimeBlocks
+	if start < 0 {
+		start = 0
+	}
+	times := make([]int64, 0, medianTimeBlocks)
+	for _, bl := range chain[start:] {
+		times = append(times, bl.Timestamp)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[len(times)/2]
+}
+
+// timeOffset returns the median offset of the clocks of the peers to our clock. An offset larger than the max
+// adjustment is ignored; our clock or the clocks of most peers are wrong.
+func (nodes *Nodes) timeOffset() time.Duration {
+	table := nodes.peerTable()
+	table.Lock()
+	var offsets []int64
+	for _, info := range table.peers {
+		if info.TimeOffset != nil {
+			offsets = append(offsets, *info.TimeOffset)
+		}
+	}
+	table.Unlock()
+	if len(offsets) == 0 {
+		return 0
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	offset := time.Duration(offsets[len(offsets)/2])
+	if offset > maxTimeAdjustment || offset < -maxTimeAdjustment {
+		glog.Warningf("Clocks of the peers differ %s from our clock, please check the time of this node", offset)
+		return 0
+	}
+	return offset
+}
+
+// networkTime returns the network-adjusted time, our clock if there is no network
+func (nodes *Nodes) networkTime() time.Time {
+	if nodes == nil {
+		return time.Now()
+	}
+	return time.Now().Add(nodes.timeOffset())
+}
+
+// checkFutureTime checks that the header is at most the max drift ahead of the network-adjusted time
+func (bc *Blockchain) checkFutureTime(h BlockHeader) error {
+	if h.Timestamp > bc.peers().networkTime().Add(maxFutureDrift).UnixNano() {
+		return fmt.Errorf("invalid timestamp (block %d is more than %s in the future)", h.Index, maxFutureDrift)
+	}
+	return nil
+}
+
+// checkBlockTime checks that the timestamp of the block is after the median time past of the chain before it,
+// and not too far in the future
+func (bc *Blockchain) checkBlockTime(chain []Block, h BlockHeader) error {
+	if h.Timestamp <= medianTimePast(chain) {
+		return fmt.Errorf("invalid timestamp (block %d is not after the median time past)", h.Index)
+	}
+	return bc.checkFutureTime(h)
+}
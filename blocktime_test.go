@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMedianTimePast(t *testing.T) {
+	var chain []Block
+	if medianTimePast(chain) != 0 {
+		t.Error("Median time past of an empty chain should be 0")
+	}
+	for _, ts := range []int64{5, 1, 3} {
+		chain = append(chain, Block{Timestamp: ts})
+	}
+	if mtp := medianTimePast(chain); mtp != 3 {
+		t.Errorf("Expected median 3, got %d", mtp)
+	}
+	// only the last blocks count
+	for i := int64(0); i < medianTimeBlocks; i++ {
+		chain = append(chain, Block{Timestamp: 100 + i})
+	}
+	if mtp := medianTimePast(chain); mtp != 100+medianTimeBlocks/2 {
+		t.Errorf("Expected the median of the last %d blocks, got %d", medianTimeBlocks, mtp)
+	}
+}
+
+func TestBlockTimestamps(t *testing.T) {
+	saveGlobals(t)
+
+	a := newTestChain("timestamps-a")
+	a.mine(t)
+	a.mine(t)
+	b := forkTestChain(a, "timestamps-b")
+	b.mine(t)
+	a.use()
+
+	// a proof of work seal does not cover the timestamp, only the rules on it
+	tampered := map[string]int64{
+		"backdated": medianTimePast(a.bc.Chain),
+		"future":    time.Now().Add(maxFutureDrift + time.Minute).UnixNano(),
+	}
+	for name, ts := range tampered {
+		bl := b.bc.lastBlock()
+		bl.Timestamp = ts
+		if _, err := a.bc.addBlock(bl); err == nil {
+			t.Errorf("Block with a %s timestamp should be invalid", name)
+		}
+		invalid := &Blockchain{Chain: append(append([]Block{}, a.bc.Chain...), bl)}
+		if invalid.validate() {
+			t.Errorf("Chain with a %s timestamp should be invalid", name)
+		}
+	}
+	future := a.bc.Chain[1].header()
+	future.Timestamp = tampered["future"]
+	if err := a.bc.validateHeaders(nil, []BlockHeader{a.bc.Chain[0].header(), future}); err == nil {
+		t.Error("Header too far in the future should be refused")
+	}
+	if _, err := a.bc.addBlock(b.bc.lastBlock()); err != nil {
+		t.Errorf("Block with a valid timestamp should be added: %s", err)
+	}
+
+	// a block is stamped after the median time past, even if our clock is behind
+	a.bc.Chain[len(a.bc.Chain)-1].Timestamp = time.Now().Add(time.Hour).UnixNano()
+	a.bc.Chain[len(a.bc.Chain)-2].Timestamp = time.Now().Add(time.Hour).UnixNano()
+	a.mine(t)
+	if last := a.bc.lastBlock(); last.Timestamp <= medianTimePast(a.bc.Chain[:len(a.bc.Chain)-1]) {
+		t.Errorf("Mined block should be stamped after the median time past, got %d", last.Timestamp)
+	}
+}
+
+func TestNetworkTime(t *testing.T) {
+	saveGlobals(t)
+
+	nodes = initNodes()
+	if nodes.timeOffset() != 0 {
+		t.Error("Without peers the network time should be our clock")
+	}
+	for i, offset := range []time.Duration{10 * time.Minute, -5 * time.Minute, 20 * time.Minute} {
+		node := Node{Protocol: "http://", Hostname: "clock", Port: uint16(8000 + i)}
+		nodes.recordHandshake(node, Handshake{Time: time.Now().Add(offset).UnixNano()})
+	}
+	if offset := nodes.timeOffset(); offset < 9*time.Minute || offset > 11*time.Minute {
+		t.Errorf("Expected the median offset of 10 minutes, got %s", offset)
+	}
+	if drift := nodes.networkTime().Sub(time.Now()); drift < 9*time.Minute {
+		t.Errorf("Network time should be adjusted by the median offset, got %s", drift)
+	}
+
+	for i := 0; i < 3; i++ {
+		node := Node{Protocol: "http://", Hostname: "wrong-clock", Port: uint16(8000 + i)}
+		nodes.recordHandshake(node, Handshake{Time: time.Now().Add(3 * time.Hour).UnixNano()})
+	}
+	if offset := nodes.timeOffset(); offset != 0 {
+		t.Errorf("Offset larger than the max adjustment should be ignored, got %s", offset)
+	}
+}
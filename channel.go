@@ -0,0 +1,635 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grrrben/glog"
+)
+
+// Payment channels allow two parties to pay each other off-chain. The funder sends coins to the address
+// of a 2-of-2 multisig script of both keys, after which both parties exchange signed states (balances).
+// Only the last state is settled on the chain, either cooperatively with two payouts signed by both,
+// or unilaterally by publishing a state with a "close" transaction. After a close there is a dispute
+// window in which the other party can publish a newer state; the party that closed with the old state
+// is penalised and the other party gets all the credits of the channel with the "settle" transaction.
+
+// The number of blocks after a unilateral close in which a newer state can be published
+const channelDisputeWindow = 10
+
+// ChannelState is the division of the credits of a channel, signed by both parties.
+// The first balance is of the funder (the first key of the channel script).
+type ChannelState struct {
+	Channel  string     `json:"channel"`
+	Sequence int64      `json:"sequence"`
+	Balances [2]float64 `json:"balances"`
+}
+
+// ChannelUpdate is attached to transactions that close, dispute or settle a channel on the chain.
+type ChannelUpdate struct {
+	Action     string       `json:"action"` // close, dispute or settle
+	State      ChannelState `json:"state"`
+	Signatures [2]string    `json:"signatures,omitempty"` // of both parties, for a close or dispute
+}
+
+// hash is the message that both parties sign
+func (s ChannelState) hash() []byte {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s%d%.8f%.8f", s.Channel, s.Sequence, s.Balances[0], s.Balances[1])))
+	return sum[:]
+}
+
+// total returns the credits of the channel
+func (s ChannelState) total() float64 {
+	return s.Balances[0] + s.Balances[1]
+}
+
+// verify checks the signatures of both parties of a state
+func (s ChannelState) verify(keys [2][]byte, signatures [2]string) bool {
+	for i, key := range keys {
+		sig, err := hex.DecodeString(signatures[i])
+		if err != nil || !verifySignature(key, s.hash(), sig) {
+			return false
+		}
+	}
+	return true
+}
+
+// channelScript returns the 2-of-2 multisig script of a channel
+func channelScript(funderKey, otherKey []byte) string {
+	return multisigScript(2, funderKey, otherKey)
+}
+
+// parseChannelScript returns the keys of both parties of a channel script
+func parseChannelScript(script string) ([2][]byte, error) {
+	var keys [2][]byte
+	tokens := strings.Fields(script)
+	if len(tokens) != 5 || tokens[0] != "OP_2" || tokens[3] != "OP_2" || tokens[4] != "OP_CHECKMULTISIG" {
+		return keys, errors.New("invalid channel (not a channel script)")
+	}
+	for i := range keys {
+		key, err := hex.DecodeString(tokens[i+1])
+		if err != nil {
+			return keys, errors.New("invalid channel (invalid key)")
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// channelWallet returns the pay-to-pubkey-hash wallet of a party, the payouts of a channel go to this wallet.
+func channelWallet(key []byte) string {
+	return scriptHash(payToPubKeyHashScript(key))
+}
+
+// channelEvent is a channel update on the chain, or pending, with the index of it's block.
+type channelEvent struct {
+	tr    Transaction
+	index int64
+}
+
+// channelEvents returns the updates of a channel in the blocks and transactions given, by action.
+// Pending transactions are considered to be part of the block with the given index.
+func channelEvents(address string, chain []Block, transactions []Transaction, index int64) map[string][]channelEvent {
+	events := make(map[string][]channelEvent)
+	add := func(tr Transaction, blockIndex int64) {
+		if tr.Channel != nil && tr.Sender == address {
+			events[tr.Channel.Action] = append(events[tr.Channel.Action], channelEvent{tr, blockIndex})
+		}
+	}
+	for _, block := range chain {
+		for _, tr := range block.Transactions {
+			add(tr, block.Index)
+		}
+	}
+	for _, tr := range transactions {
+		add(tr, index)
+	}
+	return events
+}
+
+// checkChannelTransaction checks a close, dispute or settle of a channel, which is placed after
+// the given blocks and transactions in the block with the given index.
+// These transactions replace the script of the channel by the rules of the channel.
+func checkChannelTransaction(tr Transaction, chain []Block, transactions []Transaction, index int64) error {
+	u := tr.Channel
+	if tr.Script == "" || scriptHash(tr.Script) != tr.Sender {
+		return errors.New("invalid transaction (script does not match sender)")
+	}
+	keys, err := parseChannelScript(tr.Script)
+	if err != nil {
+		return err
+	}
+	if u.State.Channel != tr.Sender {
+		return errors.New("invalid channel (state of another channel)")
+	}
+	wallets := [2]string{channelWallet(keys[0]), channelWallet(keys[1])}
+	events := channelEvents(tr.Sender, chain, transactions, index)
+
+	switch u.Action {
+	case "close", "dispute":
+		if tr.Amount != 0 {
+			return errors.New("invalid channel (a close can not transfer an amount)")
+		}
+		if !u.State.verify(keys, u.Signatures) {
+			return errors.New("invalid channel (state not signed by both parties)")
+		}
+		if u.State.Balances[0] < 0 || u.State.Balances[1] < 0 ||
+			math.Abs(u.State.total()-walletCredits(tr.Sender, chain, transactions, -1)) > 1e-8 {
+			return errors.New("invalid channel (balances do not match the channel)")
+		}
+		// the party that publishes the state signs the transaction
+		party := -1
+		for i, wallet := range wallets {
+			if tr.Recipient == wallet {
+				party = i
+			}
+		}
+		sig, err := hex.DecodeString(tr.Witness)
+		if party < 0 || err != nil || !verifySignature(keys[party], tr.sigHash(), sig) {
+			return errors.New("invalid channel (not signed by a party of the channel)")
+		}
+
+		closes := events["close"]
+		if u.Action == "close" {
+			if len(closes) > 0 {
+				return errors.New("invalid channel (already closed)")
+			}
+			return nil
+		}
+		if len(closes) == 0 {
+			return errors.New("invalid channel (not closed)")
+		}
+		if len(events["dispute"]) > 0 {
+			return errors.New("invalid channel (already disputed)")
+		}
+		closed := closes[0]
+		if index-closed.index > channelDisputeWindow {
+			return errors.New("invalid channel (dispute window has passed)")
+		}
+		if u.State.Sequence <= closed.tr.Channel.State.Sequence || tr.Recipient == closed.tr.Recipient {
+			return errors.New("invalid channel (dispute needs a newer state of the other party)")
+		}
+		return nil
+	case "settle":
+		closes := events["close"]
+		if len(closes) == 0 || index-closes[0].index <= channelDisputeWindow {
+			return errors.New("invalid channel (dispute window has not passed)")
+		}
+		for _, settled := range events["settle"] {
+			if settled.tr.Recipient == tr.Recipient {
+				return errors.New("invalid channel (already settled)")
+			}
+		}
+		state := closes[0].tr.Channel.State
+		if disputes := events["dispute"]; len(disputes) > 0 {
+			// the penalty, all credits go to the party that disputed the old state
+			if tr.Recipient != disputes[0].tr.Recipient || math.Abs(tr.Amount-state.total()) > 1e-8 {
+				return errors.New("invalid channel (settle does not match the dispute)")
+			}
+			return nil
+		}
+		for i, wallet := range wallets {
+			if tr.Recipient == wallet && tr.Amount > 0 && math.Abs(tr.Amount-state.Balances[i]) <= 1e-8 {
+				return nil
+			}
+		}
+		return errors.New("invalid channel (settle does not match the closed state)")
+	}
+	return fmt.Errorf("invalid channel (unknown action %s)", u.Action)
+}
+
+// paymentChannel is a channel this node takes part in, with the last state signed by both parties.
+// It's locked while the state and signatures are read or changed, never during a request to the other party.
+type paymentChannel struct {
+	sync.Mutex
+	Address    string       `json:"address"`
+	Script     string       `json:"script"`
+	Party      int          `json:"party"`  // the index of this node in the channel, 0 is the funder
+	Wallet     string       `json:"wallet"` // the wallet of this node that holds the key
+	Peer       string       `json:"peer"`   // the address of the node of the other party
+	State      ChannelState `json:"state"`
+	Signatures [2]string    `json:"signatures"`
+}
+
+// channelJSON is a payment channel without it's methods, to encode it
+type channelJSON paymentChannel
+
+// MarshalJSON encodes the channel while it's locked
+func (ch *paymentChannel) MarshalJSON() ([]byte, error) {
+	ch.Lock()
+	defer ch.Unlock()
+	return json.Marshal((*channelJSON)(ch))
+}
+
+// last returns the last state and the signatures of both parties
+func (ch *paymentChannel) last() (ChannelState, [2]string) {
+	ch.Lock()
+	defer ch.Unlock()
+	return ch.State, ch.Signatures
+}
+
+// channelList holds the payment channels of this node by address.
+type channelList struct {
+	sync.Mutex
+	list map[string]*paymentChannel
+}
+
+var channels = initChannels()
+
+func initChannels() *channelList {
+	return &channelList{list: make(map[string]*paymentChannel)}
+}
+
+// getChannel returns a channel of this node
+func getChannel(address string) (*paymentChannel, bool) {
+	channels.Lock()
+	defer channels.Unlock()
+	ch, ok := channels.list[address]
+	return ch, ok
+}
+
+func addChannel(ch *paymentChannel) {
+	channels.Lock()
+	channels.list[ch.Address] = ch
+	channels.Unlock()
+}
+
+// signState signs a state with the wallet of this node
+func (ch *paymentChannel) signState(state ChannelState) (string, error) {
+	w, ok := getWallet(ch.Wallet)
+	if !ok {
+		return "", errors.New("invalid channel (wallet is not a wallet of this node)")
+	}
+	sig, err := sign(w.key, state.hash())
+	return hex.EncodeToString(sig), err
+}
+
+// channelMessage is exchanged between the nodes of both parties
+type channelMessage struct {
+	Script       string        `json:"script,omitempty"`
+	Peer         string        `json:"peer,omitempty"`
+	State        ChannelState  `json:"state"`
+	Signature    string        `json:"signature,omitempty"`
+	Transactions []Transaction `json:"transactions,omitempty"`
+	Signatures   []string      `json:"signatures,omitempty"`
+}
+
+// callPeer posts a channel message to the node of the other party and decodes it's answer
+func callPeer(url string, msg channelMessage) (channelMessage, error) {
+	var answer channelMessage
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return answer, err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
+	if err != nil {
+		return answer, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		glog.Warningf("POST request error: %s", err)
+		return answer, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e map[string]string
+		json.NewDecoder(resp.Body).Decode(&e)
+		return answer, fmt.Errorf("peer refused (%s)", e["error"])
+	}
+	err = json.NewDecoder(resp.Body).Decode(&answer)
+	return answer, err
+}
+
+// openChannel creates a channel with the other party and funds it from a wallet of this node.
+// The other party signs the first state, which returns the funds, before the funding transaction is made.
+func openChannel(w wallet, peerKey []byte, peer string, amount float64) (*paymentChannel, error) {
+	if amount <= 0 {
+		return nil, errors.New("invalid channel (invalid amount)")
+	}
+	script := channelScript(publicKeyBytes(w.key), peerKey)
+	ch := &paymentChannel{
+		Address: scriptHash(script),
+		Script:  script,
+		Party:   0,
+		Wallet:  w.hash,
+		Peer:    peer,
+	}
+	if _, exists := getChannel(ch.Address); exists {
+		return nil, errors.New("invalid channel (already open)")
+	}
+	first := ChannelState{Channel: ch.Address, Sequence: 0, Balances: [2]float64{amount, 0}}
+	if err := ch.exchange(first, fmt.Sprintf("%s/channel/open", peer), ch.Script); err != nil {
+		return nil, err
+	}
+
+	tr := Transaction{
+		Sender:    w.hash,
+		Recipient: ch.Address,
+		Amount:    amount,
+		Message:   "Channel funding",
+		Time:      time.Now().UnixNano(),
+	}
+	err := w.signTransaction(&tr)
+	if err == nil {
+		tr, err = bc.addTransaction(tr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	nodes.distributeTransaction(tr)
+	addChannel(ch)
+	return ch, nil
+}
+
+// exchange signs a new state and has it signed by the other party. On success it is the last state,
+// unless the channel moved to a newer state meanwhile.
+func (ch *paymentChannel) exchange(state ChannelState, url, script string) error {
+	sig, err := ch.signState(state)
+	if err != nil {
+		return err
+	}
+	answer, err := callPeer(url, channelMessage{Script: script, Peer: me.getAddress(), State: state, Signature: sig})
+	if err != nil {
+		return err
+	}
+
+	var signatures [2]string
+	signatures[ch.Party] = sig
+	signatures[1-ch.Party] = answer.Signature
+	keys, _ := parseChannelScript(ch.Script)
+	if !state.verify(keys, signatures) {
+		return errors.New("invalid channel (invalid signature of the other party)")
+	}
+	ch.Lock()
+	defer ch.Unlock()
+	if state.Sequence < ch.State.Sequence {
+		return errors.New("invalid channel (the state changed meanwhile)")
+	}
+	ch.State = state
+	ch.Signatures = signatures
+	return nil
+}
+
+// acceptChannel is called by the funder of a new channel, this node signs the first state.
+func acceptChannel(msg channelMessage) (string, error) {
+	keys, err := parseChannelScript(msg.Script)
+	if err != nil {
+		return "", err
+	}
+	w, ok := getWallet(channelWallet(keys[1]))
+	if !ok {
+		return "", errors.New("invalid channel (key is not a wallet of this node)")
+	}
+	if msg.State.Channel != scriptHash(msg.Script) || msg.State.Sequence != 0 || msg.State.Balances[1] != 0 || msg.State.Balances[0] <= 0 {
+		return "", errors.New("invalid channel (invalid first state)")
+	}
+	ch := &paymentChannel{
+		Address: msg.State.Channel,
+		Script:  msg.Script,
+		Party:   1,
+		Wallet:  w.hash,
+		Peer:    msg.Peer,
+		State:   msg.State,
+	}
+	ch.Lock()
+	defer ch.Unlock()
+	return ch.countersign(msg)
+}
+
+// countersign checks the signature of the other party on a new state, signs it and stores it as the last state.
+// The channel should be locked.
+func (ch *paymentChannel) countersign(msg channelMessage) (string, error) {
+	keys, _ := parseChannelScript(ch.Script)
+	sig, err := ch.signState(msg.State)
+	if err != nil {
+		return "", err
+	}
+	var signatures [2]string
+	signatures[ch.Party] = sig
+	signatures[1-ch.Party] = msg.Signature
+	if !msg.State.verify(keys, signatures) {
+		return "", errors.New("invalid channel (invalid signature of the other party)")
+	}
+	ch.State = msg.State
+	ch.Signatures = signatures
+	addChannel(ch)
+	return sig, nil
+}
+
+// pay moves an amount to the other party with a new state
+func (ch *paymentChannel) pay(amount float64) error {
+	state, _ := ch.last()
+	if amount <= 0 || amount > state.Balances[ch.Party] {
+		return errors.New("invalid channel (insufficient balance)")
+	}
+	state.Sequence++
+	state.Balances[ch.Party] -= amount
+	state.Balances[1-ch.Party] += amount
+	return ch.exchange(state, fmt.Sprintf("%s/channel/%s/update", ch.Peer, ch.Address), "")
+}
+
+// receiveUpdate is called by the other party with a new state, it may only increase our balance.
+func (ch *paymentChannel) receiveUpdate(msg channelMessage) (string, error) {
+	ch.Lock()
+	defer ch.Unlock()
+	if msg.State.Channel != ch.Address || msg.State.Sequence != ch.State.Sequence+1 {
+		return "", errors.New("invalid channel (unexpected sequence)")
+	}
+	if msg.State.Balances[ch.Party] < ch.State.Balances[ch.Party] || msg.State.Balances[1-ch.Party] < 0 ||
+		math.Abs(msg.State.total()-ch.State.total()) > 1e-8 {
+		return "", errors.New("invalid channel (invalid balances)")
+	}
+	return ch.countersign(msg)
+}
+
+// payouts returns the transactions that pay the last state to both parties.
+func (ch *paymentChannel) payouts(time int64) []Transaction {
+	keys, _ := parseChannelScript(ch.Script)
+	state, _ := ch.last()
+	var trs []Transaction
+	for i, key := range keys {
+		if state.Balances[i] <= 0 {
+			continue
+		}
+		trs = append(trs, Transaction{
+			Sender:    ch.Address,
+			Recipient: channelWallet(key),
+			Amount:    state.Balances[i],
+			Message:   "Channel close",
+			Time:      time,
+			Script:    ch.Script,
+		})
+	}
+	return trs
+}
+
+// signPayouts signs the payouts of a cooperative close with the wallet of this node.
+func (ch *paymentChannel) signPayouts(trs []Transaction) ([]string, error) {
+	w, ok := getWallet(ch.Wallet)
+	if !ok {
+		return nil, errors.New("invalid channel (wallet is not a wallet of this node)")
+	}
+	var sigs []string
+	for _, tr := range trs {
+		sig, err := sign(w.key, tr.sigHash())
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, hex.EncodeToString(sig))
+	}
+	return sigs, nil
+}
+
+// cooperativeClose pays the last state to both parties with transactions signed by both.
+func (ch *paymentChannel) cooperativeClose() ([]Transaction, error) {
+	trs := ch.payouts(time.Now().UnixNano())
+	sigs, err := ch.signPayouts(trs)
+	if err != nil {
+		return nil, err
+	}
+	state, _ := ch.last()
+	answer, err := callPeer(fmt.Sprintf("%s/channel/%s/cooperate", ch.Peer, ch.Address), channelMessage{State: state, Transactions: trs})
+	if err != nil {
+		return nil, err
+	}
+	if len(answer.Signatures) != len(trs) {
+		return nil, errors.New("invalid channel (missing signatures of the other party)")
+	}
+
+	for i := range trs {
+		// the signatures in the witness are in the order of the keys
+		pair := [2]string{}
+		pair[ch.Party] = sigs[i]
+		pair[1-ch.Party] = answer.Signatures[i]
+		trs[i].Witness = pair[0] + " " + pair[1]
+		if trs[i], err = bc.addTransaction(trs[i]); err != nil {
+			return nil, err
+		}
+		nodes.distributeTransaction(trs[i])
+	}
+	channels.Lock()
+	delete(channels.list, ch.Address)
+	channels.Unlock()
+	return trs, nil
+}
+
+// cooperate is called by the other party to sign the payouts of a cooperative close
+func (ch *paymentChannel) cooperate(msg channelMessage) ([]string, error) {
+	if len(msg.Transactions) == 0 {
+		return nil, errors.New("invalid channel (no payouts)")
+	}
+	expected := ch.payouts(msg.Transactions[0].Time)
+	if len(expected) != len(msg.Transactions) {
+		return nil, errors.New("invalid channel (payouts do not match the last state)")
+	}
+	for i, tr := range msg.Transactions {
+		if tr.getHash() != expected[i].getHash() {
+			return nil, errors.New("invalid channel (payouts do not match the last state)")
+		}
+	}
+	return ch.signPayouts(expected)
+}
+
+// publish adds a close or dispute of the last state to the chain
+func (ch *paymentChannel) publish(chain *Blockchain, action string) (Transaction, error) {
+	state, signatures := ch.last()
+	tr := Transaction{
+		Sender:    ch.Address,
+		Recipient: ch.Wallet,
+		Message:   fmt.Sprintf("Channel %s", action),
+		Time:      time.Now().UnixNano(),
+		Script:    ch.Script,
+		Channel:   &ChannelUpdate{Action: action, State: state, Signatures: signatures},
+	}
+	w, ok := getWallet(ch.Wallet)
+	if !ok {
+		return tr, errors.New("invalid channel (wallet is not a wallet of this node)")
+	}
+	sig, err := sign(w.key, tr.sigHash())
+	if err != nil {
+		return tr, err
+	}
+	tr.Witness = hex.EncodeToString(sig)
+	if tr, err = chain.newTransaction(tr); err != nil {
+		return tr, err
+	}
+	chain.peers().relay(chain.node(), []Inventory{{Type: "transaction", Hash: tr.getHash()}}, "")
+	return tr, nil
+}
+
+// settle pays out the closed (or disputed) channel to the wallet of this node, after the dispute window.
+func (ch *paymentChannel) settle() (Transaction, error) {
+	bc.Lock()
+	defer bc.Unlock()
+	index := int64(len(bc.Chain) + 1)
+	events := channelEvents(ch.Address, bc.Chain, bc.Transactions, index)
+	tr := Transaction{
+		Sender:    ch.Address,
+		Recipient: ch.Wallet,
+		Message:   "Channel settle",
+		Time:      time.Now().UnixNano(),
+		Script:    ch.Script,
+	}
+	if len(events["close"]) == 0 {
+		return tr, errors.New("invalid channel (not closed)")
+	}
+	state := events["close"][0].tr.Channel.State
+	if disputes := events["dispute"]; len(disputes) > 0 {
+		tr.Amount = 0
+		if disputes[0].tr.Recipient == ch.Wallet {
+			tr.Amount = state.total()
+		}
+	} else {
+		tr.Amount = state.Balances[ch.Party]
+	}
+	if tr.Amount <= 0 {
+		return tr, errors.New("invalid channel (nothing to settle)")
+	}
+	tr.Channel = &ChannelUpdate{Action: "settle", State: state}
+
+	tr, err := bc.newTransaction(tr)
+	if err != nil {
+		return tr, err
+	}
+	nodes.distributeTransaction(tr)
+	return tr, nil
+}
+
+// watchChannels looks for closes of the channels of this node with an old state, it's called when the chain
+// changes. A newer state is published as a dispute, which penalises the other party. The chain should be locked.
+func (bc *Blockchain) watchChannels() {
+	watched := bc.channelList()
+	watched.Lock()
+	var list []*paymentChannel
+	for _, ch := range watched.list {
+		list = append(list, ch)
+	}
+	watched.Unlock()
+
+	index := int64(len(bc.Chain) + 1)
+	for _, ch := range list {
+		events := channelEvents(ch.Address, bc.Chain, bc.Transactions, index)
+		closes := events["close"]
+		if len(closes) == 0 || len(events["dispute"]) > 0 || closes[0].tr.Recipient == ch.Wallet {
+			continue
+		}
+		if state, _ := ch.last(); closes[0].tr.Channel.State.Sequence < state.Sequence {
+			glog.Warningf("Channel %s closed with an old state, disputing it", ch.Address)
+			if _, err := ch.publish(bc, "dispute"); err != nil {
+				glog.Warningf("Could not dispute channel %s: %s", ch.Address, err)
+			}
+		}
+	}
+}
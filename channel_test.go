@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// openTestChannel opens a channel from a to b, funded with 2 credits
+func openTestChannel(t *testing.T, a, b *testChain, peer string) *paymentChannel {
+	for i := 0; i < 2; i++ {
+		a.mine(t)
+	}
+	var resp struct {
+		Channel paymentChannel `json:"channel"`
+		Error   string         `json:"error"`
+	}
+	code := a.call(t, "POST", "/channel", map[string]interface{}{
+		"wallet":  a.me.Hash,
+		"peerKey": b.publicKey(t, b.me.Hash),
+		"peer":    peer,
+		"amount":  2,
+	}, &resp)
+	if code != http.StatusOK {
+		t.Fatalf("Could not open channel: %s", resp.Error)
+	}
+	a.mine(t)
+	a.use()
+	ch, _ := getChannel(resp.Channel.Address)
+	return ch
+}
+
+func pay(t *testing.T, c *testChain, ch *paymentChannel, amount float64) {
+	var resp map[string]interface{}
+	code := c.call(t, "POST", fmt.Sprintf("/channel/%s/pay", ch.Address), map[string]interface{}{"amount": amount}, &resp)
+	if code != http.StatusOK {
+		t.Fatalf("Could not pay %f in channel: %v", amount, resp)
+	}
+}
+
+func TestChannelCooperativeClose(t *testing.T) {
+	saveGlobals(t)
+
+	a := newTestChain("channel-a")
+	b := a.newPeer("channel-b")
+	serverA, serverB := a.server(), b.server()
+	defer serverA.Close()
+	defer serverB.Close()
+
+	ch := openTestChannel(t, a, b, serverB.URL)
+	ch.Peer = serverB.URL
+	b.use()
+	chB, ok := getChannel(ch.Address)
+	if !ok {
+		t.Fatal("Channel unknown to the other party")
+	}
+	chB.Peer = serverA.URL
+
+	pay(t, a, ch, 0.5)
+	pay(t, a, ch, 0.5)
+	pay(t, b, chB, 0.25)
+	if ch.State.Sequence != 3 || ch.State.Balances != [2]float64{1.25, 0.75} {
+		t.Fatalf("Unexpected state after payments: %v", ch.State)
+	}
+	if chB.State != ch.State {
+		t.Fatalf("States of both parties differ: %v and %v", ch.State, chB.State)
+	}
+
+	var resp map[string]interface{}
+	if code := a.call(t, "POST", fmt.Sprintf("/channel/%s/close", ch.Address), nil, &resp); code != http.StatusOK {
+		t.Fatalf("Could not close channel: %v", resp)
+	}
+	a.mine(t)
+	if credits := a.credits(b.me.Hash); credits != 0.75 {
+		t.Errorf("Expected 0.75 credits for b, got %f", credits)
+	}
+	if credits := a.credits(ch.Address); credits != 0 {
+		t.Errorf("Expected an empty channel, got %f", credits)
+	}
+	if !bc.validate() {
+		t.Error("Chain is invalid after closing the channel")
+	}
+}
+
+func TestChannelDisputePenalty(t *testing.T) {
+	saveGlobals(t)
+
+	// the channels of b are watched as the chain changes
+	b := newTestChain("channel-honest")
+	a := b.newPeer("channel-cheater")
+	serverB := b.server()
+	defer serverB.Close()
+
+	ch := openTestChannel(t, a, b, serverB.URL)
+	oldState, oldSignatures := ch.last()
+	pay(t, a, ch, 1.5)
+
+	// a closes with the old state, in which a has all credits
+	a.use()
+	ch.State, ch.Signatures = oldState, oldSignatures
+	a.bc.Lock()
+	_, err := ch.publish(a.bc, "close")
+	a.bc.Unlock()
+	if err != nil {
+		t.Fatalf("Could not close with the old state: %s", err)
+	}
+	a.mine(t)
+
+	// b notices the old state once the close is in the chain and disputes it
+	if events := channelEvents(ch.Address, bc.Chain, bc.Transactions, int64(len(bc.Chain)+1)); len(events["dispute"]) != 1 {
+		t.Fatal("Old state was not disputed")
+	}
+	a.mine(t)
+
+	b.use()
+	chB, _ := getChannel(ch.Address)
+	if _, err := chB.settle(); err == nil {
+		t.Error("Channel settled before the dispute window passed")
+	}
+	for i := 0; i < channelDisputeWindow; i++ {
+		a.mine(t)
+	}
+
+	a.use()
+	if _, err := ch.settle(); err == nil {
+		t.Error("Cheater could settle the channel")
+	}
+	b.use()
+	if _, err := chB.settle(); err != nil {
+		t.Fatalf("Could not settle the channel: %s", err)
+	}
+	a.mine(t)
+	if credits := a.credits(b.me.Hash); credits != 2 {
+		t.Errorf("Expected all 2 credits for the honest party, got %f", credits)
+	}
+	if !bc.validate() {
+		t.Error("Chain is invalid after the dispute")
+	}
+}
+
+func TestChannelForceClose(t *testing.T) {
+	saveGlobals(t)
+
+	a := newTestChain("channel-funder")
+	b := a.newPeer("channel-closer")
+	serverB := b.server()
+	defer serverB.Close()
+
+	ch := openTestChannel(t, a, b, serverB.URL)
+	pay(t, a, ch, 0.5)
+
+	var resp map[string]interface{}
+	if code := b.call(t, "POST", fmt.Sprintf("/channel/%s/force-close", ch.Address), nil, &resp); code != http.StatusOK {
+		t.Fatalf("Could not force close the channel: %v", resp)
+	}
+	for i := 0; i <= channelDisputeWindow; i++ {
+		a.mine(t)
+	}
+	for _, c := range []*testChain{a, b} {
+		if code := c.call(t, "POST", fmt.Sprintf("/channel/%s/settle", ch.Address), nil, &resp); code != http.StatusOK {
+			t.Fatalf("Could not settle the channel: %v", resp)
+		}
+	}
+	a.mine(t)
+	if credits := a.credits(b.me.Hash); credits != 0.5 {
+		t.Errorf("Expected 0.5 credits for b, got %f", credits)
+	}
+	if credits := a.credits(ch.Address); credits != 0 {
+		t.Errorf("Expected an empty channel, got %f", credits)
+	}
+}
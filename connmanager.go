@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/grrrben/glog"
+)
+
+// The connection manager keeps a number of outbound peer connections (connections this node dialed).
+// Connections that fail are closed, the manager replaces them with nodes from the address book. The number of
+// inbound connections (connections of other nodes) is capped.
+
+// The number of outbound connections the manager maintains
+const targetOutbound = 8
+
+// The maximum number of inbound connections
+const maxInbound = 32
+
+// The time between two rounds of the connection manager
+const connectInterval = 30 * time.Second
+
+// The time to wait before connecting to a node again, multiplied by the number of failed attempts
+const retryInterval = time.Minute
+
+// The number of failed attempts after which a node is dropped from the address book
+const maxConnectAttempts = 5
+
+// connections returns the peer connections
+func (nodes *Nodes) connections() []*peerConn {
+	table := nodes.connTable()
+	table.Lock()
+	defer table.Unlock()
+	conns := make([]*peerConn, 0, len(table.conns))
+	for _, p := range table.conns {
+		conns = append(conns, p)
+	}
+	return conns
+}
+
+// countConnections returns the number of inbound and outbound peer connections
+func (nodes *Nodes) countConnections() (inbound, outbound int) {
+	for _, p := range nodes.connections() {
+		if p.inbound {
+			inbound++
+		} else {
+			outbound++
+		}
+	}
+	return inbound, outbound
+}
+
+// candidates returns the nodes of the address book to connect to, the most recently seen first.
+// Nodes that are connected or banned, ourself and nodes that failed recently are skipped.
+func (nodes *Nodes) candidates(self Node) []Node {
+	var candidates []Node
+	now := time.Now().UnixNano()
+	for _, known := range nodes.addressBook().list() {
+		if known.getAddress() == self.getAddress() || known.P2PPort == 0 || nodes.banList().isBanned(known.getAddress()) {
+			continue
+		}
+		if _, ok := nodes.connection(known.Node); ok {
+			continue
+		}
+		if known.Attempts > 0 && now-known.LastTried < int64(known.Attempts)*int64(retryInterval) {
+			continue
+		}
+		candidates = append(candidates, known.Node)
+	}
+	return candidates
+}
+
+// fillOutbound connects to nodes of the address book until there are enough outbound connections.
+// Nodes that keep failing are dropped from the address book. Returns the number of connections made.
+func (nodes *Nodes) fillOutbound(self Node, connect func(node Node) error) int {
+	_, outbound := nodes.countConnections()
+	book := nodes.addressBook()
+	connected := 0
+	for _, node := range nodes.candidates(self) {
+		if outbound+connected >= targetOutbound {
+			break
+		}
+		book.markAttempt(node)
+		if err := connect(node); err != nil {
+			glog.Warningf("Could not connect to %s: %s", node.getAddress(), err)
+			if book.attempts(node) >= maxConnectAttempts {
+				book.remove(node.getAddress())
+			}
+			continue
+		}
+		book.markConnected(node, "peer")
+		connected++
+	}
+	return connected
+}
+
+// connectPeer connects to a node of the address book. A node that is not in the list is challenged
+// and added first, then it is greeted and a peer connection is made.
+func (nodes *Nodes) connectPeer(node Node, chain *Blockchain, self Node) error {
+	if !nodes.isKnown(node) {
+		if err := challengeNode(node); err != nil {
+			return err
+		}
+		nodes.addNode(&node)
+	}
+	if err := nodes.greet(node, chain, self); err != nil {
+		return err
+	}
+	if _, ok := nodes.connection(node); !ok {
+		return errors.New("no peer connection (the node does not accept them)")
+	}
+	return nil
+}
+
+// manageConnections keeps the outbound connections filled every interval, it runs forever.
+func (nodes *Nodes) manageConnections(chain *Blockchain, self Node, interval time.Duration) {
+	connect := func(node Node) error {
+		return nodes.connectPeer(node, chain, self)
+	}
+	for range time.Tick(interval) {
+		if connected := nodes.fillOutbound(self, connect); connected > 0 {
+			glog.Infof("%d outbound connection(s) made", connected)
+		}
+	}
+}
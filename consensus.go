@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/grrrben/glog"
+)
+
+// The consensus engine decides how blocks are sealed, which seals are valid and which chain is followed.
+// The chain code only talks to the engine, so a network can run another engine without changing the chain.
+// Proof of work is the default engine.
+
+// ConsensusEngine seals and verifies blocks and chooses between forks
+type ConsensusEngine interface {
+	// name of the engine, as set with the -consensus flag
+	name() string
+	// seal seals a block that follows the parent, e.g. by finding it's proof
+	seal(parent BlockHeader, bl *Block) error
+	// verifySeal checks the seal of a header that follows the parent
+	verifySeal(parent, h BlockHeader) error
+	// verifyBlock checks the seal of a block against the chain before it, e.g. the leader of it's slot
+	verifyBlock(chain []Block, bl Block) error
+	// difficulty returns the difficulty of the block that follows the parent
+	difficulty(parent BlockHeader) int64
+	// weight returns what a block adds to the weight of a chain
+	weight(h BlockHeader) int64
+	// forkChoice tells if their branch should replace ours, both branches follow the same fork point
+	forkChoice(ours, theirs []BlockHeader) bool
+}
+
+// blockProducer is an engine that seals blocks by itself, e.g. when it's our turn
+type blockProducer interface {
+	produceBlocks(chain *Blockchain)
+}
+
+// headerVerifier is an engine of which a seal depends on the seals before it, e.g. the signers after them.
+// It verifies headers that are not accepted yet, without keeping anything of them.
+type headerVerifier interface {
+	verifyHeaders(parent BlockHeader, headers []BlockHeader) error
+}
+
+// blockAcceptor is an engine that keeps something of the blocks that are accepted, e.g. the signers after them
+type blockAcceptor interface {
+	accept(parent, h BlockHeader)
+}
+
+// ConsensusSettings are the engine and it's settings, set by flags or a genesis spec
+type ConsensusSettings struct {
+	Engine     string        // pow, poa or pos
+	Difficulty int64         // number of zero's of a proof (pow), hashDifficulty if 0
+	Signers    []string      // public keys of the signers (poa) or stakers (pos) at the genesis block
+	KeyFile    string        // key of this node as a signer or staker
+	Period     time.Duration // time between two blocks (poa), or of a slot (pos)
+}
+
+// The engine of new chains, set with the -consensus flag
+var engine ConsensusEngine = powEngine{}
+
+// newConsensusEngine returns the engine of the settings
+func newConsensusEngine(settings ConsensusSettings) (ConsensusEngine, error) {
+	switch settings.Engine {
+	case "pow":
+		if settings.Difficulty < 0 || settings.Difficulty > 15 {
+			return nil, fmt.Errorf("invalid consensus settings (difficulty %d, 1 to 15 zero's)", settings.Difficulty)
+		}
+		return powEngine{zeros: settings.Difficulty}, nil
+	case "poa":
+		e, err := newPoaEngine(settings)
+		if err != nil {
+			return nil, err
+		}
+		return e, nil
+	case "pos":
+		e, err := newPosEngine(settings)
+		if err != nil {
+			return nil, err
+		}
+		return e, nil
+	}
+	return nil, fmt.Errorf("invalid consensus engine (%s is unknown)", settings.Engine)
+}
+
+// consensus returns the engine of the chain, the engine of new chains if it has none
+func (bc *Blockchain) consensus() ConsensusEngine {
+	if bc.engine == nil {
+		return engine
+	}
+	return bc.engine
+}
+
+// accepted tells the engine the block passed all checks, which happens once all checks of the block are done
+func (bc *Blockchain) accepted(parent, h BlockHeader) {
+	if a, ok := bc.consensus().(blockAcceptor); ok {
+		a.accept(parent, h)
+	}
+}
+
+// chainWeight returns the sum of the weights of the headers
+func chainWeight(e ConsensusEngine, headers []BlockHeader) int64 {
+	var weight int64
+	for _, h := range headers {
+		weight += e.weight(h)
+	}
+	return weight
+}
+
+// blockHeaders returns the headers of the blocks
+func blockHeaders(blocks []Block) []BlockHeader {
+	headers := make([]BlockHeader, 0, len(blocks))
+	for _, bl := range blocks {
+		headers = append(headers, bl.header())
+	}
+	return headers
+}
+
+// prefers tells if the engine of the chain prefers the candidate over the chain.
+// The chains are compared after their fork point, which is searched from the last block of the candidate.
+func (bc *Blockchain) prefers(candidate []Block) bool {
+	fork := len(candidate) - 1
+	for fork >= 0 && (fork >= len(bc.Chain) || hash(bc.Chain[fork]) != hash(candidate[fork])) {
+		fork--
+	}
+	return bc.consensus().forkChoice(blockHeaders(bc.Chain[fork+1:]), blockHeaders(candidate[fork+1:]))
+}
+
+// powEngine is a simple Proof of Work:
+// Find a number p such that hash('pl') contains leading X zeroes, where
+// l is the previous Proof, and p is the new Proof
+type powEngine struct {
+	zeros int64 // the number of zero's, hashDifficulty if 0
+}
+
+func (powEngine) name() string {
+	return "pow"
+}
+
+// seal finds the proof of the block
+func (e powEngine) seal(parent BlockHeader, bl *Block) error {
+	difficulty := e.difficulty(parent)
+	var proof int64 = 0
+	for !e.validProof(parent.Proof, proof, difficulty) {
+		proof++
+	}
+	glog.Infof("Proof found in %d cycles (difficulty %d)\n", proof, difficulty)
+	bl.Proof = proof
+	return nil
+}
+
+// verifySeal checks the proof of the header
+func (e powEngine) verifySeal(parent, h BlockHeader) error {
+	if !e.validProof(parent.Proof, h.Proof, e.difficulty(parent)) {
+		return fmt.Errorf("invalid proof of block %d", h.Index)
+	}
+	return nil
+}
+
+// verifyBlock does nothing, the proof only depends on the parent
+func (powEngine) verifyBlock(chain []Block, bl Block) error {
+	return nil
+}
+
+// difficulty is the number of zero's the hash should start with, it is fixed
+func (e powEngine) difficulty(parent BlockHeader) int64 {
+	if e.zeros == 0 {
+		return hashDifficulty
+	}
+	return e.zeros
+}
+
+// weight is the number of hashes that are needed to find a proof, on average
+func (e powEngine) weight(h BlockHeader) int64 {
+	return 1 << uint(4*e.difficulty(h))
+}
+
+// forkChoice follows the branch with the most work, ours if they are equal
+func (e powEngine) forkChoice(ours, theirs []BlockHeader) bool {
+	return chainWeight(e, theirs) > chainWeight(e, ours)
+}
+
+// validProof tells if the hash of the proof and last proof starts with difficulty zero's
+func (powEngine) validProof(lastProof, proof, difficulty int64) bool {
+	guess := fmt.Sprintf("%d%d", proof, lastProof)
+	guessHash := fmt.Sprintf("%x", sha256.Sum256([]byte(guess)))
+	return strings.HasPrefix(guessHash, strings.Repeat("0", int(difficulty)))
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// sequenceEngine seals a block with a proof higher than the proof of it's parent, the proof is the weight
+// of the block. It shows the chain code runs with another engine than proof of work.
+type sequenceEngine struct{}
+
+func (sequenceEngine) name() string { return "sequence" }
+
+func (sequenceEngine) seal(parent BlockHeader, bl *Block) error {
+	bl.Proof = parent.Proof + 1
+	return nil
+}
+
+func (sequenceEngine) verifySeal(parent, h BlockHeader) error {
+	if h.Proof <= parent.Proof {
+		return fmt.Errorf("invalid proof of block %d", h.Index)
+	}
+	return nil
+}
+
+func (sequenceEngine) verifyBlock(chain []Block, bl Block) error { return nil }
+
+func (sequenceEngine) difficulty(parent BlockHeader) int64 { return 1 }
+
+func (sequenceEngine) weight(h BlockHeader) int64 { return h.Proof }
+
+func (e sequenceEngine) forkChoice(ours, theirs []BlockHeader) bool {
+	return chainWeight(e, theirs) > chainWeight(e, ours)
+}
+
+func TestPowEngine(t *testing.T) {
+	pow := powEngine{}
+	parent := Block{Index: 1, Proof: genesisProof, PreviousHash: zerohash}
+	bl := Block{Index: 2, PreviousHash: hash(parent)}
+	if err := pow.seal(parent.header(), &bl); err != nil {
+		t.Fatalf("Could not seal a block: %s", err)
+	}
+	if err := pow.verifySeal(parent.header(), bl.header()); err != nil {
+		t.Errorf("Sealed block should be valid, got %s", err)
+	}
+	bl.Proof++
+	if pow.verifySeal(parent.header(), bl.header()) == nil {
+		t.Error("Block with another proof should be invalid")
+	}
+
+	one, two := []BlockHeader{bl.header()}, []BlockHeader{bl.header(), bl.header()}
+	if pow.forkChoice(one, one) || pow.forkChoice(two, one) || !pow.forkChoice(one, two) {
+		t.Error("Proof of work should follow the branch with the most work, ours if they are equal")
+	}
+	if _, err := newConsensusEngine(ConsensusSettings{Engine: "unknown"}); err == nil {
+		t.Error("Unknown engine should be refused")
+	}
+}
+
+func TestConsensusEngine(t *testing.T) {
+	saveGlobals(t)
+
+	a := newTestChain("consensus-a")
+	pow := &Blockchain{Chain: append([]Block{}, a.bc.Chain...)}
+	a.bc.engine = sequenceEngine{}
+	for i := 0; i < 3; i++ {
+		a.mine(t)
+		pow.Chain = append(pow.Chain, a.bc.lastBlock())
+	}
+	if a.bc.lastBlock().Proof != genesisProof+3 {
+		t.Errorf("Blocks should be sealed by the engine of the chain, got proof %d", a.bc.lastBlock().Proof)
+	}
+	if !a.bc.validate() {
+		t.Error("Chain should be valid with it's engine")
+	}
+	if pow.validate() {
+		t.Error("Chain of another engine should be invalid with proof of work")
+	}
+
+	// a shorter branch wins if it weighs more
+	heavy := Block{Index: 2, Timestamp: a.bc.Chain[0].Timestamp + 1, Proof: 1000, PreviousHash: hash(a.bc.Chain[0])}
+	candidate := &Blockchain{Chain: []Block{a.bc.Chain[0], heavy}, engine: a.bc.engine}
+	if !candidate.validate() || !a.bc.replaceChain(candidate, []Block{heavy}) {
+		t.Fatal("Heavier branch should replace the chain")
+	}
+	if len(a.bc.Chain) != 2 || a.bc.prefers(pow.Chain) {
+		t.Error("Lighter branch should not be preferred, even if it is longer")
+	}
+}
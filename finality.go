@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grrrben/glog"
+)
+
+// Finality bounds how much of the chain a fork can rewrite. A block at the height of a checkpoint must have the
+// hash of the checkpoint, so a chain that differs from a checkpoint is never accepted. A fork that would replace
+// more than the max reorg depth of our blocks is rejected as well, even if the consensus engine prefers it; it's
+// kept as an alert for the operator to review, who can add a checkpoint or raise the depth.
+
+// The default maximum number of blocks of our chain a fork may replace
+const defaultMaxReorgDepth = 100
+
+// The maximum number of reorg alerts that are kept
+const maxReorgAlerts = 100
+
+// hardCheckpoints are the checkpoints of the network by height (block index). None yet; the genesis block is
+// created by the first node, so it's hash differs per network.
+var hardCheckpoints = map[int64]string{}
+
+// ReorgAlert is a fork that was rejected because it's deeper than the max reorg depth
+type ReorgAlert struct {
+	Peer   string `json:"peer"`
+	Fork   int64  `json:"fork"`   // index of the last common block
+	Depth  int    `json:"depth"`  // the number of our blocks it would replace
+	Tip    string `json:"tip"`    // hash of the last block of the fork
+	Length int64  `json:"length"` // length of the fork
+	Time   int64  `json:"time"`   // UnixNano
+}
+
+// Finality holds the checkpoints and the max reorg depth of a chain, and the alerts of rejected forks
+type Finality struct {
+	sync.Mutex
+	checkpoints   map[int64]string
+	maxReorgDepth int // 0 for no limit
+	alerts        []ReorgAlert
+}
+
+// The finality of the chain of this node, set by flags
+var finality = newFinality(nil, defaultMaxReorgDepth)
+
+// newFinality returns the finality with the checkpoints added to the hard-coded checkpoints
+func newFinality(checkpoints map[int64]string, maxReorgDepth int) *Finality {
+	f := &Finality{checkpoints: make(map[int64]string), maxReorgDepth: maxReorgDepth}
+	for height, h := range hardCheckpoints {
+		f.checkpoints[height] = h
+	}
+	for height, h := range checkpoints {
+		f.checkpoints[height] = h
+	}
+	return f
+}
+
+// parseCheckpoints parses comma separated checkpoints, e.g. "1000:00ab...,2000:00cd..."
+func parseCheckpoints(s string) (map[int64]string, error) {
+	checkpoints := make(map[int64]string)
+	for _, checkpoint := range strings.Split(s, ",") {
+		if checkpoint = strings.TrimSpace(checkpoint); checkpoint == "" {
+			continue
+		}
+		parts := strings.SplitN(checkpoint, ":", 2)
+		if len(parts) != 2 || len(parts[1]) != len(zerohash) {
+			return nil, fmt.Errorf("invalid checkpoint %s (expected height:hash)", checkpoint)
+		}
+		height, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || height < 1 {
+			return nil, fmt.Errorf("invalid checkpoint %s (height should be a block index)", checkpoint)
+		}
+		checkpoints[height] = parts[1]
+	}
+	return checkpoints, nil
+}
+
+// finalityRules returns the finality of the chain, or the finality of this node if the chain has none
+func (bc *Blockchain) finalityRules() *Finality {
+	if bc.finality == nil {
+		return finality
+	}
+	return bc.finality
+}
+
+// checkHeader checks that a header at the height of a checkpoint has the hash of the checkpoint
+func (f *Finality) checkHeader(h BlockHeader) error {
+	if checkpoint, ok := f.checkpoints[h.Index]; ok && checkpoint != h.hash() {
+		return fmt.Errorf("invalid block (block %d does not match checkpoint %s)", h.Index, checkpoint)
+	}
+	return nil
+}
+
+// checkReorg checks that the fork of a peer, after the block at position fork of the chain, does not replace
+// more blocks than the max reorg depth. A deeper fork is kept as an alert.
+func (f *Finality) checkReorg(chain []Block, fork int, peer string, tip BlockHeader) error {
+	depth := len(chain) - 1 - fork
+	if f.maxReorgDepth <= 0 || depth <= f.maxReorgDepth {
+		return nil
+	}
+	var forkIndex int64
+	if fork >= 0 {
+		forkIndex = chain[fork].Index
+	}
+	glog.Errorf("Rejected a fork of %s after block %d, it would replace %d blocks (max %d)", peer, forkIndex, depth, f.maxReorgDepth)
+
+	f.Lock()
+	defer f.Unlock()
+	f.alerts = append(f.alerts, ReorgAlert{
+		Peer:   peer,
+		Fork:   forkIndex,
+		Depth:  depth,
+		Tip:    tip.hash(),
+		Length: tip.Index,
+		Time:   time.Now().UnixNano(),
+	})
+	if len(f.alerts) > maxReorgAlerts {
+		f.alerts = f.alerts[len(f.alerts)-maxReorgAlerts:]
+	}
+	return errors.New("invalid fork (deeper than the max reorg depth)")
+}
+
+// reorgAlerts returns the alerts of the rejected forks, oldest first
+func (f *Finality) reorgAlerts() []ReorgAlert {
+	f.Lock()
+	defer f.Unlock()
+	return append([]ReorgAlert{}, f.alerts...)
+}
+
+// clearAlerts removes the alerts once they are reviewed. Returns the number of alerts removed.
+func (f *Finality) clearAlerts() int {
+	f.Lock()
+	defer f.Unlock()
+	cleared := len(f.alerts)
+	f.alerts = nil
+	return cleared
+}
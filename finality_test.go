@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseCheckpoints(t *testing.T) {
+	checkpoints, err := parseCheckpoints("1:" + zerohash + ", 20:" + zerohash)
+	if err != nil || len(checkpoints) != 2 || checkpoints[20] != zerohash {
+		t.Errorf("Expected 2 checkpoints, got %v (%v)", checkpoints, err)
+	}
+	for _, invalid := range []string{"1", "x:" + zerohash, "0:" + zerohash, "1:00ab"} {
+		if _, err := parseCheckpoints(invalid); err == nil {
+			t.Errorf("Checkpoint %s should be invalid", invalid)
+		}
+	}
+}
+
+func TestCheckpoints(t *testing.T) {
+	saveGlobals(t)
+
+	a := newTestChain("checkpoint-a")
+	b := forkTestChain(a, "checkpoint-b")
+	a.mine(t)
+	a.mine(t)
+	for i := 0; i < 4; i++ {
+		b.mine(t)
+	}
+	a.bc.finality = newFinality(map[int64]string{2: hash(a.bc.Chain[1])}, 0)
+
+	serverB := b.server()
+	defer serverB.Close()
+	nodeB := serverNode(serverB)
+	a.nodes.addNode(&nodeB)
+	a.use()
+	if bc.resolve() || len(a.bc.Chain) != 3 {
+		t.Error("Chain should not be replaced by a chain that differs from a checkpoint")
+	}
+	other := &Blockchain{Chain: b.bc.Chain, finality: a.bc.finality}
+	if other.validate() {
+		t.Error("Chain that differs from a checkpoint should be invalid")
+	}
+	a.bc.Chain = a.bc.Chain[:1]
+	if _, err := a.bc.addBlock(b.bc.Chain[1]); err == nil {
+		t.Error("Block that differs from a checkpoint should be invalid")
+	}
+}
+
+func TestMaxReorgDepth(t *testing.T) {
+	saveGlobals(t)
+
+	a := newTestChain("reorg-a")
+	a.mine(t)
+	b := forkTestChain(a, "reorg-b")
+	for i := 0; i < 3; i++ {
+		a.mine(t)
+	}
+	for i := 0; i < 6; i++ {
+		b.mine(t)
+	}
+	a.bc.finality = newFinality(nil, 2)
+
+	serverB := b.server()
+	defer serverB.Close()
+	nodeB := serverNode(serverB)
+	a.nodes.addNode(&nodeB)
+	a.use()
+	if bc.resolve() || len(a.bc.Chain) != 5 {
+		t.Fatal("Chain should not be replaced by a fork deeper than the max reorg depth")
+	}
+
+	var resp struct {
+		Alerts []ReorgAlert `json:"alerts"`
+	}
+	a.call(t, "GET", "/reorgs", nil, &resp)
+	if len(resp.Alerts) != 1 || resp.Alerts[0].Depth != 3 || resp.Alerts[0].Fork != 2 || resp.Alerts[0].Tip != hash(b.bc.lastBlock()) {
+		t.Fatalf("Expected an alert of the fork after block 2, got %v", resp.Alerts)
+	}
+	if code := a.call(t, "DELETE", "/reorgs", nil, nil); code != http.StatusForbidden {
+		t.Errorf("Alerts should only be cleared by the admin, got %d", code)
+	}
+	local := httptest.NewRequest("DELETE", "/reorgs", nil)
+	local.RemoteAddr = "127.0.0.1:1234"
+	if code := a.serve(t, local, nil); code != http.StatusOK || len(a.bc.finality.reorgAlerts()) != 0 {
+		t.Error("Alerts should be cleared")
+	}
+
+	a.bc.finality.maxReorgDepth = 3
+	a.use()
+	if !bc.resolve() || hash(a.bc.lastBlock()) != hash(b.bc.lastBlock()) {
+		t.Error("Chain should be replaced by a fork within the max reorg depth")
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A network is defined by a genesis spec; the name (chain ID) of the network, the time it started, the coins
+// allocated to wallets at the start and the consensus settings. The genesis block is derived from the spec
+// only, so every node with the same spec has the same genesis block and hash, and no node has to create it.
+// Every network has a spec, see NetworkParams; without one the first node creates a genesis block with the
+// current time.
+
+// GenesisSpec defines a network and it's genesis block
+type GenesisSpec struct {
+	ChainID     string             `json:"chainId"`     // name of the network
+	Timestamp   int64              `json:"timestamp"`   // UnixNano, of the genesis block
+	Allocations map[string]float64 `json:"allocations"` // coins of wallets (hash) at the genesis block
+	Consensus   ConsensusSpec      `json:"consensus"`
+}
+
+// ConsensusSpec are the consensus settings of a network, the key of a signer is set per node
+type ConsensusSpec struct {
+	Engine     string   `json:"engine"`               // pow, poa or pos
+	Difficulty int64    `json:"difficulty,omitempty"` // number of zero's of a proof (pow)
+	Signers    []string `json:"signers,omitempty"`    // signers (poa) or stakers (pos) at the genesis block
+	Period     string   `json:"period,omitempty"`     // time between two blocks (poa), or of a slot (pos), e.g. 5s
+}
+
+// The genesis spec of the network, or of the -genesis flag. Nil without a spec.
+var genesis *GenesisSpec
+
+// loadGenesisSpec reads and validates a genesis spec
+func loadGenesisSpec(file string) (*GenesisSpec, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var spec GenesisSpec
+	if err = json.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("invalid genesis spec (%s)", err)
+	}
+	if err = spec.validate(); err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// validate checks the spec, including the consensus settings
+func (spec GenesisSpec) validate() error {
+	if spec.ChainID == "" {
+		return errors.New("invalid genesis spec (no chain ID)")
+	}
+	if spec.Timestamp <= 0 {
+		return errors.New("invalid genesis spec (no timestamp)")
+	}
+	for address, amount := range spec.Allocations {
+		if _, err := hex.DecodeString(address); err != nil || len(address) != len(zerohash) {
+			return fmt.Errorf("invalid genesis spec (allocation to %s, not a wallet)", address)
+		}
+		if amount <= 0 {
+			return fmt.Errorf("invalid genesis spec (allocation to %s should be positive)", address)
+		}
+	}
+	settings, err := spec.consensusSettings()
+	if err != nil {
+		return err
+	}
+	_, err = newConsensusEngine(settings)
+	return err
+}
+
+// consensusSettings returns the consensus settings of the spec, without a key
+func (spec GenesisSpec) consensusSettings() (ConsensusSettings, error) {
+	settings := ConsensusSettings{Engine: spec.Consensus.Engine, Difficulty: spec.Consensus.Difficulty, Signers: spec.Consensus.Signers}
+	if spec.Consensus.Period != "" {
+		period, err := time.ParseDuration(spec.Consensus.Period)
+		if err != nil {
+			return settings, fmt.Errorf("invalid genesis spec (period %s)", spec.Consensus.Period)
+		}
+		settings.Period = period
+	}
+	return settings, nil
+}
+
+// block returns the genesis block of the spec. It holds a transaction that names the network and a transaction
+// per allocation, sorted by wallet.
+func (spec GenesisSpec) block() Block {
+	transactions := []Transaction{{
+		Sender:    zerohash,
+		Recipient: zerohash,
+		Message:   fmt.Sprintf("Genesis of %s", spec.ChainID),
+		Time:      spec.Timestamp,
+	}}
+	addresses := make([]string, 0, len(spec.Allocations))
+	for address := range spec.Allocations {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	for _, address := range addresses {
+		transactions = append(transactions, Transaction{
+			Sender:    zerohash,
+			Recipient: address,
+			Amount:    spec.Allocations[address],
+			Message:   "Genesis allocation",
+			Time:      spec.Timestamp,
+		})
+	}
+	return Block{
+		Index:        1,
+		Timestamp:    spec.Timestamp,
+		Transactions: transactions,
+		Proof:        genesisProof,
+		PreviousHash: zerohash,
+	}
+}
+
+// generateGenesis runs the genesis command, which writes a genesis spec made from the flags and shows the hash
+// of it's genesis block, e.g. gocoin genesis -chain-id test -alloc 4e1a...:100 -out genesis.json
+func generateGenesis(args []string) error {
+	flags := flag.NewFlagSet("genesis", flag.ContinueOnError)
+	out := flags.String("out", "genesis.json", "File the spec is written to, - for stdout")
+	chainID := flags.String("chain-id", "", "Name of the network")
+	timestamp := flags.Int64("timestamp", 0, "Time of the genesis block (UnixNano), defaults to now")
+	alloc := flags.String("alloc", "", "Comma separated allocations of coins to wallets, e.g. 4e1a...:100")
+	consensus := flags.String("consensus", "pow", "Consensus engine of the network, pow, poa or pos")
+	difficulty := flags.Int64("difficulty", hashDifficulty, "Number of zero's of a proof (pow)")
+	signers := flags.String("signers", "", "Comma separated public keys of the signers (poa) or stakers (pos)")
+	period := flags.Duration("period", 5*time.Second, "Time between two blocks (poa), or of a slot (pos)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	spec := GenesisSpec{
+		ChainID:     *chainID,
+		Timestamp:   *timestamp,
+		Allocations: make(map[string]float64),
+		Consensus:   ConsensusSpec{Engine: *consensus},
+	}
+	if spec.Timestamp == 0 {
+		spec.Timestamp = time.Now().UnixNano()
+	}
+	for _, allocation := range strings.Split(*alloc, ",") {
+		if allocation = strings.TrimSpace(allocation); allocation == "" {
+			continue
+		}
+		parts := strings.SplitN(allocation, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid allocation %s (expected wallet:amount)", allocation)
+		}
+		amount, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return fmt.Errorf("invalid allocation %s (%s)", allocation, err)
+		}
+		spec.Allocations[parts[0]] += amount
+	}
+	switch spec.Consensus.Engine {
+	case "pow":
+		spec.Consensus.Difficulty = *difficulty
+	case "poa", "pos":
+		if *signers != "" {
+			spec.Consensus.Signers = strings.Split(*signers, ",")
+		}
+		spec.Consensus.Period = period.String()
+	}
+	if err := spec.validate(); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(spec, "", "    ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if *out == "-" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = ioutil.WriteFile(*out, data, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Genesis block of %s: %s\n", spec.ChainID, hash(spec.block()))
+	return nil
+}
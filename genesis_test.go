@@ -0,0 +1,86 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testGenesisSpec() GenesisSpec {
+	return GenesisSpec{
+		ChainID:     "test",
+		Timestamp:   1500000000000000000,
+		Allocations: map[string]float64{strings.Repeat("ab", 32): 50, strings.Repeat("cd", 32): 25},
+		Consensus:   ConsensusSpec{Engine: "pow", Difficulty: 2},
+	}
+}
+
+func TestGenesisSpec(t *testing.T) {
+	saveGlobals(t)
+
+	spec := testGenesisSpec()
+	if err := spec.validate(); err != nil {
+		t.Fatalf("Valid spec refused: %s", err)
+	}
+	genesis = &spec
+	a, b := newTestChain("genesis-a"), newTestChain("genesis-b")
+	if len(a.bc.Chain) != 1 || hash(a.bc.Chain[0]) != hash(b.bc.Chain[0]) || hash(a.bc.Chain[0]) != hash(spec.block()) {
+		t.Fatal("Nodes with the same spec should have the same genesis block")
+	}
+	if err := b.bc.checkHandshake(a.bc.handshake()); err != nil {
+		t.Errorf("Nodes with the same spec should be on the same chain: %s", err)
+	}
+	if credits := walletCredits(strings.Repeat("ab", 32), a.bc.Chain, nil, -1); credits != 50 {
+		t.Errorf("Allocation should be credited at the genesis block, got %f", credits)
+	}
+
+	other := testGenesisSpec()
+	other.ChainID = "other"
+	if hash(other.block()) == hash(spec.block()) {
+		t.Error("Another network should have another genesis block")
+	}
+
+	invalid := map[string]func(spec *GenesisSpec){
+		"chain ID":   func(spec *GenesisSpec) { spec.ChainID = "" },
+		"timestamp":  func(spec *GenesisSpec) { spec.Timestamp = 0 },
+		"wallet":     func(spec *GenesisSpec) { spec.Allocations["abc"] = 1 },
+		"amount":     func(spec *GenesisSpec) { spec.Allocations[strings.Repeat("ef", 32)] = -1 },
+		"engine":     func(spec *GenesisSpec) { spec.Consensus.Engine = "unknown" },
+		"difficulty": func(spec *GenesisSpec) { spec.Consensus.Difficulty = 16 },
+		"period":     func(spec *GenesisSpec) { spec.Consensus = ConsensusSpec{Engine: "poa", Period: "often"} },
+	}
+	for name, change := range invalid {
+		spec := testGenesisSpec()
+		change(&spec)
+		if spec.validate() == nil {
+			t.Errorf("Spec with an invalid %s should be refused", name)
+		}
+	}
+}
+
+func TestGenerateGenesis(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "genesis.json")
+	args := []string{"-out", file, "-chain-id", "test", "-timestamp", "1500000000000000000", "-difficulty", "2",
+		"-alloc", strings.Repeat("ab", 32) + ":50," + strings.Repeat("cd", 32) + ":25"}
+	if err := generateGenesis(args); err != nil {
+		t.Fatalf("Could not generate a spec: %s", err)
+	}
+	spec, err := loadGenesisSpec(file)
+	if err != nil {
+		t.Fatalf("Could not load the generated spec: %s", err)
+	}
+	if hash(spec.block()) != hash(testGenesisSpec().block()) {
+		t.Errorf("Generated spec should have the same genesis block, got %v", spec)
+	}
+	settings, _ := spec.consensusSettings()
+	if e, err := newConsensusEngine(settings); err != nil || e.difficulty(BlockHeader{}) != 2 {
+		t.Errorf("Expected proof of work with 2 zero's, got %v (%v)", e, err)
+	}
+
+	if err := generateGenesis([]string{"-out", file, "-chain-id", "test", "-alloc", "abc"}); err == nil {
+		t.Error("Invalid allocation should be refused")
+	}
+	if err := generateGenesis([]string{"-out", file, "-consensus", "poa"}); err == nil {
+		t.Error("Spec without a chain ID and signers should be refused")
+	}
+}
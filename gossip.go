@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grrrben/glog"
+)
+
+// Blocks and transactions are gossiped by their hash (inventory). A node that receives inventory it
+// does not have, requests the data from the sender and relays the inventory to it's own peers.
+// Every node keeps a set of seen hashes, so inventory is only requested and relayed once. A hash is seen
+// once the data arrives, while it's requested the hash is kept in flight, so it isn't requested from another
+// peer until the request times out.
+
+// The maximum number of hashes in the seen set
+const maxSeen = 10000
+
+// The time a hash is kept in the seen set
+const seenExpiry = time.Hour
+
+// The time after which inventory that was requested but did not arrive, may be requested again
+const requestTimeout = 30 * time.Second
+
+// Inventory identifies a block or transaction by it's hash
+type Inventory struct {
+	Type string `json:"type"` // block or transaction
+	Hash string `json:"hash"`
+}
+
+// seenSet holds the hashes of the inventory a node has seen, with the time it was first seen.
+type seenSet struct {
+	sync.Mutex
+	hashes map[string]time.Time
+}
+
+func newSeenSet() *seenSet {
+	return &seenSet{hashes: make(map[string]time.Time)}
+}
+
+// markSeen adds a hash to the set. Returns true if the hash was not seen before.
+func (s *seenSet) markSeen(h string) bool {
+	s.Lock()
+	defer s.Unlock()
+	if seen, ok := s.hashes[h]; ok && time.Since(seen) < seenExpiry {
+		return false
+	}
+	if len(s.hashes) >= maxSeen {
+		for seenHash, seen := range s.hashes {
+			if time.Since(seen) >= seenExpiry {
+				delete(s.hashes, seenHash)
+			}
+		}
+		if len(s.hashes) >= maxSeen {
+			s.hashes = make(map[string]time.Time) // start over, at worst inventory is requested twice
+		}
+	}
+	s.hashes[h] = time.Now()
+	return true
+}
+
+// requestSet holds the hashes of the inventory that is requested, with the peer it's requested from and
+// the time of the request.
+type requestSet struct {
+	sync.Mutex
+	requests map[string]request
+}
+
+type request struct {
+	peer string
+	time time.Time
+}
+
+func newRequestSet() *requestSet {
+	return &requestSet{requests: make(map[string]request)}
+}
+
+// request marks the hash as requested from the peer. Returns false if it's requested already and the
+// request did not time out.
+func (s *requestSet) request(h string, peer string) bool {
+	s.Lock()
+	defer s.Unlock()
+	if r, ok := s.requests[h]; ok && time.Since(r.time) < requestTimeout {
+		return false
+	}
+	for requested, r := range s.requests {
+		if time.Since(r.time) >= requestTimeout {
+			delete(s.requests, requested)
+		}
+	}
+	s.requests[h] = request{peer: peer, time: time.Now()}
+	return true
+}
+
+// arrived removes the hash from the set. Returns true if it was requested from the peer.
+func (s *requestSet) arrived(h string, peer string) bool {
+	s.Lock()
+	defer s.Unlock()
+	r, ok := s.requests[h]
+	if !ok || r.peer != peer {
+		return false
+	}
+	delete(s.requests, h)
+	return true
+}
+
+// cancel removes the inventory requested from the peer, so it can be requested from another peer
+func (s *requestSet) cancel(inv []Inventory, peer string) {
+	s.Lock()
+	defer s.Unlock()
+	for _, item := range inv {
+		if r, ok := s.requests[item.Hash]; ok && r.peer == peer {
+			delete(s.requests, item.Hash)
+		}
+	}
+}
+
+// has tells if the hash is in the set and did not expire
+func (s *seenSet) has(h string) bool {
+	s.Lock()
+	defer s.Unlock()
+	seen, ok := s.hashes[h]
+	return ok && time.Since(seen) < seenExpiry
+}
+
+// seenSet returns the seen set of the network
+func (nodes *Nodes) seenSet() *seenSet {
+	if nodes.seen == nil {
+		nodes.seen = newSeenSet()
+	}
+	return nodes.seen
+}
+
+// requestSet returns the inventory requested from the network
+func (nodes *Nodes) requestSet() *requestSet {
+	if nodes.requests == nil {
+		nodes.requests = newRequestSet()
+	}
+	return nodes.requests
+}
+
+// relay announces the inventory to all nodes, except ourself and the node it came from.
+// Connected nodes get the inventory over their peer connection, the others over HTTP.
+func (nodes *Nodes) relay(self Node, inv []Inventory, origin string) {
+	for _, item := range inv {
+		nodes.seenSet().markSeen(item.Hash)
+	}
+	for _, node := range nodes.list() {
+		if node == self || node.getAddress() == origin || !nodes.hasFeature(node, "inv") {
+			continue
+		}
+		if p, ok := nodes.connection(node); ok {
+			go func(p *peerConn) {
+				if err := p.sendMessage(msgInv, 0, inv); err != nil {
+					glog.Warningf("Could not send inventory to %s: %s", p.node.getAddress(), err)
+					nodes.disconnect(p)
+				}
+			}(p)
+			continue
+		}
+		go nodes.announceInventory(node, self, inv)
+	}
+}
+
+// announceInventory sends inventory to a node, which requests what it doesn't have.
+// The announcement is signed with the identity key of the sender.
+func (nodes *Nodes) announceInventory(node Node, sender Node, inv []Inventory) {
+	url := fmt.Sprintf("%s/inv", node.getAddress())
+	signature, err := sender.signAnnouncement("inv", inventoryHashes(inv)...)
+	if err != nil {
+		glog.Errorf("Could not sign inventory: %s", err)
+		return
+	}
+	payload, err := json.Marshal(map[string]interface{}{"inventory": inv, "sender": sender.getAddress(), "signature": signature})
+	if err != nil {
+		glog.Errorf("Could not marshall inventory. Msg: %s", err)
+		return
+	}
+	resp, err := httpClient.Post(url, "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		glog.Warningf("POST request error: %s", err)
+		// the node is removed from the list if it keeps failing, see pingNodes
+		nodes.recordFailure(node)
+		return
+	}
+	nodes.recordSeen(node, 0)
+	resp.Body.Close()
+}
+
+// inventoryHashes returns the hashes of the inventory
+func inventoryHashes(inv []Inventory) []string {
+	hashes := make([]string, 0, len(inv))
+	for _, item := range inv {
+		hashes = append(hashes, item.Hash)
+	}
+	return hashes
+}
+
+// fetchData requests the blocks and transactions of the inventory from the node at the address
+func fetchData(address string, inv []Inventory) ([]Block, []Transaction, error) {
+	var resp struct {
+		Blocks       []Block       `json:"blocks"`
+		Transactions []Transaction `json:"transactions"`
+	}
+	payload, err := json.Marshal(map[string]interface{}{"inventory": inv})
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := httpClient.Post(fmt.Sprintf("%s/getdata", address), "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Body.Close()
+	err = json.NewDecoder(r.Body).Decode(&resp)
+	return resp.Blocks, resp.Transactions, err
+}
+
+// hasInventory tells if the block or transaction is already known, in the chain, the orphan pool
+// or the pending transactions.
+func (bc *Blockchain) hasInventory(item Inventory) bool {
+	bc.Lock()
+	defer bc.Unlock()
+	if item.Type == "block" {
+		return bc.findFork([]string{item.Hash}) >= 0 || bc.orphanPool().has(item.Hash)
+	}
+	for _, tr := range bc.Transactions {
+		if tr.getHash() == item.Hash {
+			return true
+		}
+	}
+	return false
+}
+
+// getData returns the blocks and pending transactions of the inventory. Unknown items are skipped.
+func (bc *Blockchain) getData(inv []Inventory) ([]Block, []Transaction) {
+	bc.Lock()
+	defer bc.Unlock()
+	var hashes []string
+	wanted := make(map[string]bool)
+	for _, item := range inv {
+		if item.Type == "block" {
+			hashes = append(hashes, item.Hash)
+		} else {
+			wanted[item.Hash] = true
+		}
+	}
+	transactions := []Transaction{}
+	for _, tr := range bc.Transactions {
+		if wanted[tr.getHash()] {
+			transactions = append(transactions, tr)
+		}
+	}
+	return bc.blocksByHash(hashes), transactions
+}
+
+// wantedInventory returns the inventory that was not seen before, is not known yet and is not requested
+// from another peer. The wanted inventory is marked as requested from the sender.
+func (bc *Blockchain) wantedInventory(peers *Nodes, sender string, inv []Inventory) []Inventory {
+	if peers.banList().isBanned(sender) {
+		return nil
+	}
+	var wanted []Inventory
+	for _, item := range inv {
+		if (item.Type == "block" || item.Type == "transaction") && !peers.seenSet().has(item.Hash) && !bc.hasInventory(item) && peers.requestSet().request(item.Hash, sender) {
+			wanted = append(wanted, item)
+		}
+	}
+	return wanted
+}
+
+// receiveInventory requests the inventory that was not seen before from the sender, adds it and relays it
+// to the other peers. Returns the number of items requested.
+func (bc *Blockchain) receiveInventory(peers *Nodes, self Node, sender string, inv []Inventory) int {
+	wanted := bc.wantedInventory(peers, sender, inv)
+	if len(wanted) == 0 {
+		return 0
+	}
+
+	go func() {
+		blocks, transactions, err := fetchData(sender, wanted)
+		if err != nil {
+			glog.Warningf("Could not fetch data from %s: %s", sender, err)
+		} else {
+			bc.receiveData(peers, self, sender, blocks, transactions)
+		}
+		peers.requestSet().cancel(wanted, sender) // what did not arrive can be requested from another peer
+	}()
+	return len(wanted)
+}
+
+// receiveData adds the blocks and transactions received from the sender and relays the ones that are added
+// to the other peers. Data that was not requested from the sender is ignored, invalid data counts as
+// misbehaviour of the sender. A transaction that is only invalid on our chain is dropped without counting.
+func (bc *Blockchain) receiveData(peers *Nodes, self Node, sender string, blocks []Block, transactions []Transaction) {
+	var relay []Inventory
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Index < blocks[j].Index })
+	for _, bl := range blocks {
+		if !peers.requestSet().arrived(hash(bl), sender) {
+			glog.Warningf("Block %d from %s was not requested", bl.Index, sender)
+			continue
+		}
+		peers.seenSet().markSeen(hash(bl))
+		added, err := bc.receiveBlock(bl, sender)
+		if err != nil {
+			glog.Warningf("Invalid block %d from %s: %s", bl.Index, sender, err)
+			peers.banList().misbehave(sender, scoreInvalidBlock, err.Error())
+		} else if added {
+			relay = append(relay, Inventory{Type: "block", Hash: hash(bl)})
+		}
+	}
+	for _, tr := range transactions {
+		if !peers.requestSet().arrived(tr.getHash(), sender) {
+			glog.Warningf("Transaction %s from %s was not requested", tr.getHash(), sender)
+			continue
+		}
+		peers.seenSet().markSeen(tr.getHash())
+		added, err := bc.receiveTransaction(tr)
+		if err != nil && checkTransactionFormat(tr) != nil {
+			glog.Warningf("Invalid transaction from %s: %s", sender, err)
+			peers.banList().misbehave(sender, scoreInvalidTransaction, err.Error())
+		} else if err != nil {
+			// e.g. mined already or spending the same credits as another transaction, the sender may not know yet
+			glog.Infof("Transaction %s from %s is not added: %s", tr.getHash(), sender, err)
+		} else if added {
+			relay = append(relay, Inventory{Type: "transaction", Hash: tr.getHash()})
+		}
+	}
+	if len(relay) > 0 {
+		peers.relay(self, relay, sender)
+	}
+}
+
+// receiveTransaction adds a transaction received from a peer, unless it's known already.
+// Returns true if the transaction is added.
+func (bc *Blockchain) receiveTransaction(tr Transaction) (bool, error) {
+	bc.Lock()
+	defer bc.Unlock()
+	if !bc.isNonExistingTransaction(tr) {
+		return false, nil
+	}
+	_, err := bc.newTransaction(tr)
+	return err == nil, err
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSeenSet(t *testing.T) {
+	seen := newSeenSet()
+	if !seen.markSeen("hash") {
+		t.Error("New hash should not be seen")
+	}
+	if seen.markSeen("hash") {
+		t.Error("Hash should be seen the second time")
+	}
+	seen.hashes["hash"] = time.Now().Add(-seenExpiry)
+	if !seen.markSeen("hash") {
+		t.Error("Expired hash should not be seen")
+	}
+
+	for i := 0; i < maxSeen; i++ {
+		seen.markSeen(string(rune(i)))
+	}
+	if len(seen.hashes) > maxSeen {
+		t.Errorf("Seen set should be bounded to %d hashes, got %d", maxSeen, len(seen.hashes))
+	}
+}
+
+func TestRequestSet(t *testing.T) {
+	requests := newRequestSet()
+	if !requests.request("hash", "peer-a") {
+		t.Error("New hash should be requested")
+	}
+	if requests.request("hash", "peer-b") {
+		t.Error("Hash in flight should not be requested again")
+	}
+	if requests.arrived("hash", "peer-b") {
+		t.Error("Hash should only arrive from the peer it's requested from")
+	}
+	if !requests.arrived("hash", "peer-a") || requests.arrived("hash", "peer-a") {
+		t.Error("Hash should arrive once from the peer it's requested from")
+	}
+
+	requests.request("hash", "peer-a")
+	requests.requests["hash"] = request{peer: "peer-a", time: time.Now().Add(-requestTimeout)}
+	if !requests.request("hash", "peer-b") {
+		t.Error("Hash should be requested again when the request timed out")
+	}
+	requests.cancel([]Inventory{{Type: "block", Hash: "hash"}}, "peer-b")
+	if !requests.request("hash", "peer-a") {
+		t.Error("Cancelled hash should be requested again")
+	}
+}
+
+// TestGossipRelay relays a block and a transaction over a line of nodes a - b - c, c only hears of them through b.
+func TestGossipRelay(t *testing.T) {
+	saveGlobals(t)
+
+	a := newTestChain("gossip-a")
+	b := forkTestChain(a, "gossip-b")
+	c := forkTestChain(a, "gossip-c")
+	for _, chain := range []*testChain{a, b, c} {
+		server := chain.listen()
+		defer server.Close()
+	}
+	connect(a, b)
+	connect(b, c)
+
+	a.mine(t)
+	if !waitFor(func() bool { return c.length() == a.length() }) {
+		t.Fatalf("Block was not relayed to c, got length %d, expected %d", len(c.bc.Chain), len(a.bc.Chain))
+	}
+
+	code := a.call(t, "POST", "/transaction", map[string]interface{}{
+		"sender":    a.me.Hash,
+		"recipient": c.me.Hash,
+		"amount":    1,
+	}, nil)
+	if code != http.StatusOK {
+		t.Fatalf("Could not add transaction, got %d", code)
+	}
+	tr := a.bc.Transactions[0]
+	if !waitFor(func() bool { return c.hasTransaction(tr) }) {
+		t.Error("Transaction was not relayed to c")
+	}
+
+	// inventory that is seen already is not requested again
+	var resp struct {
+		Requested int `json:"requested"`
+	}
+	inv := []Inventory{{Type: "transaction", Hash: tr.getHash()}, {Type: "block", Hash: hash(a.bc.lastBlock())}}
+	signature, _ := a.me.signAnnouncement("inv", inventoryHashes(inv)...)
+	b.call(t, "POST", "/inv", map[string]interface{}{
+		"inventory": inv,
+		"sender":    a.me.getAddress(),
+		"signature": signature,
+	}, &resp)
+	if resp.Requested != 0 {
+		t.Errorf("Seen inventory should not be requested, got %d items", resp.Requested)
+	}
+
+	// data that was not requested is ignored
+	d := forkTestChain(c, "gossip-d")
+	d.mine(t)
+	c.bc.receiveData(c.nodes, c.me, a.me.getAddress(), []Block{d.bc.lastBlock()}, nil)
+	if c.length() == d.length() {
+		t.Error("Block that was not requested was added")
+	}
+}
+
+func TestGetData(t *testing.T) {
+	saveGlobals(t)
+
+	a := newTestChain("getdata")
+	a.mine(t)
+	a.call(t, "POST", "/transaction", map[string]interface{}{
+		"sender":    a.me.Hash,
+		"recipient": createWallet().hash,
+		"amount":    1,
+	}, nil)
+
+	var resp struct {
+		Blocks       []Block       `json:"blocks"`
+		Transactions []Transaction `json:"transactions"`
+	}
+	a.call(t, "POST", "/getdata", map[string]interface{}{
+		"inventory": []Inventory{
+			{Type: "block", Hash: hash(a.bc.Chain[1])},
+			{Type: "block", Hash: "unknown"},
+			{Type: "transaction", Hash: a.bc.Transactions[0].getHash()},
+		},
+	}, &resp)
+	if len(resp.Blocks) != 1 || hash(resp.Blocks[0]) != hash(a.bc.Chain[1]) {
+		t.Errorf("Expected block 2, got %v", resp.Blocks)
+	}
+	if len(resp.Transactions) != 1 || resp.Transactions[0].getHash() != a.bc.Transactions[0].getHash() {
+		t.Errorf("Expected the pending transaction, got %v", resp.Transactions)
+	}
+}
+
+func TestReceiveDataScores(t *testing.T) {
+	saveGlobals(t)
+
+	c := newTestChain("gossip-scores")
+	c.mine(t)
+	c.mine(t)
+	sender := "http://10.0.0.9:8000"
+	w, _ := getWallet(c.me.Hash)
+	mined := Transaction{Sender: w.hash, Recipient: strings.Repeat("ab", 32), Amount: 1, Time: time.Now().UnixNano()}
+	w.signTransaction(&mined)
+	if _, err := c.bc.addTransaction(mined); err != nil {
+		t.Fatalf("Could not add a transaction: %s", err)
+	}
+	c.mine(t)
+	forged := Transaction{Sender: w.hash, Recipient: strings.Repeat("ab", 32), Amount: 1, Time: time.Now().UnixNano()}
+
+	score := func(tr Transaction) int {
+		c.nodes.banList().clear("")
+		c.nodes.requestSet().request(tr.getHash(), sender)
+		c.bc.receiveData(c.nodes, c.me, sender, nil, []Transaction{tr})
+		_, scores := c.nodes.banList().all()
+		return scores[peerAddress(sender)]
+	}
+	if s := score(mined); s != 0 {
+		t.Errorf("A transaction that is mined already should not count as misbehaviour, got score %d", s)
+	}
+	if s := score(forged); s != scoreInvalidTransaction {
+		t.Errorf("A transaction without a valid script should count as misbehaviour, got score %d", s)
+	}
+}
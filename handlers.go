@@ -1,10 +1,14 @@
 package main
 
 import (
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/grrrben/glog"
@@ -16,14 +20,52 @@ func (a *App) index(w http.ResponseWriter, r *http.Request) {
 
 // wallet Shows some stats of a wallet, including the credits available
 func (a *App) wallet(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hash, err := parseAddress(vars["hash"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	resp := map[string]interface{}{
+		"success":   true,
+		"address":   networkAddress(hash),
+		"credit":    getWalletCredits(hash),
+		"spendable": getSpendableCredits(hash),
+	}
+	if w, ok := getWallet(hash); ok {
+		// a wallet of this node, others need the public key for scripts like a HTLC
+		resp["publicKey"] = hex.EncodeToString(publicKeyBytes(w.key))
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// walletTokens shows the credits per token of a wallet
+func (a *App) walletTokens(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	hash := vars["hash"]
 
 	resp := map[string]interface{}{
 		"success": true,
-		"credit":  getWalletCredits(hash),
+		"tokens":  getWalletTokens(hash),
 	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
 
+// token shows the definition of the token with {id}
+func (a *App) token(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	bc.Lock()
+	token, found := findToken(id, bc.Chain, bc.Transactions)
+	bc.Unlock()
+	if !found {
+		respondWithError(w, http.StatusNotFound, fmt.Sprintf("Could not find token %s", id))
+		return
+	}
+	resp := map[string]interface{}{"success": true, "token": token}
 	respondWithJSON(w, http.StatusOK, resp)
 }
 
@@ -34,9 +76,12 @@ func (a *App) transactions(w http.ResponseWriter, r *http.Request) {
 	hash := vars["hash"]
 
 	transactions := []Transaction{}
+	bc.Lock()
+	chain := bc.Chain
+	bc.Unlock()
 
 	// check all blocks, see if the hash is the sender or receiver.
-	for _, block := range bc.Chain {
+	for _, block := range chain {
 		for _, transaction := range block.Transactions {
 			if transaction.Sender == hash || transaction.Recipient == hash {
 				transactions = append(transactions, transaction)
@@ -48,7 +93,10 @@ func (a *App) transactions(w http.ResponseWriter, r *http.Request) {
 
 // currentTransactions shows all transactions that are not in a block yet
 func (a *App) currentTransactions(w http.ResponseWriter, r *http.Request) {
-	respondWithJSON(w, http.StatusOK, bc.Transactions)
+	bc.Lock()
+	transactions := bc.Transactions
+	bc.Unlock()
+	respondWithJSON(w, http.StatusOK, transactions)
 }
 
 // distributedTransaction receives a transaction from another node in the network.
@@ -60,6 +108,7 @@ func (a *App) distributedTransaction(w http.ResponseWriter, r *http.Request) {
 	type Payload struct {
 		Transaction Transaction `json:"transaction"`
 		Sender      string      `json:"sender"`
+		Signature   string      `json:"signature"`
 	}
 
 	var payload Payload
@@ -67,17 +116,31 @@ func (a *App) distributedTransaction(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		glog.Warningf("Invalid Transaction (Unable to decode) on Node: %s", me.getAddress())
+		nodes.banList().misbehave(r.RemoteAddr, scoreInvalidPayload, "undecodable transaction")
 		respondWithError(w, http.StatusUnprocessableEntity, "Invalid Transaction (Unable to decode)")
+	} else if err = nodes.verifyAnnouncement(payload.Sender, payload.Signature, "transaction", payload.Transaction.getHash()); err != nil {
+		glog.Warningf("Invalid Transaction (%s) on Node: %s", err, me.getAddress())
+		nodes.banList().misbehave(r.RemoteAddr, scoreInvalidPayload, err.Error())
+		respondWithError(w, http.StatusUnauthorized, err.Error())
 	} else {
 		glog.Infof("payload: %v", payload)
-		if bc.isNonExistingTransaction(payload.Transaction) {
-			glog.Infof("transaction: %v", payload.Transaction)
+		bc.Lock()
+		known := !bc.isNonExistingTransaction(payload.Transaction)
+		if !known {
 			_, err = bc.newTransaction(payload.Transaction)
+		}
+		bc.Unlock()
+		if !known {
+			glog.Infof("transaction: %v", payload.Transaction)
 			if err != nil {
 				glog.Warningf("%s on Node: %s", err, me.getAddress())
+				if checkTransactionFormat(payload.Transaction) != nil {
+					nodes.banList().misbehave(r.RemoteAddr, scoreInvalidTransaction, err.Error())
+				}
 				respondWithError(w, http.StatusUnprocessableEntity, err.Error())
 			} else {
 				glog.Infof("Transaction added on Node: %s", me.getAddress())
+				nodes.relay(me, []Inventory{{Type: "transaction", Hash: payload.Transaction.getHash()}}, payload.Sender)
 				respondWithJSON(w, http.StatusOK, "Transaction added")
 			}
 		} else {
@@ -92,6 +155,7 @@ func (a *App) distributedTransaction(w http.ResponseWriter, r *http.Request) {
 // Sender string
 // Recipient string
 // Amount float32
+// Script and Witness strings, unless the Sender is a wallet of this node, which signs it.
 func (a *App) newTransaction(w http.ResponseWriter, r *http.Request) {
 	var tr Transaction
 	err := json.NewDecoder(r.Body).Decode(&tr)
@@ -100,9 +164,20 @@ func (a *App) newTransaction(w http.ResponseWriter, r *http.Request) {
 		glog.Warningf("Invalid Transaction (%s)", err)
 		respondWithError(w, http.StatusUnprocessableEntity, "Invalid Transaction (Unable to decode)")
 	} else {
-		// for a new transaction, time should be added by the system
-		tr.Time = 0
-		addedTransaction, err := bc.newTransaction(tr)
+		// the recipient may be given as an address of the network
+		tr.Recipient, err = parseAddress(tr.Recipient)
+		if err == nil && tr.Witness == "" {
+			// for a new transaction, time should be added by the system
+			tr.Time = time.Now().UnixNano()
+			// transactions from wallets of this node are signed by the node
+			if w, ok := getWallet(tr.Sender); ok {
+				err = w.signTransaction(&tr)
+			}
+		}
+		var addedTransaction Transaction
+		if err == nil {
+			addedTransaction, err = bc.addTransaction(tr)
+		}
 		if err != nil {
 			respondWithError(w, http.StatusUnprocessableEntity, err.Error())
 		} else {
@@ -113,6 +188,289 @@ func (a *App) newTransaction(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// createHTLC creates a hash time-locked contract and funds it from a wallet of this node.
+// The postdata consists of the sender (wallet hash), the recipientKey (hex public key),
+// the hashlock (hex sha256 of the secret), a timeout (block index or timestamp) and the amount.
+func (a *App) createHTLC(w http.ResponseWriter, r *http.Request) {
+	type Payload struct {
+		Sender       string  `json:"sender"`
+		RecipientKey string  `json:"recipientKey"`
+		Hashlock     string  `json:"hashlock"`
+		Timeout      int64   `json:"timeout"`
+		Amount       float64 `json:"amount"`
+	}
+
+	var payload Payload
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, "Invalid HTLC (Unable to decode)")
+		return
+	}
+
+	sender, ok := getWallet(payload.Sender)
+	if !ok {
+		respondWithError(w, http.StatusUnprocessableEntity, "Invalid HTLC (Sender is not a wallet of this node)")
+		return
+	}
+	recipientKey, err := hex.DecodeString(payload.RecipientKey)
+	if err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, "Invalid HTLC (Invalid recipient key)")
+		return
+	}
+	hashlock, err := hex.DecodeString(payload.Hashlock)
+	if err != nil || len(hashlock) != 32 {
+		respondWithError(w, http.StatusUnprocessableEntity, "Invalid HTLC (Invalid hashlock)")
+		return
+	}
+	if payload.Timeout <= 0 {
+		respondWithError(w, http.StatusUnprocessableEntity, "Invalid HTLC (Invalid timeout)")
+		return
+	}
+	if payload.Amount <= 0 {
+		respondWithError(w, http.StatusUnprocessableEntity, "Invalid HTLC (Invalid amount)")
+		return
+	}
+
+	htlc := newHTLC(hashlock, recipientKey, publicKeyBytes(sender.key), payload.Timeout)
+	tr := Transaction{
+		Sender:    sender.hash,
+		Recipient: htlc.Address,
+		Amount:    payload.Amount,
+		Message:   "HTLC",
+		Time:      time.Now().UnixNano(),
+	}
+	if err = sender.signTransaction(&tr); err == nil {
+		tr, err = bc.addTransaction(tr)
+	}
+	if err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	nodes.distributeTransaction(tr)
+	resp := map[string]interface{}{"success": true, "htlc": htlc, "transaction": tr}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// claimHTLC claims the credits of the HTLC with {address} by revealing the preimage of the hashlock.
+// The postdata consists of the script of the HTLC, the (hex) preimage and the wallet of this node that
+// holds the recipient key. The credits are paid to that wallet.
+func (a *App) claimHTLC(w http.ResponseWriter, r *http.Request) {
+	type Payload struct {
+		Script   string `json:"script"`
+		Preimage string `json:"preimage"`
+		Wallet   string `json:"wallet"`
+	}
+
+	var payload Payload
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, "Invalid HTLC (Unable to decode)")
+		return
+	}
+	preimage, err := hex.DecodeString(payload.Preimage)
+	if err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, "Invalid HTLC (Invalid preimage)")
+		return
+	}
+
+	htlc, wal, amount, err := htlcSpend(mux.Vars(r)["address"], payload.Script, payload.Wallet)
+	if err == nil {
+		var tr Transaction
+		if tr, err = htlc.claimTransaction(wal, preimage, wal.hash, amount); err == nil {
+			tr, err = bc.addTransaction(tr)
+		}
+		if err == nil {
+			nodes.distributeTransaction(tr)
+			respondWithJSON(w, http.StatusOK, map[string]interface{}{"success": true, "transaction": tr})
+			return
+		}
+	}
+	respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+}
+
+// refundHTLC pays the credits of the HTLC with {address} back to the sender.
+// The refund is only added to a block after the timeout of the HTLC. The postdata consists of the
+// script of the HTLC and the wallet of this node that holds the refund key.
+func (a *App) refundHTLC(w http.ResponseWriter, r *http.Request) {
+	type Payload struct {
+		Script string `json:"script"`
+		Wallet string `json:"wallet"`
+	}
+
+	var payload Payload
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, "Invalid HTLC (Unable to decode)")
+		return
+	}
+
+	htlc, wal, amount, err := htlcSpend(mux.Vars(r)["address"], payload.Script, payload.Wallet)
+	if err == nil {
+		var tr Transaction
+		if tr, err = htlc.refundTransaction(wal, wal.hash, amount); err == nil {
+			tr, err = bc.addTransaction(tr)
+		}
+		if err == nil {
+			nodes.distributeTransaction(tr)
+			respondWithJSON(w, http.StatusOK, map[string]interface{}{"success": true, "transaction": tr})
+			return
+		}
+	}
+	respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+}
+
+// htlcPreimage shows the preimage of the HTLC with {address} once it is claimed.
+// The script of the HTLC is given by the script query parameter.
+func (a *App) htlcPreimage(w http.ResponseWriter, r *http.Request) {
+	htlc, err := parseHTLC(r.URL.Query().Get("script"))
+	if err != nil || htlc.Address != mux.Vars(r)["address"] {
+		respondWithError(w, http.StatusUnprocessableEntity, "Invalid HTLC (Script does not match address)")
+		return
+	}
+	preimage, found := htlc.findPreimage()
+	if !found {
+		respondWithError(w, http.StatusNotFound, "HTLC is not claimed")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"success": true, "preimage": hex.EncodeToString(preimage)})
+}
+
+// htlcSpend checks the script and wallet used to spend from a HTLC and returns the spendable amount.
+func htlcSpend(address, script, walletHash string) (HTLC, wallet, float64, error) {
+	htlc, err := parseHTLC(script)
+	if err != nil {
+		return htlc, wallet{}, 0, err
+	}
+	if htlc.Address != address {
+		return htlc, wallet{}, 0, errors.New("invalid htlc (script does not match address)")
+	}
+	wal, ok := getWallet(walletHash)
+	if !ok {
+		return htlc, wal, 0, errors.New("invalid htlc (wallet is not a wallet of this node)")
+	}
+	amount := getSpendableCredits(address)
+	if amount <= 0 {
+		return htlc, wal, 0, errors.New("invalid htlc (no credits)")
+	}
+	return htlc, wal, amount, nil
+}
+
+// openChannel opens a payment channel with the node of another party, funded by a wallet of this node.
+// The postdata consists of the wallet (hash), the peerKey (hex public key of the other party),
+// the peer (address of the node of the other party) and the amount.
+func (a *App) openChannel(w http.ResponseWriter, r *http.Request) {
+	type Payload struct {
+		Wallet  string  `json:"wallet"`
+		PeerKey string  `json:"peerKey"`
+		Peer    string  `json:"peer"`
+		Amount  float64 `json:"amount"`
+	}
+
+	var payload Payload
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, "Invalid Channel (Unable to decode)")
+		return
+	}
+	wal, ok := getWallet(payload.Wallet)
+	if !ok {
+		respondWithError(w, http.StatusUnprocessableEntity, "Invalid Channel (Wallet is not a wallet of this node)")
+		return
+	}
+	peerKey, err := hex.DecodeString(payload.PeerKey)
+	if err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, "Invalid Channel (Invalid peer key)")
+		return
+	}
+
+	ch, err := openChannel(wal, peerKey, payload.Peer, payload.Amount)
+	if err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"success": true, "channel": ch})
+}
+
+// channel shows the last state of the payment channel with {address}
+func (a *App) channel(w http.ResponseWriter, r *http.Request) {
+	ch, ok := getChannel(mux.Vars(r)["address"])
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Unknown channel")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"success": true, "channel": ch})
+}
+
+// channelAction performs an action on the payment channel with {address}:
+// pay (postdata {"amount": 1}), close (cooperative), force-close (unilateral) or settle.
+func (a *App) channelAction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ch, ok := getChannel(vars["address"])
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Unknown channel")
+		return
+	}
+
+	var result interface{}
+	var err error
+	switch vars["action"] {
+	case "pay":
+		var payload struct {
+			Amount float64 `json:"amount"`
+		}
+		if err = json.NewDecoder(r.Body).Decode(&payload); err == nil {
+			err = ch.pay(payload.Amount)
+			result = ch
+		}
+	case "close":
+		result, err = ch.cooperativeClose()
+	case "force-close":
+		bc.Lock()
+		result, err = ch.publish(bc, "close")
+		bc.Unlock()
+	case "settle":
+		result, err = ch.settle()
+	default:
+		respondWithError(w, http.StatusNotFound, "Unknown action")
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"success": true, "result": result})
+}
+
+// channelMessage receives a message of the other party of a payment channel:
+// open (sign the first state), update (sign a new state) or cooperate (sign the payouts of a close).
+func (a *App) channelMessage(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var msg channelMessage
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, "Invalid Channel (Unable to decode)")
+		return
+	}
+
+	var answer channelMessage
+	var err error
+	if vars["action"] == "open" {
+		answer.Signature, err = acceptChannel(msg)
+	} else if ch, ok := getChannel(vars["address"]); !ok {
+		err = errors.New("unknown channel")
+	} else if vars["action"] == "update" {
+		answer.Signature, err = ch.receiveUpdate(msg)
+	} else {
+		answer.Signatures, err = ch.cooperate(msg)
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, answer)
+}
+
 // distributedBlock is a receiver for blocks mined by other nodes.
 // It catches the newly mined block and checks for validity on his own chain
 // If it is valid the block is added and a statusOk is returned.
@@ -122,38 +480,45 @@ func (a *App) distributedBlock(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 
 	type Payload struct {
-		NewBlock Block  `json:"block"`
-		Sender   string `json:"sender"`
+		NewBlock  Block  `json:"block"`
+		Sender    string `json:"sender"`
+		Signature string `json:"signature"`
 	}
 
 	var payload Payload
 	err := decoder.Decode(&payload)
 	if err != nil {
 		glog.Errorf("Could not decode postdata of new block; %s", err.Error())
+		nodes.banList().misbehave(r.RemoteAddr, scoreInvalidPayload, "undecodable block")
 		respondWithError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	err = nodes.verifyAnnouncement(payload.Sender, payload.Signature, "block", hash(payload.NewBlock))
+	if err != nil {
+		nodes.banList().misbehave(r.RemoteAddr, scoreInvalidPayload, err.Error())
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
 	}
-	block, err := bc.addBlock(payload.NewBlock)
+	added, err := bc.receiveBlock(payload.NewBlock, payload.Sender)
 
-	if err == nil {
-		bc.clearTransactions(block.Transactions)
+	if err != nil {
+		glog.Warningf("Invalid block %d from %s: %s", payload.NewBlock.Index, payload.Sender, err)
+		nodes.banList().misbehave(r.RemoteAddr, scoreInvalidBlock, err.Error())
+		respondWithError(w, http.StatusConflict, "Invalid block")
+	} else if added {
+		nodes.relay(me, []Inventory{{Type: "block", Hash: hash(payload.NewBlock)}}, payload.Sender)
 		resp := map[string]interface{}{
 			"success": true,
 			"message": "New block added",
 		}
 		respondWithJSON(w, http.StatusOK, resp)
 	} else {
-		repair := bc.analyseInvalidBlock(payload.NewBlock, payload.Sender)
-
-		if repair == false {
-			// better resolve..?
-			respondWithError(w, http.StatusConflict, "Invalid block")
-		} else {
-			resp := map[string]interface{}{
-				"success": true,
-				"message": "New blocks added",
-			}
-			respondWithJSON(w, http.StatusOK, resp)
+		// the parent is unknown, it is requested in the background
+		resp := map[string]interface{}{
+			"success": true,
+			"message": "Block added to the orphan pool",
 		}
+		respondWithJSON(w, http.StatusAccepted, resp)
 	}
 }
 
@@ -165,7 +530,9 @@ func (a *App) resolve(w http.ResponseWriter, r *http.Request) {
 
 // lastblock Serves single block
 func (a *App) lastblock(w http.ResponseWriter, r *http.Request) {
-	block := bc.Chain[len(bc.Chain)-1]
+	bc.Lock()
+	block := bc.lastBlock()
+	bc.Unlock()
 	resp := map[string]interface{}{"success": true, "block": block}
 	respondWithJSON(w, http.StatusOK, resp)
 }
@@ -175,8 +542,11 @@ func (a *App) block(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	hash := vars["hash"]
 	found := false
+	bc.Lock()
+	chain := bc.Chain
+	bc.Unlock()
 
-	for _, bl := range bc.Chain {
+	for _, bl := range chain {
 		if bl.PreviousHash == hash {
 			found = true
 			resp := map[string]interface{}{"success": true, "block": bl}
@@ -201,8 +571,11 @@ func (a *App) blockByIndex(w http.ResponseWriter, r *http.Request) {
 	}
 
 	found := false
+	bc.Lock()
+	chain := bc.Chain
+	bc.Unlock()
 
-	for _, bl := range bc.Chain {
+	for _, bl := range chain {
 		if bl.Index == index {
 			found = true
 			resp := map[string]interface{}{"success": true, "block": bl}
@@ -216,49 +589,242 @@ func (a *App) blockByIndex(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// chainStatus tells about the lenght and last hash of the chain.
+// chainStatus tells about the lenght and last hash of the chain, and the progress of syncing.
 func (a *App) chainStatus(w http.ResponseWriter, r *http.Request) {
-	hash := bc.Chain[len(bc.Chain)-1].PreviousHash
-	resp := map[string]interface{}{"length": len(bc.Chain), "hash": hash}
+	bc.Lock()
+	chain := bc.Chain
+	bc.Unlock()
+	hash := chain[len(chain)-1].PreviousHash
+	resp := map[string]interface{}{
+		"length":         len(chain),
+		"hash":           hash,
+		"sync":           syncReport(),
+		"medianTimePast": medianTimePast(chain),
+		"networkTime":    nodes.networkTime().UnixNano(),
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// headers serves the headers that follow the fork point of a locator, a comma separated list of
+// block hashes given by the locator query parameter.
+func (a *App) headers(w http.ResponseWriter, r *http.Request) {
+	var locator []string
+	if l := r.URL.Query().Get("locator"); l != "" {
+		locator = strings.Split(l, ",")
+	}
+	bc.Lock()
+	headers := bc.headersAfter(locator, maxHeadersPerRequest)
+	bc.Unlock()
+	resp := map[string]interface{}{"success": true, "headers": headers}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// blocks serves the blocks with the hashes given by the postdata {"hashes": []}
+func (a *App) blocks(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Hashes []string `json:"hashes"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	bc.Lock()
+	blocks := bc.blocksByHash(payload.Hashes)
+	bc.Unlock()
+	resp := map[string]interface{}{"success": true, "blocks": blocks}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// inventory receives the hashes of blocks and transactions announced by another node.
+// The postdata {"inventory": [], "sender": "", "signature": ""}, signed by the sender. The data that is not known yet is requested from the sender in the background.
+func (a *App) inventory(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Inventory []Inventory `json:"inventory"`
+		Sender    string      `json:"sender"`
+		Signature string      `json:"signature"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		nodes.banList().misbehave(r.RemoteAddr, scoreInvalidPayload, "undecodable inventory")
+		respondWithError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	err = nodes.verifyAnnouncement(payload.Sender, payload.Signature, "inv", inventoryHashes(payload.Inventory)...)
+	if err != nil {
+		nodes.banList().misbehave(r.RemoteAddr, scoreInvalidPayload, err.Error())
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	requested := bc.receiveInventory(nodes, me, payload.Sender, payload.Inventory)
+	resp := map[string]interface{}{"success": true, "requested": requested}
+	respondWithJSON(w, http.StatusAccepted, resp)
+}
+
+// getData serves the blocks and pending transactions of the inventory in the postdata {"inventory": []}
+func (a *App) getData(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Inventory []Inventory `json:"inventory"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	blocks, transactions := bc.getData(payload.Inventory)
+	resp := map[string]interface{}{"success": true, "blocks": blocks, "transactions": transactions}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// blocksAfterLocator serves the blocks that follow the fork point of the locator in the postdata {"locator": []}
+// The hash of the fork point is returned as well, or a 404 if none of the hashes is known.
+func (a *App) blocksAfterLocator(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Locator []string `json:"locator"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	bc.Lock()
+	fork, blocks := bc.blocksAfter(payload.Locator, maxBlocksPerLocator)
+	var forkBlock Block
+	if fork >= 0 {
+		forkBlock = bc.Chain[fork]
+	}
+	bc.Unlock()
+	if fork < 0 {
+		respondWithError(w, http.StatusNotFound, "No common block found")
+		return
+	}
+	resp := map[string]interface{}{"success": true, "fork": hash(forkBlock), "index": forkBlock.Index, "blocks": blocks}
 	respondWithJSON(w, http.StatusOK, resp)
 }
 
 // connectNode Connect a Node to the network which is represented
-// in the Nodes.list The postdata should consist of a standard Node
+// in the Nodes.list The postdata should consist of a standard Node, with a timestamp and signature (a Greeting)
 func (a *App) connectNode(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
-	var newCl Node
-	err := decoder.Decode(&newCl)
+	var greeting Greeting
+	err := decoder.Decode(&greeting)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "invalid json")
-		glog.Panicf("Could not decode postdata of new node; %s", err.Error())
+		glog.Warningf("Could not decode postdata of new node; %s", err.Error())
+		return
 	}
-	// register the node
-	added := nodes.addNode(&newCl)
-	if added {
-		resp := map[string]interface{}{"Node": newCl, "total": nodes.num()}
-		respondWithJSON(w, http.StatusOK, resp)
-	} else {
+	// the greeting should be signed by the node at the address
+	if err = greeting.verify(); err != nil {
+		glog.Warningf("Greeting of %s refused: %s", greeting.getAddress(), err)
+		nodes.banList().misbehave(r.RemoteAddr, scoreInvalidPayload, err.Error())
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if err = bc.checkHandshake(greeting.Handshake); err != nil {
+		glog.Warningf("Greeting of %s refused: %s", greeting.getAddress(), err)
+		respondWithError(w, http.StatusPreconditionFailed, err.Error())
+		return
+	}
+	// register the node, a known node is updated as it may have restarted with another identity
+	newCl := greeting.Node
+	if !nodes.updateNode(newCl) && !nodes.addNode(&newCl) {
 		respondWithError(w, http.StatusConflict, "Node could not be added")
+		return
 	}
+	info := nodes.recordHandshake(newCl, greeting.Handshake)
+	nodes.addressBook().markConnected(newCl, "greeting")
+	resp := map[string]interface{}{"Node": newCl, "total": nodes.num(), "handshake": bc.handshake(), "features": info.Features}
+	respondWithJSON(w, http.StatusOK, resp)
 }
 
-// getNodes response is the list of Nodes
+// getNodes response is the list of Nodes, with their health
 func (a *App) getNodes(w http.ResponseWriter, r *http.Request) {
-	resp := map[string]interface{}{"list": nodes.List, "length": len(nodes.List)}
+	resp := map[string]interface{}{"list": nodes.statusList(), "length": nodes.num()}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// addresses response is the address book, the nodes this node heard of
+func (a *App) addresses(w http.ResponseWriter, r *http.Request) {
+	inbound, outbound := nodes.countConnections()
+	list := nodes.addressBook().list()
+	resp := map[string]interface{}{"list": list, "length": len(list), "inbound": inbound, "outbound": outbound}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// identity signs the challenge in the postdata {"challenge": ""} with the identity key of this node,
+// to prove this node is at it's address
+func (a *App) identity(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Challenge string `json:"challenge"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil || payload.Challenge == "" {
+		respondWithError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	signature, err := me.answerChallenge(payload.Challenge)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	resp := map[string]interface{}{"publicKey": me.PublicKey, "signature": signature}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// ping is used by other nodes to check if this node is alive
+func (a *App) ping(w http.ResponseWriter, r *http.Request) {
+	resp := map[string]interface{}{"success": true, "length": bc.length()}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// getBans shows the banned peers and the misbehaviour scores of the other peers
+func (a *App) getBans(w http.ResponseWriter, r *http.Request) {
+	bans, scores := nodes.banList().all()
+	resp := map[string]interface{}{"bans": bans, "scores": scores, "length": len(bans)}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// clearBans lifts the ban of the peer with the address (host), or of all peers if no address is given
+func (a *App) clearBans(w http.ResponseWriter, r *http.Request) {
+	cleared := nodes.banList().clear(mux.Vars(r)["address"])
+	resp := map[string]interface{}{"success": true, "cleared": cleared}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// getReorgs shows the checkpoints, the max reorg depth and the forks that were rejected because they are too deep
+func (a *App) getReorgs(w http.ResponseWriter, r *http.Request) {
+	f := bc.finalityRules()
+	alerts := f.reorgAlerts()
+	resp := map[string]interface{}{
+		"checkpoints":   f.checkpoints,
+		"maxReorgDepth": f.maxReorgDepth,
+		"alerts":        alerts,
+		"length":        len(alerts),
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// clearReorgs removes the alerts of the rejected forks, once they are reviewed
+func (a *App) clearReorgs(w http.ResponseWriter, r *http.Request) {
+	cleared := bc.finalityRules().clearAlerts()
+	resp := map[string]interface{}{"success": true, "cleared": cleared}
 	respondWithJSON(w, http.StatusOK, resp)
 }
 
 // chain shows the entire blockchain
 func (a *App) chain(w http.ResponseWriter, r *http.Request) {
+	bc.Lock()
 	resp := map[string]interface{}{"chain": bc.Chain, "transactions": bc.Transactions, "length": len(bc.Chain)}
+	bc.Unlock()
 	respondWithJSON(w, http.StatusOK, resp)
 }
 
 // validate checks the entire blockchain
 func (a *App) validate(w http.ResponseWriter, r *http.Request) {
+	bc.Lock()
 	isValid := bc.validate()
 	resp := map[string]interface{}{"valid": isValid, "length": len(bc.Chain)}
+	bc.Unlock()
 	respondWithJSON(w, http.StatusOK, resp)
 }
 
@@ -272,13 +838,231 @@ func (a *App) mine(w http.ResponseWriter, r *http.Request) {
 		resp := map[string]interface{}{
 			"message":      "New block mined.",
 			"Block":        block,
-			"length":       len(bc.Chain),
+			"length":       bc.length(),
 			"transactions": len(block.Transactions),
 		}
 		respondWithJSON(w, http.StatusOK, resp)
 	}
 }
 
+// deployments shows the state of the deployments of the network for the next block, and how many blocks of the
+// current window signal for them
+func (a *App) deployments(w http.ResponseWriter, r *http.Request) {
+	bc.Lock()
+	chain := bc.Chain
+	bc.Unlock()
+	vb := network.VersionBits
+	var window []Block
+	if vb.Window > 0 {
+		window = chain[len(chain)-len(chain)%vb.Window:]
+	}
+	var list []map[string]interface{}
+	for _, d := range vb.Deployments {
+		list = append(list, map[string]interface{}{
+			"name":      d.Name,
+			"bit":       d.Bit,
+			"startTime": d.StartTime,
+			"timeout":   d.Timeout,
+			"state":     deploymentState(chain, d),
+			"signals":   signalCount(window, d),
+		})
+	}
+	resp := map[string]interface{}{
+		"deployments": list,
+		"window":      vb.Window,
+		"threshold":   vb.Threshold,
+		"version":     blockVersion(chain),
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// generate mines a number of blocks at once, on networks that allow it (regtest), postdata {"blocks": 10}
+func (a *App) generate(w http.ResponseWriter, r *http.Request) {
+	if !network.Generate {
+		respondWithError(w, http.StatusForbidden, fmt.Sprintf("blocks can not be generated on %s", network.Name))
+		return
+	}
+	var payload struct {
+		Blocks int `json:"blocks"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.Blocks < 1 || payload.Blocks > maxGenerateBlocks {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("invalid number of blocks (1 to %d)", maxGenerateBlocks))
+		return
+	}
+	hashes := []string{}
+	for i := 0; i < payload.Blocks; i++ {
+		block, err := bc.mine()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		hashes = append(hashes, hash(block))
+	}
+	resp := map[string]interface{}{"success": true, "hashes": hashes, "length": bc.length()}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// signers shows the signers after the last block of a proof of authority chain, their votes and our proposals
+func (a *App) signers(w http.ResponseWriter, r *http.Request) {
+	poa, ok := bc.consensus().(*poaEngine)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "invalid consensus engine (not proof of authority)")
+		return
+	}
+	bc.Lock()
+	last := bc.lastBlock().header()
+	bc.Unlock()
+	snap, err := poa.snapshot(last)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	poa.Lock()
+	proposals := make(map[string]bool, len(poa.proposals))
+	for signer, authorize := range poa.proposals {
+		proposals[signer] = authorize
+	}
+	poa.Unlock()
+	resp := map[string]interface{}{
+		"signers":   snap.Signers,
+		"votes":     snap.Votes,
+		"inTurn":    snap.Signers[(last.Index+1)%int64(len(snap.Signers))],
+		"signer":    poa.signer,
+		"proposals": proposals,
+		"period":    poa.period.String(),
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// voteSigner makes this signer vote to add or remove a signer in the blocks it seals,
+// postdata {"signer": "public key", "authorize": true}
+func (a *App) voteSigner(w http.ResponseWriter, r *http.Request) {
+	poa, ok := bc.consensus().(*poaEngine)
+	if !ok || poa.key == nil {
+		respondWithError(w, http.StatusBadRequest, "invalid consensus engine (not a proof of authority signer)")
+		return
+	}
+	var vote SignerVote
+	if err := json.NewDecoder(r.Body).Decode(&vote); err != nil {
+		respondWithError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := poa.propose(vote.Signer, vote.Authorize); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	resp := map[string]interface{}{"message": "Vote added.", "signer": vote.Signer, "authorize": vote.Authorize}
+	respondWithJSON(w, http.StatusCreated, resp)
+}
+
+// getStakes shows the stakes of a proof of stake chain, the leader of the next slot and the double signs that
+// are not slashed yet
+func (a *App) getStakes(w http.ResponseWriter, r *http.Request) {
+	pos, ok := bc.consensus().(*posEngine)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "invalid consensus engine (not proof of stake)")
+		return
+	}
+	bc.Lock()
+	list := stakes(bc.Chain, bc.Transactions)
+	weights := pos.weights(bc.Chain)
+	slot := pos.slot(time.Now().UnixNano()) + 1
+	next := leader(bc.lastBlock().header(), slot, weights)
+	bc.Unlock()
+	pos.Lock()
+	var evidence []string
+	for key := range pos.evidence {
+		evidence = append(evidence, key)
+	}
+	pos.Unlock()
+	resp := map[string]interface{}{
+		"stakes":   list,
+		"weights":  weights,
+		"staker":   pos.staker,
+		"slot":     slot,
+		"leader":   next,
+		"evidence": evidence,
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// stake stakes coins of a wallet of this node for the key of this node, postdata {"wallet": "hash", "amount": 10}
+func (a *App) stake(w http.ResponseWriter, r *http.Request) {
+	pos, ok := bc.consensus().(*posEngine)
+	if !ok || pos.key == nil {
+		respondWithError(w, http.StatusBadRequest, "invalid consensus engine (not a proof of stake staker)")
+		return
+	}
+	var payload struct {
+		Wallet string  `json:"wallet"`
+		Amount float64 `json:"amount"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		respondWithError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	sender, ok := getWallet(payload.Wallet)
+	if !ok {
+		respondWithError(w, http.StatusUnprocessableEntity, "invalid stake (not a wallet of this node)")
+		return
+	}
+	tr := Transaction{
+		Sender:    sender.hash,
+		Recipient: stakeAddress,
+		Amount:    payload.Amount,
+		Message:   "Stake",
+		Time:      time.Now().UnixNano(),
+		Stake:     &StakeUpdate{Action: "stake", Key: pos.staker},
+	}
+	err := sender.signTransaction(&tr)
+	if err == nil {
+		tr, err = bc.addTransaction(tr)
+	}
+	if err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	nodes.distributeTransaction(tr)
+	resp := map[string]interface{}{"success": true, "transaction": tr}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// unstake returns the stake of the key of this node to it's wallet
+func (a *App) unstake(w http.ResponseWriter, r *http.Request) {
+	pos, ok := bc.consensus().(*posEngine)
+	if !ok || pos.key == nil {
+		respondWithError(w, http.StatusBadRequest, "invalid consensus engine (not a proof of stake staker)")
+		return
+	}
+	bc.Lock()
+	stake, ok := stakes(bc.Chain, bc.Transactions)[pos.staker]
+	bc.Unlock()
+	if !ok || stake.Amount == 0 {
+		respondWithError(w, http.StatusUnprocessableEntity, "invalid stake (no stake of this node)")
+		return
+	}
+	tr := Transaction{
+		Sender:    stakeAddress,
+		Recipient: stake.Wallet,
+		Amount:    stake.Amount,
+		Message:   "Unstake",
+		Time:      time.Now().UnixNano(),
+		Stake:     &StakeUpdate{Action: "unstake", Key: pos.staker},
+	}
+	sig, err := sign(pos.key, tr.sigHash())
+	if err == nil {
+		tr.Witness = hex.EncodeToString(sig)
+		tr, err = bc.addTransaction(tr)
+	}
+	if err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	nodes.distributeTransaction(tr)
+	resp := map[string]interface{}{"success": true, "transaction": tr}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
 func respondWithError(w http.ResponseWriter, code int, message string) {
 	respondWithJSON(w, code, map[string]string{"error": message})
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Nodes exchange a handshake when they greet; the version of the protocol, the chain they are on (the hash of the
+// genesis block), the length of their chain, the features they support and their clock. Nodes on another chain or
+// with an older protocol are refused. Both nodes record the features they have in common, and the offset of the
+// clock of the other node, see networkTime.
+
+// The version of the protocol of this node
+const protocolVersion = 2
+
+// The oldest version of the protocol this node can talk to
+const minProtocolVersion = 2
+
+// The features of the protocol this node supports
+var supportedFeatures = []string{"headers", "locator", "orphans", "inv", "ping", "bans", "identity", "tcp", "addr"}
+
+// Handshake tells other nodes which protocol and chain a node is on
+type Handshake struct {
+	Version  int      `json:"version"`
+	ChainID  string   `json:"chainId"` // the hash of the genesis block
+	Height   int64    `json:"height"`
+	Features []string `json:"features"`
+	Time     int64    `json:"time,omitempty"` // UnixNano, the clock of the node
+}
+
+// PeerInfo is the handshake of a node, with the features both nodes support
+type PeerInfo struct {
+	Version    int      `json:"version"`
+	ChainID    string   `json:"chainId"`
+	Height     int64    `json:"height"`
+	Features   []string `json:"features"`             // negotiated
+	TimeOffset *int64   `json:"timeOffset,omitempty"` // of the clock of the node to ours in nanoseconds, nil if unknown
+}
+
+// peerTable holds the handshakes of the nodes by their address
+type peerTable struct {
+	sync.Mutex
+	peers map[string]PeerInfo
+}
+
+func newPeerTable() *peerTable {
+	return &peerTable{peers: make(map[string]PeerInfo)}
+}
+
+// peerTable returns the handshakes of the nodes in the network
+func (nodes *Nodes) peerTable() *peerTable {
+	if nodes.peers == nil {
+		nodes.peers = newPeerTable()
+	}
+	return nodes.peers
+}
+
+// handshake returns the handshake of this node
+func (bc *Blockchain) handshake() Handshake {
+	bc.Lock()
+	defer bc.Unlock()
+	h := Handshake{Version: protocolVersion, Height: int64(len(bc.Chain)), Features: supportedFeatures, Time: time.Now().UnixNano()}
+	if len(bc.Chain) > 0 {
+		h.ChainID = hash(bc.Chain[0])
+	}
+	return h
+}
+
+// checkHandshake checks if a node with the handshake is compatible with this node
+func (bc *Blockchain) checkHandshake(h Handshake) error {
+	bc.Lock()
+	defer bc.Unlock()
+	if h.Version < minProtocolVersion {
+		return fmt.Errorf("incompatible node (protocol version %d, at least %d required)", h.Version, minProtocolVersion)
+	}
+	if h.ChainID == "" || len(bc.Chain) == 0 {
+		return errors.New("incompatible node (unknown chain)")
+	}
+	if h.ChainID != hash(bc.Chain[0]) {
+		return fmt.Errorf("incompatible node (on chain %s)", h.ChainID)
+	}
+	return nil
+}
+
+// handshakeMessage returns the parts of a handshake that are signed as part of a greeting
+func (h Handshake) handshakeMessage() []string {
+	return []string{fmt.Sprintf("%d", h.Version), h.ChainID, fmt.Sprintf("%d", h.Height), strings.Join(h.Features, ","), fmt.Sprintf("%d", h.Time)}
+}
+
+// negotiateFeatures returns the features of theirs that we support as well
+func negotiateFeatures(ours, theirs []string) []string {
+	supported := make(map[string]bool, len(theirs))
+	for _, feature := range theirs {
+		supported[feature] = true
+	}
+	features := []string{}
+	for _, feature := range ours {
+		if supported[feature] {
+			features = append(features, feature)
+		}
+	}
+	return features
+}
+
+// recordHandshake stores the handshake of a node, with the negotiated features
+func (nodes *Nodes) recordHandshake(node Node, h Handshake) PeerInfo {
+	info := PeerInfo{Version: h.Version, ChainID: h.ChainID, Height: h.Height, Features: negotiateFeatures(supportedFeatures, h.Features)}
+	if h.Time != 0 {
+		offset := h.Time - time.Now().UnixNano()
+		info.TimeOffset = &offset
+	}
+	table := nodes.peerTable()
+	table.Lock()
+	table.peers[node.getAddress()] = info
+	table.Unlock()
+	return info
+}
+
+// peerInfo returns the handshake of a node, false if no handshake is done with the node
+func (nodes *Nodes) peerInfo(node Node) (PeerInfo, bool) {
+	table := nodes.peerTable()
+	table.Lock()
+	defer table.Unlock()
+	info, ok := table.peers[node.getAddress()]
+	return info, ok
+}
+
+// hasFeature tells if a feature is negotiated with the node. Nodes without a handshake are assumed to support it.
+func (nodes *Nodes) hasFeature(node Node, feature string) bool {
+	info, ok := nodes.peerInfo(node)
+	if !ok {
+		return true
+	}
+	for _, f := range info.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptHandshake records the handshake of a node that answered our greeting, or removes the node if it is incompatible.
+func (nodes *Nodes) acceptHandshake(node Node, chain *Blockchain, h Handshake) error {
+	if err := chain.checkHandshake(h); err != nil {
+		nodes.removeNode(node.getAddress())
+		return err
+	}
+	nodes.recordHandshake(node, h)
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNegotiateFeatures(t *testing.T) {
+	features := negotiateFeatures([]string{"headers", "inv", "identity"}, []string{"identity", "future", "headers"})
+	if !reflect.DeepEqual(features, []string{"headers", "identity"}) {
+		t.Errorf("Expected the common features, got %v", features)
+	}
+	if features := negotiateFeatures(supportedFeatures, nil); len(features) != 0 {
+		t.Errorf("Expected no common features, got %v", features)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	saveGlobals(t)
+
+	a := newTestChain("handshake-a")
+	b := a.newPeer("handshake-b")
+	serverB := b.server()
+	defer serverB.Close()
+	b.me = b.nodeAt(serverB)
+
+	h := b.bc.handshake()
+	h.Features = []string{"headers", "future"}
+	greeting, _ := newGreeting(b.me, h, "")
+
+	// the time of the handshake is signed, it can't be changed to skew the network-adjusted time
+	skewed := greeting
+	skewed.Time += int64(time.Hour)
+	if err := skewed.verifySignature(); err == nil {
+		t.Error("Greeting with a changed handshake time should be refused")
+	}
+
+	var resp struct {
+		Handshake Handshake `json:"handshake"`
+		Features  []string  `json:"features"`
+	}
+	if code := a.call(t, "POST", "/node", greeting, &resp); code != http.StatusOK {
+		t.Fatalf("Compatible node refused, got %d", code)
+	}
+	if resp.Handshake.ChainID != hash(a.bc.Chain[0]) || resp.Handshake.Version != protocolVersion {
+		t.Errorf("Expected the handshake of a, got %v", resp.Handshake)
+	}
+	if !reflect.DeepEqual(resp.Features, []string{"headers"}) {
+		t.Errorf("Expected the negotiated features, got %v", resp.Features)
+	}
+	if info, ok := a.nodes.peerInfo(b.me); !ok || !reflect.DeepEqual(info.Features, []string{"headers"}) {
+		t.Errorf("Handshake of b should be recorded, got %v", info)
+	}
+	if a.nodes.hasFeature(b.me, "inv") {
+		t.Error("Feature that is not negotiated should not be used")
+	}
+
+	// the greeter records the answer
+	if err := b.nodes.acceptHandshake(a.me, b.bc, resp.Handshake); err != nil {
+		t.Errorf("Handshake of a refused: %s", err)
+	}
+	if _, ok := b.nodes.peerInfo(a.me); !ok {
+		t.Error("Handshake of a should be recorded")
+	}
+
+	// a greeting again refreshes the node, it may have restarted with another identity
+	b.me.PublicKey = ""
+	b.me.createIdentity()
+	greeting, _ = newGreeting(b.me, b.bc.handshake(), "")
+	if code := a.call(t, "POST", "/node", greeting, nil); code != http.StatusOK {
+		t.Fatalf("Known node refused, got %d", code)
+	}
+	if a.nodes.List[len(a.nodes.List)-1].PublicKey != b.me.PublicKey {
+		t.Error("Identity of the known node should be updated")
+	}
+}
+
+func TestIncompatibleHandshake(t *testing.T) {
+	saveGlobals(t)
+
+	a := newTestChain("incompatible-a")
+	other := newTestChain("incompatible-other") // another genesis block
+	serverOther := other.server()
+	defer serverOther.Close()
+	other.me = other.nodeAt(serverOther)
+
+	greeting, _ := newGreeting(other.me, other.bc.handshake(), "")
+	if code := a.call(t, "POST", "/node", greeting, nil); code != http.StatusPreconditionFailed {
+		t.Errorf("Node on another chain should be refused, got %d", code)
+	}
+
+	old := a.bc.handshake()
+	old.Version = minProtocolVersion - 1
+	greeting, _ = newGreeting(other.me, old, "")
+	if code := a.call(t, "POST", "/node", greeting, nil); code != http.StatusPreconditionFailed {
+		t.Errorf("Node with an old protocol should be refused, got %d", code)
+	}
+	if a.nodes.isKnown(other.me) {
+		t.Error("Incompatible node should not be added")
+	}
+
+	// a greeted node that answers with another chain is removed
+	a.nodes.addNode(&other.me)
+	if err := a.nodes.acceptHandshake(other.me, a.bc, other.bc.handshake()); err == nil || a.nodes.isKnown(other.me) {
+		t.Error("Greeted node on another chain should be removed")
+	}
+}
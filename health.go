@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/grrrben/glog"
+)
+
+// Every node in the list is pinged periodically. The latency, the last time the node was seen and the number
+// of consecutive failures are tracked; a node that fails too often is removed from the list.
+
+// The time between two pings of all nodes
+const pingInterval = 30 * time.Second
+
+// The time a node has to respond to a ping
+const pingTimeout = 5 * time.Second
+
+// The number of consecutive failures after which a node is removed from the list
+const maxPingFailures = 3
+
+// NodeHealth shows how a node responds
+type NodeHealth struct {
+	LastSeen int64 `json:"lastSeen"` // UnixNano, 0 if never seen
+	Latency  int64 `json:"latency"`  // of the last ping in milliseconds
+	Failures int   `json:"failures"` // consecutive failures
+}
+
+// NodeStatus is a node with it's health and handshake
+type NodeStatus struct {
+	Node
+	Health    NodeHealth `json:"health"`
+	Handshake *PeerInfo  `json:"handshake,omitempty"`
+}
+
+// healthTable holds the health of the nodes by their address
+type healthTable struct {
+	sync.Mutex
+	nodes map[string]*NodeHealth
+}
+
+func newHealthTable() *healthTable {
+	return &healthTable{nodes: make(map[string]*NodeHealth)}
+}
+
+// healthTable returns the health of the nodes in the network
+func (nodes *Nodes) healthTable() *healthTable {
+	if nodes.health == nil {
+		nodes.health = newHealthTable()
+	}
+	return nodes.health
+}
+
+// getHealth returns the health of a node
+func (nodes *Nodes) getHealth(node Node) NodeHealth {
+	table := nodes.healthTable()
+	table.Lock()
+	defer table.Unlock()
+	if health, ok := table.nodes[node.getAddress()]; ok {
+		return *health
+	}
+	return NodeHealth{}
+}
+
+// recordSeen records that a node responded, with the latency if it is measured (a ping).
+func (nodes *Nodes) recordSeen(node Node, latency time.Duration) {
+	table := nodes.healthTable()
+	table.Lock()
+	defer table.Unlock()
+	health, ok := table.nodes[node.getAddress()]
+	if !ok {
+		health = &NodeHealth{}
+		table.nodes[node.getAddress()] = health
+	}
+	health.LastSeen = time.Now().UnixNano()
+	health.Failures = 0
+	if latency > 0 {
+		health.Latency = int64(latency / time.Millisecond)
+	}
+}
+
+// recordFailure records that a node did not respond. Returns the number of consecutive failures.
+func (nodes *Nodes) recordFailure(node Node) int {
+	table := nodes.healthTable()
+	table.Lock()
+	defer table.Unlock()
+	health, ok := table.nodes[node.getAddress()]
+	if !ok {
+		health = &NodeHealth{}
+		table.nodes[node.getAddress()] = health
+	}
+	health.Failures++
+	return health.Failures
+}
+
+// statusList returns the list of nodes with their health and handshake
+func (nodes *Nodes) statusList() []NodeStatus {
+	list := []NodeStatus{}
+	for _, node := range nodes.list() {
+		status := NodeStatus{Node: node, Health: nodes.getHealth(node)}
+		if info, ok := nodes.peerInfo(node); ok {
+			status.Handshake = &info
+		}
+		list = append(list, status)
+	}
+	return list
+}
+
+// removeNode removes the node with the address from the list. Returns true if it was in the list.
+func (nodes *Nodes) removeNode(address string) bool {
+	nodes.Lock()
+	list := make([]Node, 0, len(nodes.List))
+	for _, node := range nodes.List {
+		if node.getAddress() != address {
+			list = append(list, node)
+		}
+	}
+	removed := len(list) < len(nodes.List)
+	nodes.List = list
+	nodes.Unlock()
+
+	table := nodes.healthTable()
+	table.Lock()
+	delete(table.nodes, address)
+	table.Unlock()
+	peers := nodes.peerTable()
+	peers.Lock()
+	delete(peers.peers, address)
+	peers.Unlock()
+	conns := nodes.connTable()
+	conns.Lock()
+	p, ok := conns.conns[address]
+	conns.Unlock()
+	if ok {
+		nodes.disconnect(p)
+	}
+	if removed {
+		glog.Infof("Node removed (%s). Nodes: %d", address, nodes.num())
+	}
+	return removed
+}
+
+// ping checks if a node responds and measures the latency
+func ping(node Node) (time.Duration, error) {
+	client := &http.Client{Timeout: pingTimeout, Transport: httpClient.Transport}
+	start := time.Now()
+	resp, err := client.Get(fmt.Sprintf("%s/ping", node.getAddress()))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("ping of %s failed with status %d", node.getAddress(), resp.StatusCode)
+	}
+	return time.Since(start), nil
+}
+
+// pingNode pings a node over it's peer connection, or over HTTP if it is not connected.
+// A connection that does not answer is closed, the connection manager replaces it.
+func (nodes *Nodes) pingNode(node Node) (time.Duration, error) {
+	if p, ok := nodes.connection(node); ok {
+		latency, err := p.ping(pingTimeout)
+		if err != nil {
+			nodes.disconnect(p)
+		}
+		return latency, err
+	}
+	return ping(node)
+}
+
+// pingNodes pings all other nodes at the same time and removes the nodes that failed too often.
+// Returns the number of nodes removed.
+func (nodes *Nodes) pingNodes(self Node) int {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var dead []string
+	for _, node := range nodes.list() {
+		if node == self {
+			continue
+		}
+		wg.Add(1)
+		go func(node Node) {
+			defer wg.Done()
+			latency, err := nodes.pingNode(node)
+			if err == nil {
+				nodes.recordSeen(node, latency)
+				return
+			}
+			glog.Warningf("Ping of %s failed: %s", node.getAddress(), err)
+			if nodes.recordFailure(node) >= maxPingFailures {
+				mu.Lock()
+				dead = append(dead, node.getAddress())
+				mu.Unlock()
+			}
+		}(node)
+	}
+	wg.Wait()
+
+	removed := 0
+	for _, address := range dead {
+		if nodes.removeNode(address) {
+			removed++
+		}
+	}
+	return removed
+}
+
+// watchHealth pings the nodes every interval, it runs forever.
+func (nodes *Nodes) watchHealth(self Node, interval time.Duration) {
+	for range time.Tick(interval) {
+		nodes.pingNodes(self)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPingNodes(t *testing.T) {
+	saveGlobals(t)
+
+	a := newTestChain("health-a")
+	b := a.newPeer("health-b")
+	serverB := b.server()
+	defer serverB.Close()
+	dead := a.newPeer("health-dead").server()
+	dead.Close()
+
+	alive, gone := serverNode(serverB), serverNode(dead)
+	a.nodes.addNode(&alive)
+	a.nodes.addNode(&gone)
+
+	for i := 1; i <= maxPingFailures; i++ {
+		removed := a.nodes.pingNodes(a.me)
+		if i < maxPingFailures && (removed != 0 || a.nodes.getHealth(gone).Failures != i) {
+			t.Errorf("Expected %d failures and no nodes removed after %d pings, got %d removed", i, i, removed)
+		}
+		if i == maxPingFailures && removed != 1 {
+			t.Errorf("Dead node should be removed after %d failures, got %d removed", i, removed)
+		}
+	}
+	if a.nodes.num() != 2 {
+		t.Errorf("Expected 2 nodes left, got %d", a.nodes.num())
+	}
+	if health := a.nodes.getHealth(alive); health.LastSeen == 0 || health.Failures != 0 {
+		t.Errorf("Alive node should be seen without failures, got %v", health)
+	}
+
+	a.nodes.recordFailure(alive)
+	a.nodes.recordSeen(alive, 0)
+	if a.nodes.getHealth(alive).Failures != 0 {
+		t.Error("Failures should be reset once a node is seen")
+	}
+
+	var resp struct {
+		List []NodeStatus `json:"list"`
+	}
+	a.call(t, "GET", "/node", nil, &resp)
+	if len(resp.List) != 2 || resp.List[1].getAddress() != alive.getAddress() || resp.List[1].Health.LastSeen == 0 {
+		t.Errorf("Expected the nodes with their health, got %v", resp.List)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// testChain is a separate blockchain with it's own node, to run multiple chains in a single test.
+// The chain is used by setting it as the global chain, nodes and node (me).
+type testChain struct {
+	app      App
+	bc       *Blockchain
+	nodes    *Nodes
+	me       Node
+	channels *channelList
+}
+
+func newTestChain(name string) *testChain {
+	c := &testChain{nodes: initNodes(), channels: initChannels()}
+	c.me = Node{Protocol: "http://", Hostname: name, Port: 8000, Name: name}
+	c.me.createWallet()
+	c.me.createIdentity()
+	c.nodes.addNode(&c.me)
+	c.use()
+	c.bc = initBlockchain()
+	c.bind()
+	c.app.Router = mux.NewRouter()
+	c.app.initializeRoutes()
+	return c
+}
+
+// newPeer creates another node with it's own wallet on the same chain
+func (c *testChain) newPeer(name string) *testChain {
+	p := &testChain{bc: c.bc, nodes: initNodes(), channels: initChannels()}
+	p.me = Node{Protocol: "http://", Hostname: name, Port: 8000, Name: name}
+	p.me.createWallet()
+	p.me.createIdentity()
+	p.nodes.addNode(&p.me)
+	p.app.Router = mux.NewRouter()
+	p.app.initializeRoutes()
+	return p
+}
+
+// use sets the chain as the global chain
+func (c *testChain) use() {
+	serverLock.Lock()
+	defer serverLock.Unlock()
+	c.setGlobals()
+}
+
+// setGlobals sets the chain, nodes, node and channels as the globals, the server lock should be held
+func (c *testChain) setGlobals() {
+	bc, nodes, me, channels = c.bc, c.nodes, c.me, c.channels
+}
+
+// bind makes the chain use the nodes, node and channels of the test chain, for the code that runs in the
+// background instead of the globals. It's done again when the nodes or the node change.
+func (c *testChain) bind() {
+	c.bc.nodes, c.bc.self, c.bc.channels = c.nodes, &c.me, c.channels
+}
+
+// saveGlobals restores the global chain, nodes, node, channels, network and genesis spec when the test ends
+func saveGlobals(t *testing.T) {
+	prevBc, prevNodes, prevMe, prevChannels := bc, nodes, me, channels
+	prevNetwork, prevGenesis := network, genesis
+	t.Cleanup(func() {
+		serverLock.Lock()
+		defer serverLock.Unlock()
+		bc, nodes, me, channels = prevBc, prevNodes, prevMe, prevChannels
+		network, genesis = prevNetwork, prevGenesis
+	})
+}
+
+// serverLock makes sure only one test server, or the test itself, at a time swaps the global chain
+var serverLock sync.Mutex
+
+// server serves the API of the chain over http, for calls made by other nodes.
+// The requests are handled while the chain is set as the global chain.
+func (c *testChain) server() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverLock.Lock()
+		defer serverLock.Unlock()
+		prevBc, prevNodes, prevMe, prevChannels := bc, nodes, me, channels
+		defer func() { bc, nodes, me, channels = prevBc, prevNodes, prevMe, prevChannels }()
+		c.setGlobals()
+		c.app.Router.ServeHTTP(w, r)
+	}))
+}
+
+// call performs a request on the API of the chain and decodes the response
+func (c *testChain) call(t *testing.T, method, url string, body interface{}, response interface{}) int {
+	payload, _ := json.Marshal(body)
+	return c.serve(t, httptest.NewRequest(method, url, bytes.NewBuffer(payload)), response)
+}
+
+// serve handles a request on the API of the chain and decodes the response, for requests with e.g. headers
+func (c *testChain) serve(t *testing.T, req *http.Request, response interface{}) int {
+	c.use()
+	rec := httptest.NewRecorder()
+	c.app.Router.ServeHTTP(rec, req)
+	if response != nil {
+		if err := json.NewDecoder(rec.Body).Decode(response); err != nil {
+			t.Fatalf("Could not decode response of %s: %s", req.URL, err)
+		}
+	}
+	return rec.Code
+}
+
+// mine mines a block on the chain, paid to the node. A peer on the same chain is the node of it meanwhile.
+func (c *testChain) mine(t *testing.T) {
+	serverLock.Lock()
+	c.setGlobals()
+	prevSelf := c.bc.self
+	c.bc.self = &c.me
+	_, err := c.bc.mine()
+	c.bc.self = prevSelf
+	serverLock.Unlock()
+	if err != nil {
+		t.Fatalf("Could not mine on %s: %s", c.me.Name, err)
+	}
+}
+
+// length returns the length of the chain
+func (c *testChain) length() int {
+	return c.bc.length()
+}
+
+// hasTransaction tells if the transaction is pending or in the chain, under the lock
+func (c *testChain) hasTransaction(tr Transaction) bool {
+	c.bc.Lock()
+	defer c.bc.Unlock()
+	return !c.bc.isNonExistingTransaction(tr)
+}
+
+func (c *testChain) publicKey(t *testing.T, hash string) string {
+	var resp struct {
+		PublicKey string `json:"publicKey"`
+	}
+	c.call(t, "GET", "/wallet/"+hash, nil, &resp)
+	return resp.PublicKey
+}
+
+func (c *testChain) credits(hash string) float64 {
+	serverLock.Lock()
+	defer serverLock.Unlock()
+	c.setGlobals()
+	return getWalletCredits(hash)
+}
+
+// serverNode returns the node of a test server
+func serverNode(server *httptest.Server) Node {
+	u, _ := url.Parse(server.URL)
+	port, _ := strconv.ParseUint(u.Port(), 10, 16)
+	return Node{Protocol: "http://", Hostname: u.Hostname(), Port: uint16(port), Name: server.URL}
+}
+
+// waitFor waits at most a few seconds until the condition is met
+func waitFor(condition func() bool) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return condition()
+}
+
+// forkTestChain creates a peer with a copy of the chain
+func forkTestChain(c *testChain, name string) *testChain {
+	p := c.newPeer(name)
+	p.bc = &Blockchain{Chain: append([]Block{}, c.bc.Chain...)}
+	p.bind()
+	return p
+}
+
+// nodeAt returns the node of the chain at the address of the server
+func (c *testChain) nodeAt(server *httptest.Server) Node {
+	node := serverNode(server)
+	node.Hash, node.PublicKey = c.me.Hash, c.me.PublicKey
+	return node
+}
+
+// announceBlock posts a block to the chain, announced and signed by the sender. The sender is made known first.
+func (c *testChain) announceBlock(t *testing.T, sender Node, bl Block, response interface{}) int {
+	c.nodes.addNode(&sender)
+	signature, err := sender.signAnnouncement("block", hash(bl))
+	if err != nil {
+		t.Fatalf("Could not sign the block: %s", err)
+	}
+	return c.call(t, "POST", "/block/distributed", map[string]interface{}{
+		"block":     bl,
+		"sender":    sender.getAddress(),
+		"signature": signature,
+	}, response)
+}
+
+// listen starts a server for the chain and makes the node known by the address of the server
+func (c *testChain) listen() *httptest.Server {
+	server := c.server()
+	c.me = c.nodeAt(server)
+	c.nodes = initNodes()
+	c.nodes.addNode(&c.me)
+	c.bind()
+	return server
+}
+
+// connect adds the nodes of both chains to each other's list
+func connect(a, b *testChain) {
+	nodeA, nodeB := a.me, b.me
+	a.nodes.addNode(&nodeB)
+	b.nodes.addNode(&nodeA)
+}
+
+// listenPeers accepts peer connections for the chain, the node of the chain is at the address of the listener
+func (c *testChain) listenPeers(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+	c.me.Hostname, c.me.Port, c.me.P2PPort = "127.0.0.1", port, port
+	c.nodes = initNodes()
+	c.nodes.addNode(&c.me)
+	c.bind()
+	go c.nodes.listenPeers(listener, c.bc, c.me)
+	return listener
+}
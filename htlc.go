@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// HTLC is a hash time-locked contract. The coins sent to it's Address can be claimed with the
+// key of the recipient by presenting the preimage of the Hashlock, or refunded with the key of
+// the sender once the Timeout (a block index or timestamp, like a LockTime) has passed.
+// Two HTLC's with the same Hashlock on two chains make an atomic swap possible.
+type HTLC struct {
+	Address      string `json:"address"`
+	Script       string `json:"script"`
+	Hashlock     string `json:"hashlock"`
+	RecipientKey string `json:"recipientKey"`
+	RefundKey    string `json:"refundKey"`
+	Timeout      int64  `json:"timeout"`
+}
+
+// newHTLC creates the locking script of a HTLC
+func newHTLC(hashlock, recipientKey, refundKey []byte, timeout int64) HTLC {
+	script := fmt.Sprintf(
+		"OP_IF OP_SHA256 %x OP_EQUALVERIFY %x OP_ELSE %s OP_CHECKLOCKTIMEVERIFY OP_DROP %x OP_ENDIF OP_CHECKSIG",
+		hashlock, recipientKey, scriptNumberToken(timeout), refundKey,
+	)
+	return HTLC{
+		Address:      scriptHash(script),
+		Script:       script,
+		Hashlock:     hex.EncodeToString(hashlock),
+		RecipientKey: hex.EncodeToString(recipientKey),
+		RefundKey:    hex.EncodeToString(refundKey),
+		Timeout:      timeout,
+	}
+}
+
+// parseHTLC reads a HTLC from it's locking script
+func parseHTLC(script string) (HTLC, error) {
+	tokens := strings.Fields(script)
+	if len(tokens) != 12 || tokens[0] != "OP_IF" || tokens[1] != "OP_SHA256" || tokens[3] != "OP_EQUALVERIFY" ||
+		tokens[5] != "OP_ELSE" || tokens[7] != "OP_CHECKLOCKTIMEVERIFY" || tokens[8] != "OP_DROP" ||
+		tokens[10] != "OP_ENDIF" || tokens[11] != "OP_CHECKSIG" {
+		return HTLC{}, errors.New("invalid htlc (not a htlc script)")
+	}
+
+	hashlock, err1 := hex.DecodeString(tokens[2])
+	recipientKey, err2 := hex.DecodeString(tokens[4])
+	refundKey, err3 := hex.DecodeString(tokens[9])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return HTLC{}, errors.New("invalid htlc (invalid data)")
+	}
+	timeout, ok := pushOpcodeValue(tokens[6])
+	if !ok {
+		b, err := hex.DecodeString(tokens[6])
+		if err != nil {
+			return HTLC{}, errors.New("invalid htlc (invalid timeout)")
+		}
+		if timeout, err = decodeScriptNumber(b); err != nil {
+			return HTLC{}, err
+		}
+	}
+
+	h := newHTLC(hashlock, recipientKey, refundKey, timeout)
+	if h.Script != script {
+		return HTLC{}, errors.New("invalid htlc (not a htlc script)")
+	}
+	return h, nil
+}
+
+// claimTransaction creates a transaction that pays the amount of the HTLC to the recipient.
+// The wallet should hold the key of the recipient of the HTLC.
+func (h HTLC) claimTransaction(w wallet, preimage []byte, recipient string, amount float64) (Transaction, error) {
+	if hex.EncodeToString(publicKeyBytes(w.key)) != h.RecipientKey {
+		return Transaction{}, errors.New("invalid htlc (wallet is not the recipient)")
+	}
+	hashlock := sha256.Sum256(preimage)
+	if hex.EncodeToString(hashlock[:]) != h.Hashlock {
+		return Transaction{}, errors.New("invalid htlc (preimage does not match hashlock)")
+	}
+
+	tr := Transaction{
+		Sender:    h.Address,
+		Recipient: recipient,
+		Amount:    amount,
+		Message:   "HTLC claim",
+		Time:      time.Now().UnixNano(),
+		Script:    h.Script,
+	}
+	sig, err := sign(w.key, tr.sigHash())
+	if err != nil {
+		return tr, err
+	}
+	tr.Witness = fmt.Sprintf("%x %x OP_TRUE", sig, preimage)
+	return tr, nil
+}
+
+// refundTransaction creates a transaction that pays the amount of the HTLC back to the sender.
+// The transaction is locked until the timeout of the HTLC. The wallet should hold the refund key.
+func (h HTLC) refundTransaction(w wallet, recipient string, amount float64) (Transaction, error) {
+	if hex.EncodeToString(publicKeyBytes(w.key)) != h.RefundKey {
+		return Transaction{}, errors.New("invalid htlc (wallet is not the sender)")
+	}
+
+	tr := Transaction{
+		Sender:    h.Address,
+		Recipient: recipient,
+		Amount:    amount,
+		Message:   "HTLC refund",
+		Time:      time.Now().UnixNano(),
+		Script:    h.Script,
+		LockTime:  h.Timeout,
+	}
+	sig, err := sign(w.key, tr.sigHash())
+	if err != nil {
+		return tr, err
+	}
+	tr.Witness = fmt.Sprintf("%x OP_FALSE", sig)
+	return tr, nil
+}
+
+// findPreimage looks for a claim of the HTLC in the chain and the pending transactions.
+// A claim reveals the preimage, which can then be used to claim the other side of a swap.
+func (h HTLC) findPreimage() ([]byte, bool) {
+	hashlock, _ := hex.DecodeString(h.Hashlock)
+	bc.Lock()
+	transactions := append([]Transaction{}, bc.Transactions...)
+	for _, block := range bc.Chain {
+		transactions = append(transactions, block.Transactions...)
+	}
+	bc.Unlock()
+
+	for _, tr := range transactions {
+		if tr.Sender != h.Address {
+			continue
+		}
+		for _, token := range strings.Fields(tr.Witness) {
+			data, err := hex.DecodeString(token)
+			if err != nil {
+				continue
+			}
+			sum := sha256.Sum256(data)
+			if bytes.Equal(sum[:], hashlock) {
+				return data, true
+			}
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+type htlcResponse struct {
+	Htlc  HTLC   `json:"htlc"`
+	Error string `json:"error"`
+}
+
+// TestAtomicSwap swaps coins between two chains. Alice has coins on chain X and wants coins on chain Y,
+// Bob has coins on chain Y and wants coins on chain X.
+func TestAtomicSwap(t *testing.T) {
+	saveGlobals(t)
+
+	x := newTestChain("chain-x")
+	y := newTestChain("chain-y")
+	x.mine(t)
+	y.mine(t)
+
+	alice := x.me.Hash // coins on chain X
+	bob := y.me.Hash   // coins on chain Y
+	aliceY := createWallet().hash
+	bobX := createWallet().hash
+
+	secret := []byte("alice's secret")
+	hashlock := sha256.Sum256(secret)
+
+	// an HTLC should lock a positive amount
+	for _, amount := range []float64{0, -1} {
+		code := x.call(t, "POST", "/htlc", map[string]interface{}{
+			"sender":       alice,
+			"recipientKey": x.publicKey(t, bobX),
+			"hashlock":     hex.EncodeToString(hashlock[:]),
+			"timeout":      10,
+			"amount":       amount,
+		}, nil)
+		if code != http.StatusUnprocessableEntity {
+			t.Errorf("HTLC with amount %.0f should be refused, got %d", amount, code)
+		}
+	}
+
+	// Alice locks her coins on X for Bob, with a long timeout
+	var htlcX htlcResponse
+	code := x.call(t, "POST", "/htlc", map[string]interface{}{
+		"sender":       alice,
+		"recipientKey": x.publicKey(t, bobX),
+		"hashlock":     hex.EncodeToString(hashlock[:]),
+		"timeout":      10,
+		"amount":       1,
+	}, &htlcX)
+	if code != http.StatusOK {
+		t.Fatalf("Could not create HTLC on chain X: %s", htlcX.Error)
+	}
+
+	// Bob sees the HTLC on X and locks his coins on Y for Alice with the same hashlock and a shorter timeout
+	var htlcY htlcResponse
+	code = y.call(t, "POST", "/htlc", map[string]interface{}{
+		"sender":       bob,
+		"recipientKey": y.publicKey(t, aliceY),
+		"hashlock":     htlcX.Htlc.Hashlock,
+		"timeout":      5,
+		"amount":       1,
+	}, &htlcY)
+	if code != http.StatusOK {
+		t.Fatalf("Could not create HTLC on chain Y: %s", htlcY.Error)
+	}
+	x.mine(t)
+	y.mine(t)
+
+	// Alice claims on Y, revealing the secret
+	var claim map[string]interface{}
+	code = y.call(t, "POST", fmt.Sprintf("/htlc/%s/claim", htlcY.Htlc.Address), map[string]interface{}{
+		"script":   htlcY.Htlc.Script,
+		"preimage": hex.EncodeToString(secret),
+		"wallet":   aliceY,
+	}, &claim)
+	if code != http.StatusOK {
+		t.Fatalf("Alice could not claim on chain Y: %v", claim)
+	}
+	y.mine(t)
+
+	// Bob learns the secret from chain Y and claims on X
+	var revealed struct {
+		Preimage string `json:"preimage"`
+	}
+	code = y.call(t, "GET", fmt.Sprintf("/htlc/%s/preimage?script=%s", htlcY.Htlc.Address, url.QueryEscape(htlcY.Htlc.Script)), nil, &revealed)
+	if code != http.StatusOK || revealed.Preimage != hex.EncodeToString(secret) {
+		t.Fatalf("Preimage not revealed on chain Y, got %q", revealed.Preimage)
+	}
+	code = x.call(t, "POST", fmt.Sprintf("/htlc/%s/claim", htlcX.Htlc.Address), map[string]interface{}{
+		"script":   htlcX.Htlc.Script,
+		"preimage": revealed.Preimage,
+		"wallet":   bobX,
+	}, &claim)
+	if code != http.StatusOK {
+		t.Fatalf("Bob could not claim on chain X: %v", claim)
+	}
+	x.mine(t)
+
+	if credits := y.credits(aliceY); credits != 1 {
+		t.Errorf("Alice should have 1 credit on chain Y, got %f", credits)
+	}
+	if credits := x.credits(bobX); credits != 1 {
+		t.Errorf("Bob should have 1 credit on chain X, got %f", credits)
+	}
+	if credits := x.credits(htlcX.Htlc.Address) + y.credits(htlcY.Htlc.Address); credits != 0 {
+		t.Errorf("HTLC's should be empty, got %f credits", credits)
+	}
+	x.use()
+	if !bc.validate() {
+		t.Error("Chain X is invalid after the swap")
+	}
+	y.use()
+	if !bc.validate() {
+		t.Error("Chain Y is invalid after the swap")
+	}
+}
+
+func TestRefundHTLC(t *testing.T) {
+	saveGlobals(t)
+
+	x := newTestChain("chain-refund")
+	x.mine(t)
+	sender := x.me.Hash
+	hashlock := sha256.Sum256([]byte("never revealed"))
+	timeout := x.bc.lastBlock().Index + 3
+
+	var htlc htlcResponse
+	x.call(t, "POST", "/htlc", map[string]interface{}{
+		"sender":       sender,
+		"recipientKey": x.publicKey(t, createWallet().hash),
+		"hashlock":     hex.EncodeToString(hashlock[:]),
+		"timeout":      timeout,
+		"amount":       1,
+	}, &htlc)
+	x.mine(t)
+
+	var refund map[string]interface{}
+	code := x.call(t, "POST", fmt.Sprintf("/htlc/%s/refund", htlc.Htlc.Address), map[string]interface{}{
+		"script": htlc.Htlc.Script,
+		"wallet": sender,
+	}, &refund)
+	if code != http.StatusOK {
+		t.Fatalf("Could not refund HTLC: %v", refund)
+	}
+
+	// the refund stays pending until the timeout
+	for x.bc.lastBlock().Index < timeout-1 {
+		x.mine(t)
+		if credits := walletCredits(htlc.Htlc.Address, x.bc.Chain, nil, -1); credits != 1 {
+			t.Fatalf("HTLC refunded before the timeout in block %d", x.bc.lastBlock().Index)
+		}
+	}
+	x.mine(t)
+	if credits := walletCredits(htlc.Htlc.Address, x.bc.Chain, nil, -1); credits != 0 {
+		t.Errorf("HTLC should be refunded after the timeout, got %f credits", credits)
+	}
+}
+
+func TestParseHTLC(t *testing.T) {
+	a, b := createWallet(), createWallet()
+	hashlock := sha256.Sum256([]byte("secret"))
+	for _, timeout := range []int64{5, 1000, 1600000000000000000} {
+		h := newHTLC(hashlock[:], publicKeyBytes(a.key), publicKeyBytes(b.key), timeout)
+		parsed, err := parseHTLC(h.Script)
+		if err != nil {
+			t.Fatalf("Could not parse HTLC script: %s", err)
+		}
+		if parsed != h {
+			t.Errorf("Parsed HTLC differs, expected %v, got %v", h, parsed)
+		}
+	}
+
+	if _, err := parseHTLC(a.script); err == nil {
+		t.Error("A pay-to-pubkey-hash script was parsed as HTLC")
+	}
+}
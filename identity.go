@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grrrben/glog"
+)
+
+// Every node holds an identity key, the public key is part of the Node. A greeting is signed with it, and
+// the receiver challenges the address in the greeting to sign a random value, so a node can't pretend to be
+// at another node's address. Over a peer connection there is no HTTP challenge, the greeting signs a fresh
+// challenge of the other node instead, so it can't be replayed. Announcements of blocks, transactions and inventory are signed as well; only
+// announcements of known nodes that are signed with their identity key are accepted.
+
+// The time a greeting is valid
+const maxGreetingAge = 5 * time.Minute
+
+// identities holds the identity keys of the nodes that run in this process, by their public key
+var identities = struct {
+	sync.Mutex
+	keys map[string]*ecdsa.PrivateKey
+}{keys: make(map[string]*ecdsa.PrivateKey)}
+
+// Greeting is a node that introduces itself to another node with it's handshake, signed with it's identity key
+type Greeting struct {
+	Node
+	Handshake
+	Timestamp int64  `json:"timestamp"`
+	Challenge string `json:"challenge,omitempty"` // of the other node over a peer connection
+	Signature string `json:"signature"`
+}
+
+// The PEM file with the identity key of this node, set by a flag. Without it the node has a new identity on every start.
+var identityFile string
+
+// createIdentity creates the identity key of the node. Is is done only once.
+func (node *Node) createIdentity() {
+	if node.PublicKey != "" {
+		return
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		glog.Panicf("Could not generate an identity key: %s", err)
+	}
+	node.setIdentity(key)
+}
+
+// loadIdentity sets the identity key of the node from a PEM file, so other nodes know it after a restart.
+// A new key is stored in the file if it does not exist yet.
+func (node *Node) loadIdentity(file string) error {
+	key, err := loadSignerKey(file)
+	if os.IsNotExist(err) {
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err == nil {
+			err = saveKey(file, key)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("invalid identity key (%s)", err)
+	}
+	node.setIdentity(key)
+	return nil
+}
+
+// setIdentity makes the key the identity key of the node
+func (node *Node) setIdentity(key *ecdsa.PrivateKey) {
+	node.PublicKey = hex.EncodeToString(publicKeyBytes(key))
+	identities.Lock()
+	identities.keys[node.PublicKey] = key
+	identities.Unlock()
+}
+
+// saveKey stores the key in a PEM file that only the owner can read, in the format of loadSignerKey
+func saveKey(file string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+}
+
+// identityMessage is the message that is signed by an identity key; the parts joined by newlines
+func identityMessage(parts ...string) []byte {
+	return []byte(strings.Join(parts, "\n"))
+}
+
+// signIdentity signs the message with the identity key of the node
+func (node Node) signIdentity(parts ...string) (string, error) {
+	identities.Lock()
+	key, ok := identities.keys[node.PublicKey]
+	identities.Unlock()
+	if !ok {
+		return "", errors.New("invalid identity (no identity key)")
+	}
+	sig, err := sign(key, identityMessage(parts...))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sig), nil
+}
+
+// verifyIdentity checks that the message is signed with the identity key of the node
+func (node Node) verifyIdentity(signature string, parts ...string) error {
+	pub, err1 := hex.DecodeString(node.PublicKey)
+	sig, err2 := hex.DecodeString(signature)
+	if node.PublicKey == "" || err1 != nil || err2 != nil || !verifySignature(pub, identityMessage(parts...), sig) {
+		return fmt.Errorf("invalid identity (signature of %s invalid)", node.getAddress())
+	}
+	return nil
+}
+
+// greetingMessage returns the parts of a greeting that are signed
+func (g Greeting) greetingMessage() []string {
+	parts := []string{"greeting", g.getAddress(), g.Name, g.Hash, g.PublicKey, fmt.Sprintf("%d", g.P2PPort), fmt.Sprintf("%d", g.Timestamp), g.Challenge}
+	return append(parts, g.handshakeMessage()...)
+}
+
+// newGreeting creates a greeting of the node with the handshake and the challenge of the other node if there
+// is one, signed with it's identity key
+func newGreeting(node Node, h Handshake, challenge string) (Greeting, error) {
+	g := Greeting{Node: node, Handshake: h, Timestamp: time.Now().UnixNano(), Challenge: challenge}
+	sig, err := node.signIdentity(g.greetingMessage()...)
+	g.Signature = sig
+	return g, err
+}
+
+// verify checks the signature and age of the greeting and challenges the node at the address of the greeting.
+func (g Greeting) verify() error {
+	if err := g.verifySignature(); err != nil {
+		return err
+	}
+	return challengeNode(g.Node)
+}
+
+// verifySignature checks the signature and age of the greeting
+func (g Greeting) verifySignature() error {
+	age := time.Duration(time.Now().UnixNano() - g.Timestamp)
+	if age > maxGreetingAge || age < -maxGreetingAge {
+		return errors.New("invalid greeting (expired)")
+	}
+	return g.verifyIdentity(g.Signature, g.greetingMessage()...)
+}
+
+// newChallenge returns a random value to be signed by another node
+func newChallenge() (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(random), nil
+}
+
+// challengeNode asks the node at it's address to sign a random challenge with the identity key of the node.
+func challengeNode(node Node) error {
+	challenge, err := newChallenge()
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(map[string]interface{}{"challenge": challenge})
+	if err != nil {
+		return err
+	}
+
+	var resp struct {
+		PublicKey string `json:"publicKey"`
+		Signature string `json:"signature"`
+	}
+	r, err := httpClient.Post(fmt.Sprintf("%s/identity", node.getAddress()), "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return fmt.Errorf("invalid identity (%s)", err)
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+		return fmt.Errorf("invalid identity (%s)", err)
+	}
+	if resp.PublicKey != node.PublicKey {
+		return fmt.Errorf("invalid identity (%s has another identity)", node.getAddress())
+	}
+	return node.verifyIdentity(resp.Signature, "identity", challenge, node.getAddress())
+}
+
+// answerChallenge signs a challenge with the identity key of the node, to prove the node is at it's address
+func (node Node) answerChallenge(challenge string) (string, error) {
+	return node.signIdentity("identity", challenge, node.getAddress())
+}
+
+// signAnnouncement signs an announcement of a block, transaction or inventory by the node
+func (node Node) signAnnouncement(kind string, hashes ...string) (string, error) {
+	return node.signIdentity(append([]string{kind, node.getAddress()}, hashes...)...)
+}
+
+// verifyAnnouncement checks that an announcement is signed by the sender, which should be a known node.
+func (nodes *Nodes) verifyAnnouncement(sender, signature, kind string, hashes ...string) error {
+	for _, node := range nodes.list() {
+		if node.getAddress() == sender && node.PublicKey != "" {
+			return node.verifyIdentity(signature, append([]string{kind, sender}, hashes...)...)
+		}
+	}
+	return fmt.Errorf("invalid identity (unknown sender %s)", sender)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSignedGreeting(t *testing.T) {
+	saveGlobals(t)
+
+	a := newTestChain("identity-a")
+	b := a.newPeer("identity-b")
+	serverB := b.server()
+	defer serverB.Close()
+	b.me = b.nodeAt(serverB)
+
+	greeting, err := newGreeting(b.me, b.bc.handshake(), "")
+	if err != nil {
+		t.Fatalf("Could not create greeting: %s", err)
+	}
+	if code := a.call(t, "POST", "/node", greeting, nil); code != http.StatusOK {
+		t.Fatalf("Signed greeting refused, got %d", code)
+	}
+	if !a.nodes.isKnown(b.me) {
+		t.Error("Greeting node should be added")
+	}
+
+	// someone else pretends to be at the address of b
+	impostor := a.newPeer("identity-impostor").me
+	impostor.Hostname, impostor.Port = b.me.Hostname, b.me.Port
+	a.nodes.removeNode(b.me.getAddress())
+	forged, _ := newGreeting(impostor, b.bc.handshake(), "")
+	if code := a.call(t, "POST", "/node", forged, nil); code != http.StatusUnauthorized {
+		t.Errorf("Greeting of an impostor should be refused, got %d", code)
+	}
+
+	tampered := greeting
+	tampered.Name = "someone else"
+	if code := a.call(t, "POST", "/node", tampered, nil); code != http.StatusUnauthorized {
+		t.Errorf("Tampered greeting should be refused, got %d", code)
+	}
+
+	expired := Greeting{Node: b.me, Handshake: b.bc.handshake(), Timestamp: time.Now().Add(-2 * maxGreetingAge).UnixNano()}
+	expired.Signature, _ = b.me.signIdentity(expired.greetingMessage()...)
+	if code := a.call(t, "POST", "/node", expired, nil); code != http.StatusUnauthorized {
+		t.Errorf("Expired greeting should be refused, got %d", code)
+	}
+}
+
+func TestSignedAnnouncement(t *testing.T) {
+	saveGlobals(t)
+
+	a := newTestChain("announce-a")
+	b := forkTestChain(a, "announce-b")
+	b.mine(t)
+	bl := b.bc.lastBlock()
+
+	// an unknown sender is refused
+	signature, _ := b.me.signAnnouncement("block", hash(bl))
+	code := a.call(t, "POST", "/block/distributed", map[string]interface{}{
+		"block": bl, "sender": b.me.getAddress(), "signature": signature,
+	}, nil)
+	if code != http.StatusUnauthorized {
+		t.Errorf("Block of an unknown sender should be refused, got %d", code)
+	}
+
+	// a known sender, but signed by someone else
+	sender := b.me
+	a.nodes.addNode(&sender)
+	other := a.newPeer("announce-other").me
+	other.Hostname, other.Port = sender.Hostname, sender.Port
+	forged, _ := other.signAnnouncement("block", hash(bl))
+	code = a.call(t, "POST", "/block/distributed", map[string]interface{}{
+		"block": bl, "sender": sender.getAddress(), "signature": forged,
+	}, nil)
+	if code != http.StatusUnauthorized {
+		t.Errorf("Block with a forged signature should be refused, got %d", code)
+	}
+
+	if code := a.announceBlock(t, sender, bl, nil); code != http.StatusOK {
+		t.Errorf("Signed block of a known sender should be accepted, got %d", code)
+	}
+}
+
+func TestLoadIdentity(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "identity.key")
+	var first, restarted Node
+	if err := first.loadIdentity(file); err != nil {
+		t.Fatalf("Could not create an identity key: %s", err)
+	}
+	if err := restarted.loadIdentity(file); err != nil {
+		t.Fatalf("Could not load the identity key: %s", err)
+	}
+	if first.PublicKey == "" || restarted.PublicKey != first.PublicKey {
+		t.Errorf("Node should keep it's identity after a restart, got %s and %s", first.PublicKey, restarted.PublicKey)
+	}
+	if _, err := restarted.signIdentity("identity", "challenge"); err != nil {
+		t.Errorf("Loaded identity key can not sign: %s", err)
+	}
+
+	ioutil.WriteFile(file, []byte("no key"), 0600)
+	if err := (&Node{}).loadIdentity(file); err == nil {
+		t.Error("File without a key should not be accepted")
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"log"
 
@@ -16,14 +18,41 @@ var bc *Blockchain
 var nodes *Nodes
 
 var nodePort uint16
+var p2pPort uint16
 var nodeName *string
 
 const zerohash = "0000000000000000000000000000000000000000000000000000000000000000"
 
 func main() {
-	prt := flag.String("p", "8000", "Port on which the app will run, defaults to 8000")
+	if len(os.Args) > 1 && os.Args[1] == "genesis" {
+		if err := generateGenesis(os.Args[2:]); err != nil {
+			log.Fatalf("Could not generate a genesis spec. Msg %s", err)
+		}
+		return
+	}
+
+	networkName := flag.String("network", "mainnet", "Network of the node, mainnet, testnet or regtest")
+	prt := flag.String("p", "", "Port on which the app will run, defaults to the port of the network (8000 on mainnet)")
 	nodeName = flag.String("name", "Node_X", "Set a name for the node")
+	p2p := flag.Int("p2p", -1, "Port on which peer connections are accepted, defaults to the port + 1000, 0 to use HTTP only")
+	cert := flag.String("cert", "", "Certificate file, the node serves over TLS (https) if it is set")
+	key := flag.String("key", "", "Key file of the certificate")
+	ca := flag.String("ca", "", "CA certificate file to verify the certificates of other nodes with, defaults to the system's CAs")
+	mtls := flag.Bool("mtls", false, "Mutual TLS; only nodes and clients with a certificate signed by the CA are accepted")
+	bans := flag.String("bans", "", "File in which the banned peers are stored, defaults to bans_{port}.json next to the app")
+	admin := flag.String("admin-token", "", "Token that authorizes the admin endpoints (bans) from other hosts than localhost")
+	consensus := flag.String("consensus", "pow", "Consensus engine of the network, pow (proof of work), poa (proof of authority) or pos (proof of stake)")
+	signers := flag.String("signers", "", "Comma separated public keys of the signers (poa) or stakers (pos) at the genesis block")
+	identity := flag.String("identity", "", "PEM file with the P-256 identity key of the node, created if it does not exist, so the node keeps it's identity after a restart")
+	signerKey := flag.String("signer-key", "", "PEM file with the P-256 key this node seals blocks with (poa, pos), the node only verifies blocks without it")
+	period := flag.Duration("period", 5*time.Second, "Time between two blocks (poa), or of a slot (pos)")
+	genesisFile := flag.String("genesis", "", "Genesis spec of the network, replaces the genesis and consensus settings of the network")
+	checkpoints := flag.String("checkpoints", "", "Comma separated checkpoints (height:hash) every accepted chain should match")
+	maxReorg := flag.Int("max-reorg", defaultMaxReorgDepth, "Maximum number of blocks a fork may replace, 0 for no limit")
+	maxDrift := flag.Duration("max-drift", defaultMaxFutureDrift, "Time a block may be ahead of the network-adjusted time")
 	flag.Parse()
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
 
 	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
 	if err != nil {
@@ -33,6 +62,16 @@ func main() {
 	glog.SetLogFile(fmt.Sprintf("%s/log/blockchain.log", dir))
 	glog.SetLogLevel(glog.Log_level_info)
 
+	params, ok := networks[*networkName]
+	if !ok {
+		log.Fatalf("Unknown network %s", *networkName)
+	}
+	network = params
+	minersIncentive = network.Subsidy
+	if *prt == "" {
+		*prt = fmt.Sprintf("%d", network.Port)
+	}
+
 	u, err := strconv.ParseUint(*prt, 10, 16) // always gives an uint64...
 	if err != nil {
 		glog.Errorf("Unable to cast Prt to uint: %s", err)
@@ -40,6 +79,55 @@ func main() {
 	// different Nodes can have different ports,
 	// used to connect multiple Nodes in debug.
 	nodePort = uint16(u)
+	if *p2p < 0 {
+		*p2p = int(nodePort) + 1000
+	}
+	p2pPort = uint16(*p2p)
+
+	banFile = *bans
+	identityFile = *identity
+	adminToken = *admin
+	if banFile == "" {
+		banFile = fmt.Sprintf("%s/bans_%d.json", dir, nodePort)
+	}
+
+	// the consensus flags replace the consensus settings of the network, a genesis spec replaces both
+	genesis = &network.Genesis
+	if explicit["consensus"] || explicit["signers"] || explicit["period"] {
+		spec := network.Genesis
+		spec.Consensus = ConsensusSpec{Engine: *consensus, Period: period.String()}
+		if *signers != "" {
+			spec.Consensus.Signers = strings.Split(*signers, ",")
+		}
+		genesis = &spec
+	}
+	if *genesisFile != "" {
+		if genesis, err = loadGenesisSpec(*genesisFile); err != nil {
+			log.Fatalf("Could not load the genesis spec. Msg %s", err)
+		}
+	}
+	settings, err := genesis.consensusSettings()
+	if err != nil {
+		log.Fatalf("Could not set up the consensus engine. Msg %s", err)
+	}
+	settings.KeyFile = *signerKey
+	engine, err = newConsensusEngine(settings)
+	if err != nil {
+		log.Fatalf("Could not set up the consensus engine. Msg %s", err)
+	}
+
+	cps, err := parseCheckpoints(*checkpoints)
+	if err != nil {
+		log.Fatalf("Could not set the checkpoints. Msg %s", err)
+	}
+	cps[1] = hash(genesis.block())
+	finality = newFinality(cps, *maxReorg)
+	maxFutureDrift = *maxDrift
+
+	err = setupTLS(TLSSettings{CertFile: *cert, KeyFile: *key, CAFile: *ca, Mutual: *mtls})
+	if err != nil {
+		log.Fatalf("Could not set up TLS. Msg %s", err)
+	}
 
 	a := App{}
 	a.Initialize()
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// A node runs on one of the networks: mainnet for production, testnet to test with others and regtest for local
+// regression tests. Each network has it's own parameters; default ports, genesis block, subsidy, address prefix,
+// seeds and deployments of rule changes, so nodes of different networks can run side by side and never accept
+// each other's blocks (their genesis blocks differ). Blocks are easy to mine on regtest, and can be generated at
+// will with POST /generate.
+
+// NetworkParams are the parameters of a network, selected with the -network flag
+type NetworkParams struct {
+	Name          string
+	Port          uint16      // default port of the API, the p2p port is the port + 1000
+	Genesis       GenesisSpec // unless another spec is set with -genesis
+	Subsidy       float64     // paid to the miner of a block
+	AddressPrefix string      // of the addresses of wallets, to tell the networks apart
+	Seeds         []string    // nodes (host:port) that are asked for the other nodes
+	Generate      bool        // blocks can be generated at will
+	VersionBits   VersionBits // the deployments of rule changes
+}
+
+// The networks by name
+var networks = map[string]NetworkParams{
+	"mainnet": {
+		Name: "mainnet",
+		Port: 8000,
+		Genesis: GenesisSpec{
+			ChainID:   "gocoin-mainnet",
+			Timestamp: 1508000000000000000,
+			Consensus: ConsensusSpec{Engine: "pow", Difficulty: hashDifficulty},
+		},
+		Subsidy:       1,
+		AddressPrefix: "gc",
+		Seeds:         []string{"localhost:8000"},
+		VersionBits: VersionBits{Window: 1000, Threshold: 950, Deployments: []Deployment{
+			{Name: deploymentSubsidy, Bit: 1, StartTime: 1798761600000000000, Timeout: 1830297600000000000}, // 2027 - 2028
+		}},
+	},
+	"testnet": {
+		Name: "testnet",
+		Port: 18000,
+		Genesis: GenesisSpec{
+			ChainID:   "gocoin-testnet",
+			Timestamp: 1508000000000000000,
+			Consensus: ConsensusSpec{Engine: "pow", Difficulty: 3},
+		},
+		Subsidy:       10,
+		AddressPrefix: "tgc",
+		Seeds:         []string{"localhost:18000"},
+		VersionBits: VersionBits{Window: 100, Threshold: 75, Deployments: []Deployment{
+			{Name: deploymentSubsidy, Bit: 1, StartTime: 1793491200000000000, Timeout: 1825027200000000000}, // Nov 2026 - Nov 2027
+		}},
+	},
+	"regtest": {
+		Name: "regtest",
+		Port: 28000,
+		Genesis: GenesisSpec{
+			ChainID:   "gocoin-regtest",
+			Timestamp: 1508000000000000000,
+			Consensus: ConsensusSpec{Engine: "pow", Difficulty: 1},
+		},
+		Subsidy:       50,
+		AddressPrefix: "rgc",
+		Generate:      true,
+		VersionBits: VersionBits{Window: 20, Threshold: 15, Deployments: []Deployment{
+			{Name: deploymentSubsidy, Bit: 1, StartTime: 0, Timeout: math.MaxInt64},
+		}},
+	},
+}
+
+// The network of this node, set by the -network flag
+var network = networks["mainnet"]
+
+// The maximum number of blocks generated per request (regtest)
+const maxGenerateBlocks = 1000
+
+// networkAddress returns the address of a wallet on the network, the hash with the prefix of the network
+func networkAddress(hash string) string {
+	return network.AddressPrefix + hash
+}
+
+// parseAddress returns the hash of an address, which is either a hash or an address of this network
+func parseAddress(address string) (string, error) {
+	for _, params := range networks {
+		if params.AddressPrefix == "" || !strings.HasPrefix(address, params.AddressPrefix) {
+			continue
+		}
+		hash := strings.TrimPrefix(address, params.AddressPrefix)
+		if len(hash) != len(zerohash) {
+			continue // e.g. tgc is not an address of gc
+		}
+		if params.Name != network.Name {
+			return "", fmt.Errorf("invalid address (%s is an address of %s)", address, params.Name)
+		}
+		return hash, nil
+	}
+	return address, nil
+}
+
+// seedIsNode tells if the address (host:port) of a seed is the node
+func seedIsNode(seed string, node Node) bool {
+	return seed == fmt.Sprintf("localhost:%d", node.Port) || seed == fmt.Sprintf("%s:%d", node.Hostname, node.Port)
+}
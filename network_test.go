@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNetworks(t *testing.T) {
+	ports, prefixes, chains := make(map[uint16]bool), make(map[string]bool), make(map[string]bool)
+	for name, params := range networks {
+		if err := params.Genesis.validate(); err != nil {
+			t.Errorf("Genesis spec of %s is invalid: %s", name, err)
+		}
+		if params.Name != name {
+			t.Errorf("Network %s is named %s", name, params.Name)
+		}
+		ports[params.Port], prefixes[params.AddressPrefix], chains[hash(params.Genesis.block())] = true, true, true
+	}
+	if len(ports) != len(networks) || len(prefixes) != len(networks) || len(chains) != len(networks) {
+		t.Error("Networks should have their own ports, address prefixes and genesis blocks")
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	saveGlobals(t)
+
+	network = networks["testnet"]
+	wallet := strings.Repeat("ab", 32)
+	if address := networkAddress(wallet); address != "tgc"+wallet {
+		t.Errorf("Expected the address with the prefix of testnet, got %s", address)
+	}
+	for _, address := range []string{wallet, "tgc" + wallet} {
+		if hash, err := parseAddress(address); err != nil || hash != wallet {
+			t.Errorf("Expected wallet %s of address %s, got %s (%v)", wallet, address, hash, err)
+		}
+	}
+	if _, err := parseAddress("gc" + wallet); err == nil {
+		t.Error("Address of another network should be refused")
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	saveGlobals(t)
+
+	c := newTestChain("generate")
+	payload := map[string]interface{}{"blocks": 5}
+	if code := c.call(t, "POST", "/generate", payload, nil); code != http.StatusForbidden {
+		t.Errorf("Blocks should not be generated on mainnet, got %d", code)
+	}
+
+	network = networks["regtest"]
+	settings, _ := network.Genesis.consensusSettings()
+	c.bc.engine, _ = newConsensusEngine(settings)
+	var resp struct {
+		Hashes []string `json:"hashes"`
+		Length int      `json:"length"`
+	}
+	if code := c.call(t, "POST", "/generate", payload, &resp); code != http.StatusOK || len(resp.Hashes) != 5 || resp.Length != 6 {
+		t.Fatalf("Expected 5 generated blocks, got %d: %v", code, resp)
+	}
+	if resp.Hashes[4] != hash(c.bc.lastBlock()) || !c.bc.validate() {
+		t.Error("Generated blocks should make a valid chain")
+	}
+	if code := c.call(t, "POST", "/generate", map[string]interface{}{"blocks": maxGenerateBlocks + 1}, nil); code != http.StatusBadRequest {
+		t.Errorf("Too many blocks should be refused, got %d", code)
+	}
+}
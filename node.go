@@ -13,17 +13,25 @@ import (
 var me Node
 
 type Node struct {
-	Hostname string `json:"hostname"`
-	Protocol string `json:"protocol"`
-	Port     uint16 `json:"port"`
-	Name     string `json:"name"`
-	Hash     string `json:"hash"`
+	Hostname  string `json:"hostname"`
+	Protocol  string `json:"protocol"`
+	Port      uint16 `json:"port"`
+	Name      string `json:"name"`
+	Hash      string `json:"hash"`
+	PublicKey string `json:"publicKey"`         // of the identity key of the node
+	P2PPort   uint16 `json:"p2pPort,omitempty"` // on which the node accepts peer connections, 0 if it doesn't
 }
 
 // greet makes a call to a node to make this node known within the network.
-func greet(node Node) {
+// The greeting is signed with the identity key of this node and carries our handshake; the node answers with it's handshake.
+// Once greeted, a peer connection is made with the node if it accepts them.
+func (nodes *Nodes) greet(node Node, chain *Blockchain, self Node) error {
 	url := fmt.Sprintf("%s/node", node.getAddress())
-	payload, err := json.Marshal(me)
+	greeting, err := newGreeting(self, chain.handshake(), "")
+	if err != nil {
+		return fmt.Errorf("could not sign the greeting (%s)", err)
+	}
+	payload, err := json.Marshal(greeting)
 	if err != nil {
 		glog.Panicf("Could not marshall node: Me; %s", err.Error())
 	}
@@ -34,15 +42,32 @@ func greet(node Node) {
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
-		glog.Warningf("POST request error: %s", err)
-		// I don't want to panic here, but it might be a good idea to
-		// remove the node from the list (todo)
-	} else {
-		resp.Body.Close()
+		// the node is removed from the list if it keeps failing, see pingNodes
+		nodes.recordFailure(node)
+		return err
+	}
+	defer resp.Body.Close()
+	nodes.recordSeen(node, 0)
+
+	// the node answers with it's own handshake
+	var answer struct {
+		Handshake Handshake `json:"handshake"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&answer); err != nil || resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("greeting refused by %s (status %d)", node.getAddress(), resp.StatusCode)
+	}
+	if err = nodes.acceptHandshake(node, chain, answer.Handshake); err != nil {
+		return err
+	}
+	// messages are sent over a peer connection if the node accepts them
+	if node.P2PPort != 0 && nodes.hasFeature(node, "tcp") {
+		if err = nodes.dialPeer(node, chain, self); err != nil {
+			return fmt.Errorf("no peer connection with %s (%s)", node.getAddress(), err)
+		}
 	}
+	return nil
 }
 
 // createWallet Creates a wallet and sets the hash of the new wallet on the Node.
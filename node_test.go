@@ -42,5 +42,8 @@ func TestGreet(t *testing.T) {
 		Name:     "this is me",
 	}
 	me.createWallet()
-	greet(node)
+	me.createIdentity()
+	if err := initNodes().greet(node, &Blockchain{}, me); err == nil {
+		t.Error("Greeting a node that is not running should fail")
+	}
 }
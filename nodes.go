@@ -2,17 +2,29 @@ package main
 
 import (
 	"encoding/json"
-	"net/http"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/grrrben/glog"
 )
 
+// Nodes is the list of known nodes with their state. The list is locked as nodes are added and removed
+// by handlers and in the background.
 type Nodes struct {
-	List []Node
+	sync.Mutex
+	List     []Node
+	seen     *seenSet
+	requests *requestSet
+	health   *healthTable
+	bans     *banList
+	peers    *peerTable
+	conns    *connTable
+	addrs    *addressBook
 }
 
 func initNodes() *Nodes {
-	nodes := &Nodes{}
+	nodes := &Nodes{seen: newSeenSet(), requests: newRequestSet(), health: newHealthTable(), bans: newBanList(""), peers: newPeerTable(), conns: newConnTable(), addrs: newAddressBook()}
 	return nodes
 }
 
@@ -21,47 +33,91 @@ func initNodes() *Nodes {
 // return bool true on success.
 func (nodes *Nodes) addNode(newNode *Node) bool {
 	newNode.createWallet()
+	nodes.Lock()
+	defer nodes.Unlock()
 	for _, n := range nodes.List {
 		if n.getAddress() == newNode.getAddress() {
-			glog.Warningf("Node already known: %s", n.getAddress())
+			glog.Warningf("Node already known: %s", newNode.getAddress())
 			return false
 		}
 	}
 	nodes.List = append(nodes.List, *newNode)
-	glog.Infof("Node added (%s). Nodes: %d", newNode.getAddress(), nodes.num())
+	glog.Infof("Node added (%s). Nodes: %d", newNode.getAddress(), len(nodes.List))
 	return true
 }
 
-// syncNodes contacts other Nodes to fetch a full list of Nodes
-// todo; how do I know which nodes are currently in the network
-func (nodes *Nodes) syncNodes() bool {
-	// if I am the only node, ignore this
-	if me.Port == 8000 {
-		return true
+// updateNode replaces the node with the same address in the list. Returns false if the node is not in the list.
+func (nodes *Nodes) updateNode(node Node) bool {
+	nodes.Lock()
+	defer nodes.Unlock()
+	for i, n := range nodes.List {
+		if n.getAddress() == node.getAddress() {
+			node.createWallet()
+			nodes.List[i] = node
+			return true
+		}
 	}
-	// for now, just use the main parent node as an oracle.
-	url := "http://localhost:8000/node"
-
-	var externalNodes Nodes
+	return false
+}
 
-	resp, err := http.Get(url)
-	if err != nil {
-		glog.Warningf("Could not get list of Nodes on url: %s", url)
-		return false
+// isKnown tells if a node with the same address is in the list
+func (nodes *Nodes) isKnown(node Node) bool {
+	for _, n := range nodes.list() {
+		if n.getAddress() == node.getAddress() {
+			return true
+		}
 	}
-	defer resp.Body.Close()
+	return false
+}
 
-	decodingErr := json.NewDecoder(resp.Body).Decode(&externalNodes)
-	if decodingErr != nil {
-		glog.Warningf("Could not decode JSON of list of Nodes\n")
+// syncNodes contacts other Nodes to fetch a full list of Nodes
+// The oracle is the first seed of the network that answers, other nodes are found in the addresses the connected
+// nodes share.
+func (nodes *Nodes) syncNodes() bool {
+	var externalNodes Nodes
+	asked := false
+	for _, seed := range network.Seeds {
+		if seedIsNode(seed, me) {
+			continue
+		}
+		asked = true
+		url := fmt.Sprintf("%s%s/node", me.Protocol, seed)
+		resp, err := httpClient.Get(url)
+		if err != nil {
+			glog.Warningf("Could not get list of Nodes on url: %s", url)
+			continue
+		}
+		decodingErr := json.NewDecoder(resp.Body).Decode(&externalNodes)
+		resp.Body.Close()
+		if decodingErr != nil {
+			glog.Warningf("Could not decode JSON of list of Nodes\n")
+			continue
+		}
+		break
+	}
+	if !asked {
+		// if I am the only node, ignore this
+		return true
+	}
+	if len(externalNodes.List) == 0 {
 		return false
 	}
 
-	glog.Infof("external nodes:\n%v", externalNodes)
+	glog.Infof("external nodes:\n%v", externalNodes.List)
 
 	// just try to add all nodes
 	i := 0
 	for _, n := range externalNodes.List {
+		if n.getAddress() != me.getAddress() {
+			nodes.addressBook().add(n, "oracle", time.Now().UnixNano())
+		}
+		if nodes.isKnown(n) {
+			continue
+		}
+		if err := challengeNode(n); err != nil {
+			glog.Warningf("Node %s not added: %s", n.getAddress(), err)
+			continue
+		}
 		success := nodes.addNode(&n)
 		if success == true {
 			i++
@@ -73,40 +129,43 @@ func (nodes *Nodes) syncNodes() bool {
 
 // greetNodes contacts other Nodes to add this node to their list of known Nodes
 func (nodes *Nodes) greetNodes() bool {
-	for _, node := range nodes.List {
+	for _, node := range nodes.list() {
 		if node == me {
 			// no need to register myself
 			continue
 		}
-		go greet(node)
+		go func(node Node) {
+			if err := nodes.greet(node, bc, me); err != nil {
+				glog.Warningf("Greeting of %s failed: %s", node.getAddress(), err)
+			}
+		}(node)
 	}
 	return true
 }
 
 // announceMinedBlocks tells all nodes in the network about the newly mined block.
-// it gives the new block to the nodes who can add it to their chain.
-func (nodes *Nodes) announceMinedBlocks(bl Block) {
-	for _, node := range nodes.List {
-		if node == me {
-			continue // no need to brag
-		}
-		go announceMinedBlock(node, bl)
-	}
+// The hash of the block is announced, the nodes request the block itself if they don't have it.
+func (nodes *Nodes) announceMinedBlocks(self Node, bl Block) {
+	nodes.relay(self, []Inventory{{Type: "block", Hash: hash(bl)}}, "")
 }
 
 // distributeTransaction tells all nodes in the network about the new Transaction.
+// The hash of the transaction is announced, the nodes request the transaction itself if they don't have it.
 func (nodes *Nodes) distributeTransaction(tr Transaction) {
-	glog.Infof("Announcing transaction to %d nodes", len(nodes.List))
-	for _, node := range nodes.List {
-		if node == me {
-			continue // no need to brag
-		}
-		glog.Info("Announcing transaction")
-		go announceTransaction(node, tr)
-	}
+	glog.Infof("Announcing transaction to %d nodes", nodes.num())
+	nodes.relay(me, []Inventory{{Type: "transaction", Hash: tr.getHash()}}, "")
 }
 
 // num returns an int which represents the number of connected nodes.
 func (nodes *Nodes) num() int {
+	nodes.Lock()
+	defer nodes.Unlock()
 	return len(nodes.List)
 }
+
+// list returns a copy of the list of nodes
+func (nodes *Nodes) list() []Node {
+	nodes.Lock()
+	defer nodes.Unlock()
+	return append([]Node{}, nodes.List...)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"reflect"
+	"sync"
 	"testing"
 )
 
@@ -57,3 +58,25 @@ func TestNum(t *testing.T) {
 		t.Errorf("Expected 2 nodes, got %d.", nodes.num())
 	}
 }
+
+// TestNodesConcurrently adds and removes nodes while the list is read, as handlers and the health watcher do
+func TestNodesConcurrently(t *testing.T) {
+	list := initNodes()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			node := Node{Protocol: "http://", Hostname: "127.0.0.1", Port: uint16(9000 + i), Name: fmt.Sprintf("node%d", i)}
+			list.addNode(&node)
+			list.statusList()
+			if i%2 == 0 {
+				list.removeNode(node.getAddress())
+			}
+		}(i)
+	}
+	wg.Wait()
+	if list.num() != 5 {
+		t.Errorf("Expected 5 nodes, got %d", list.num())
+	}
+}
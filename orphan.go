@@ -0,0 +1,154 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/grrrben/glog"
+)
+
+// Blocks that are announced before their parent are kept in an orphan pool. The missing parents are
+// requested from the sender in the background, the orphans are connected once their ancestors arrive.
+
+// The maximum number of blocks in the orphan pool
+const maxOrphans = 100
+
+// The time an orphan is kept in the pool
+const maxOrphanAge = 10 * time.Minute
+
+// orphanBlock is a block of which the parent is unknown
+type orphanBlock struct {
+	block    Block
+	sender   string
+	received time.Time
+}
+
+// orphanPool holds the orphan blocks by their hash and the senders that are asked for the missing parents.
+type orphanPool struct {
+	sync.Mutex
+	blocks     map[string]orphanBlock
+	requesting map[string]bool
+}
+
+func newOrphanPool() *orphanPool {
+	return &orphanPool{blocks: make(map[string]orphanBlock), requesting: make(map[string]bool)}
+}
+
+// orphanPool returns the orphan pool of the chain
+func (bc *Blockchain) orphanPool() *orphanPool {
+	if bc.orphans == nil {
+		bc.orphans = newOrphanPool()
+	}
+	return bc.orphans
+}
+
+// add adds a block to the pool. Expired orphans are removed, and the oldest orphan if the pool is full.
+func (pool *orphanPool) add(bl Block, sender string) {
+	pool.Lock()
+	defer pool.Unlock()
+	pool.prune()
+
+	if len(pool.blocks) >= maxOrphans {
+		var oldest string
+		for h, orphan := range pool.blocks {
+			if oldest == "" || orphan.received.Before(pool.blocks[oldest].received) {
+				oldest = h
+			}
+		}
+		delete(pool.blocks, oldest)
+	}
+	pool.blocks[hash(bl)] = orphanBlock{block: bl, sender: sender, received: time.Now()}
+}
+
+// prune removes the expired orphans. The pool should be locked.
+func (pool *orphanPool) prune() {
+	for h, orphan := range pool.blocks {
+		if time.Since(orphan.received) > maxOrphanAge {
+			delete(pool.blocks, h)
+		}
+	}
+}
+
+// has returns true if the block with the hash is in the pool
+func (pool *orphanPool) has(h string) bool {
+	pool.Lock()
+	defer pool.Unlock()
+	_, ok := pool.blocks[h]
+	return ok
+}
+
+// takeChild removes and returns an orphan that follows the block with the hash
+func (pool *orphanPool) takeChild(parent string) (Block, bool) {
+	pool.Lock()
+	defer pool.Unlock()
+	pool.prune()
+	for h, orphan := range pool.blocks {
+		if orphan.block.PreviousHash == parent {
+			delete(pool.blocks, h)
+			return orphan.block, true
+		}
+	}
+	return Block{}, false
+}
+
+// startRequest marks the sender as being asked for missing parents.
+// Returns false if a request to the sender is already running.
+func (pool *orphanPool) startRequest(sender string) bool {
+	pool.Lock()
+	defer pool.Unlock()
+	if pool.requesting[sender] {
+		return false
+	}
+	pool.requesting[sender] = true
+	return true
+}
+
+func (pool *orphanPool) endRequest(sender string) {
+	pool.Lock()
+	delete(pool.requesting, sender)
+	pool.Unlock()
+}
+
+// size returns the number of orphans in the pool
+func (pool *orphanPool) size() int {
+	pool.Lock()
+	defer pool.Unlock()
+	pool.prune()
+	return len(pool.blocks)
+}
+
+// addOrphan puts a block of which the parent is unknown in the orphan pool and requests
+// the missing parents from the sender in the background.
+func (bc *Blockchain) addOrphan(bl Block, sender string) {
+	pool := bc.orphanPool()
+	pool.add(bl, sender)
+	glog.Infof("Block %d added to the orphan pool (%d orphans)", bl.Index, pool.size())
+
+	if !pool.startRequest(sender) {
+		return // the parents are already requested
+	}
+	go func() {
+		defer pool.endRequest(sender)
+		bc.analyseInvalidBlock(bl, sender)
+	}()
+}
+
+// connectOrphans adds the orphans that follow the last block to the chain. The chain should be locked.
+// Returns the number of blocks added.
+func (bc *Blockchain) connectOrphans() int {
+	pool := bc.orphanPool()
+	added := 0
+	for {
+		next, ok := pool.takeChild(hash(bc.lastBlock()))
+		if !ok {
+			return added
+		}
+		if _, err := bc.addBlock(next); err != nil {
+			glog.Warningf("Could not connect orphan block %d: %s", next.Index, err)
+			continue
+		}
+		bc.clearTransactions(next.Transactions)
+		added++
+		glog.Infof("Connected orphan block %d", next.Index)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestOrphanPool(t *testing.T) {
+	pool := newOrphanPool()
+	for i := int64(1); i <= maxOrphans+1; i++ {
+		pool.add(Block{Index: i, PreviousHash: "parent"}, "sender")
+	}
+	if pool.size() != maxOrphans {
+		t.Errorf("Orphan pool should be bounded to %d blocks, got %d", maxOrphans, pool.size())
+	}
+
+	child := Block{Index: 2, PreviousHash: "known"}
+	pool.add(child, "sender")
+	if bl, ok := pool.takeChild("known"); !ok || hash(bl) != hash(child) {
+		t.Error("Child of a known block not found in the orphan pool")
+	}
+	if pool.has(hash(child)) {
+		t.Error("Connected orphan should be removed from the pool")
+	}
+
+	for h, orphan := range pool.blocks {
+		orphan.received = time.Now().Add(-maxOrphanAge - time.Second)
+		pool.blocks[h] = orphan
+	}
+	if pool.size() != 0 {
+		t.Errorf("Expired orphans should be removed, got %d", pool.size())
+	}
+}
+
+func TestConnectOrphans(t *testing.T) {
+	saveGlobals(t)
+
+	a := newTestChain("orphan-a")
+	b := forkTestChain(a, "orphan-b")
+	for i := 0; i < 3; i++ {
+		b.mine(t)
+	}
+
+	// the blocks arrive in reverse order, from a sender that can't be reached
+	sender := b.me
+	sender.Hostname, sender.Port = "127.0.0.1", 1
+	for i := len(b.bc.Chain) - 1; i > 0; i-- {
+		code := a.announceBlock(t, sender, b.bc.Chain[i], nil)
+		expected := http.StatusAccepted
+		if i == 1 {
+			expected = http.StatusOK
+		}
+		if code != expected {
+			t.Errorf("Expected status %d for block %d, got %d", expected, i+1, code)
+		}
+	}
+	if len(a.bc.Chain) != len(b.bc.Chain) || hash(a.bc.lastBlock()) != hash(b.bc.lastBlock()) {
+		t.Errorf("Orphans were not connected, got length %d, expected %d", len(a.bc.Chain), len(b.bc.Chain))
+	}
+	if a.bc.orphanPool().size() != 0 {
+		t.Errorf("Orphan pool should be empty, got %d", a.bc.orphanPool().size())
+	}
+}
+
+func TestOrphanParentsRequested(t *testing.T) {
+	saveGlobals(t)
+
+	a := newTestChain("orphan-fetch-a")
+	b := forkTestChain(a, "orphan-fetch-b")
+	for i := 0; i < 5; i++ {
+		b.mine(t)
+	}
+	serverB := b.server()
+	defer serverB.Close()
+
+	code := a.announceBlock(t, b.nodeAt(serverB), b.bc.lastBlock(), nil)
+	if code != http.StatusAccepted {
+		t.Fatalf("Expected the block to be added to the orphan pool, got %d", code)
+	}
+
+	if !waitFor(func() bool { return a.length() == b.length() }) {
+		t.Errorf("Missing parents were not fetched, got length %d, expected %d", len(a.bc.Chain), len(b.bc.Chain))
+	}
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/grrrben/glog"
+)
+
+// Nodes keep a persistent TCP connection with each other, next to the HTTP API. Messages are framed by
+// their length (4 bytes, big endian) followed by the message in JSON. A connection starts with a handshake:
+// both nodes send a random challenge, the dialing node sends a greeting that signs the challenge of the other
+// node, which answers with it's own greeting that signs the challenge of the dialing node. Both nodes only
+// accept greetings of known nodes with the same identity key, the node is challenged when it greeted over HTTP.
+// Until the handshake is done, messages can't be larger than a greeting.
+// Once connected, inventory, data, pings and addresses are sent over the connection instead of HTTP.
+// A node that connects with a longer chain is synced with.
+
+// The maximum size of a message
+const maxMessageSize = 32 << 20
+
+// The maximum size of a message during the handshake, a greeting fits
+const maxHandshakeSize = 16 << 10
+
+// The time a node has to connect and answer the handshake
+const handshakeTimeout = 10 * time.Second
+
+// Message types
+const (
+	msgChallenge = "challenge" // payload: a random value, the greeting of the other node should sign it
+	msgHandshake = "handshake" // payload: Greeting
+	msgReject    = "reject"    // payload: the reason, the connection is closed
+	msgPing      = "ping"      // no payload, answered with a pong with the same id
+	msgPong      = "pong"      // payload: {"length": int}
+	msgInv       = "inv"       // payload: []Inventory
+	msgGetData   = "getdata"   // payload: []Inventory, answered with block and tx messages
+	msgBlock     = "block"     // payload: Block
+	msgTx        = "tx"        // payload: Transaction
+	msgGetAddr   = "getaddr"   // no payload, answered with an addr message
+	msgAddr      = "addr"      // payload: []PeerAddress
+)
+
+// Message is a message between nodes over a peer connection
+type Message struct {
+	Type    string          `json:"type"`
+	ID      uint64          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// writeMessage writes a message, prefixed with it's length
+func writeMessage(w io.Writer, msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(data) > maxMessageSize {
+		return fmt.Errorf("invalid message (%d bytes, at most %d)", len(data), maxMessageSize)
+	}
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	_, err = w.Write(frame)
+	return err
+}
+
+// readMessage reads a message that is prefixed with it's length
+func readMessage(r io.Reader) (Message, error) {
+	return readMessageLimit(r, maxMessageSize)
+}
+
+// readMessageLimit reads a message that is prefixed with it's length, which should be at most the limit
+func readMessageLimit(r io.Reader, limit uint32) (Message, error) {
+	var msg Message
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return msg, err
+	}
+	length := binary.BigEndian.Uint32(size[:])
+	if length > limit {
+		return msg, fmt.Errorf("invalid message (%d bytes, at most %d)", length, limit)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return msg, err
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return msg, fmt.Errorf("invalid message (%s)", err)
+	}
+	return msg, nil
+}
+
+// newMessage creates a message with the payload in JSON
+func newMessage(kind string, id uint64, payload interface{}) (Message, error) {
+	msg := Message{Type: kind, ID: id}
+	if payload == nil {
+		return msg, nil
+	}
+	data, err := json.Marshal(payload)
+	msg.Payload = data
+	return msg, err
+}
+
+// peerConn is a connection with a node
+type peerConn struct {
+	node    Node
+	conn    net.Conn
+	inbound bool       // the other node dialed
+	send    sync.Mutex // one writer at a time
+	lock    sync.Mutex // guards the fields below
+	nextID  uint64
+	pending map[uint64]chan Message
+}
+
+func newPeerConn(node Node, conn net.Conn) *peerConn {
+	return &peerConn{node: node, conn: conn, pending: make(map[uint64]chan Message)}
+}
+
+// sendMessage sends a message with the payload to the node
+func (p *peerConn) sendMessage(kind string, id uint64, payload interface{}) error {
+	msg, err := newMessage(kind, id, payload)
+	if err != nil {
+		return err
+	}
+	p.send.Lock()
+	defer p.send.Unlock()
+	p.conn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	return writeMessage(p.conn, msg)
+}
+
+// request sends a message and waits for the answer with the same id
+func (p *peerConn) request(kind string, payload interface{}, timeout time.Duration) (Message, error) {
+	answer := make(chan Message, 1)
+	p.lock.Lock()
+	p.nextID++
+	id := p.nextID
+	p.pending[id] = answer
+	p.lock.Unlock()
+	defer func() {
+		p.lock.Lock()
+		delete(p.pending, id)
+		p.lock.Unlock()
+	}()
+
+	if err := p.sendMessage(kind, id, payload); err != nil {
+		return Message{}, err
+	}
+	select {
+	case msg := <-answer:
+		return msg, nil
+	case <-time.After(timeout):
+		return Message{}, fmt.Errorf("no answer to %s from %s", kind, p.node.getAddress())
+	}
+}
+
+// answer delivers a message to the request that waits for it. Returns false if no request waits for it.
+func (p *peerConn) answer(msg Message) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	answer, ok := p.pending[msg.ID]
+	if ok {
+		answer <- msg
+		delete(p.pending, msg.ID)
+	}
+	return ok
+}
+
+// ping checks if the node responds over the connection and measures the latency
+func (p *peerConn) ping(timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	if _, err := p.request(msgPing, nil, timeout); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// connTable holds the connections with the nodes by their address
+type connTable struct {
+	sync.Mutex
+	conns map[string]*peerConn
+}
+
+func newConnTable() *connTable {
+	return &connTable{conns: make(map[string]*peerConn)}
+}
+
+// connTable returns the connections with the nodes in the network
+func (nodes *Nodes) connTable() *connTable {
+	if nodes.conns == nil {
+		nodes.conns = newConnTable()
+	}
+	return nodes.conns
+}
+
+// connection returns the connection with a node, false if the node is not connected
+func (nodes *Nodes) connection(node Node) (*peerConn, bool) {
+	table := nodes.connTable()
+	table.Lock()
+	defer table.Unlock()
+	p, ok := table.conns[node.getAddress()]
+	return p, ok
+}
+
+// register stores the connection with a node, an existing connection with the node is closed.
+func (nodes *Nodes) register(p *peerConn) {
+	table := nodes.connTable()
+	table.Lock()
+	old, ok := table.conns[p.node.getAddress()]
+	table.conns[p.node.getAddress()] = p
+	table.Unlock()
+	if ok {
+		old.conn.Close()
+	}
+}
+
+// disconnect closes the connection and removes it from the table
+func (nodes *Nodes) disconnect(p *peerConn) {
+	p.conn.Close()
+	table := nodes.connTable()
+	table.Lock()
+	if table.conns[p.node.getAddress()] == p {
+		delete(table.conns, p.node.getAddress())
+	}
+	table.Unlock()
+}
+
+// getPeerAddress returns the host:port on which the node accepts peer connections
+func (node Node) getPeerAddress() string {
+	return fmt.Sprintf("%s:%d", node.Hostname, node.P2PPort)
+}
+
+// checkPeerGreeting checks the greeting of a peer connection. The node should be known with the same identity key,
+// and the greeting should sign our challenge.
+func (nodes *Nodes) checkPeerGreeting(chain *Blockchain, g Greeting, challenge string) error {
+	if g.Challenge != challenge {
+		return errors.New("invalid handshake (challenge not signed)")
+	}
+	if err := g.verifySignature(); err != nil {
+		return err
+	}
+	if err := chain.checkHandshake(g.Handshake); err != nil {
+		return err
+	}
+	for _, node := range nodes.list() {
+		if node.getAddress() == g.getAddress() {
+			if node.PublicKey != g.PublicKey {
+				return fmt.Errorf("invalid identity (%s has another identity)", g.getAddress())
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid identity (unknown node %s)", g.getAddress())
+}
+
+// sendChallenge sends a random challenge over a connection. Returns the challenge.
+func sendChallenge(conn net.Conn) (string, error) {
+	challenge, err := newChallenge()
+	if err != nil {
+		return "", err
+	}
+	msg, err := newMessage(msgChallenge, 0, challenge)
+	if err != nil {
+		return "", err
+	}
+	conn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	return challenge, writeMessage(conn, msg)
+}
+
+// readHandshake reads a message of the handshake of a connection, of the kind, into the payload
+func readHandshake(conn net.Conn, kind string, payload interface{}) error {
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	msg, err := readMessageLimit(conn, maxHandshakeSize)
+	if err != nil {
+		return err
+	}
+	if msg.Type == msgReject {
+		var reason string
+		json.Unmarshal(msg.Payload, &reason)
+		return fmt.Errorf("connection refused (%s)", reason)
+	}
+	if msg.Type != kind {
+		return fmt.Errorf("invalid handshake (%s message)", msg.Type)
+	}
+	if err = json.Unmarshal(msg.Payload, payload); err != nil {
+		return fmt.Errorf("invalid handshake (%s)", err)
+	}
+	return nil
+}
+
+// readChallenge reads the challenge of a connection
+func readChallenge(conn net.Conn) (string, error) {
+	var challenge string
+	err := readHandshake(conn, msgChallenge, &challenge)
+	return challenge, err
+}
+
+// readGreeting reads the greeting of a connection
+func readGreeting(conn net.Conn) (Greeting, error) {
+	var g Greeting
+	err := readHandshake(conn, msgHandshake, &g)
+	return g, err
+}
+
+// listenPeers accepts peer connections of other nodes, until the listener is closed
+func (nodes *Nodes) listenPeers(listener net.Listener, chain *Blockchain, self Node) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			glog.Warningf("Stopped accepting peer connections: %s", err)
+			return
+		}
+		go nodes.acceptPeer(conn, chain, self)
+	}
+}
+
+// acceptPeer does the handshake of a connection of another node and serves it
+func (nodes *Nodes) acceptPeer(conn net.Conn, chain *Blockchain, self Node) {
+	remote := conn.RemoteAddr().String()
+	if nodes.banList().isBanned(remote) {
+		conn.Close()
+		return
+	}
+	var g Greeting
+	challenge, err := sendChallenge(conn)
+	var theirs string
+	if err == nil {
+		theirs, err = readChallenge(conn)
+	}
+	if err == nil {
+		g, err = readGreeting(conn)
+	}
+	if err == nil {
+		err = nodes.checkPeerGreeting(chain, g, challenge)
+	}
+	if err != nil {
+		glog.Warningf("Peer connection of %s refused: %s", remote, err)
+		nodes.banList().misbehave(remote, scoreInvalidPayload, err.Error())
+		if msg, e := newMessage(msgReject, 0, err.Error()); e == nil {
+			writeMessage(conn, msg)
+		}
+		conn.Close()
+		return
+	}
+
+	if inbound, _ := nodes.countConnections(); inbound >= maxInbound {
+		glog.Warningf("Peer connection of %s refused: too many peer connections", g.getAddress())
+		if msg, e := newMessage(msgReject, 0, "too many peer connections"); e == nil {
+			writeMessage(conn, msg)
+		}
+		conn.Close()
+		return
+	}
+
+	p := newPeerConn(g.Node, conn)
+	p.inbound = true
+	greeting, err := newGreeting(self, chain.handshake(), theirs)
+	if err == nil {
+		err = p.sendMessage(msgHandshake, 0, greeting)
+	}
+	if err != nil {
+		glog.Warningf("Could not answer the handshake of %s: %s", g.getAddress(), err)
+		conn.Close()
+		return
+	}
+	nodes.recordHandshake(g.Node, g.Handshake)
+	nodes.register(p)
+	nodes.recordSeen(g.Node, 0)
+	nodes.addressBook().markConnected(g.Node, "inbound")
+	catchUp(chain, g.Node, g.Height)
+	glog.Infof("Peer connection with %s accepted", g.getAddress())
+	nodes.servePeer(p, chain, self)
+}
+
+// dialPeer connects to a node and does the handshake. The connection is served in the background.
+func (nodes *Nodes) dialPeer(node Node, chain *Blockchain, self Node) error {
+	if node.P2PPort == 0 {
+		return fmt.Errorf("no peer connection (%s has no peer port)", node.getAddress())
+	}
+	conn, err := dialNode(node)
+	if err != nil {
+		return err
+	}
+	p := newPeerConn(node, conn)
+	challenge, err := sendChallenge(conn)
+	var theirs string
+	if err == nil {
+		theirs, err = readChallenge(conn)
+	}
+	var greeting Greeting
+	if err == nil {
+		greeting, err = newGreeting(self, chain.handshake(), theirs)
+	}
+	if err == nil {
+		err = p.sendMessage(msgHandshake, 0, greeting)
+	}
+	var g Greeting
+	if err == nil {
+		g, err = readGreeting(conn)
+	}
+	if err == nil && g.getAddress() != node.getAddress() {
+		err = errors.New("invalid handshake (another node answered)")
+	}
+	if err == nil {
+		err = nodes.checkPeerGreeting(chain, g, challenge)
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	nodes.recordHandshake(node, g.Handshake)
+	nodes.register(p)
+	nodes.recordSeen(node, 0)
+	nodes.addressBook().markConnected(node, "peer")
+	catchUp(chain, node, g.Height)
+	glog.Infof("Peer connection with %s established", node.getAddress())
+	go nodes.servePeer(p, chain, self)
+	if nodes.hasFeature(node, "addr") {
+		p.sendMessage(msgGetAddr, 0, nil)
+	}
+	return nil
+}
+
+// catchUp syncs with a node that connected with a longer chain, in the background
+func catchUp(chain *Blockchain, node Node, height int64) {
+	if height > int64(chain.length()) {
+		go chain.syncWith(node, nil)
+	}
+}
+
+// servePeer handles the messages of a connection until it is closed
+func (nodes *Nodes) servePeer(p *peerConn, chain *Blockchain, self Node) {
+	defer nodes.disconnect(p)
+	sender := p.node.getAddress()
+	for {
+		msg, err := readMessage(p.conn)
+		if err != nil {
+			if err != io.EOF {
+				glog.Warningf("Peer connection with %s closed: %s", sender, err)
+			}
+			return
+		}
+		if nodes.banList().isBanned(sender) {
+			return
+		}
+		if err = nodes.handleMessage(p, chain, self, msg); err != nil {
+			glog.Warningf("Invalid %s message from %s: %s", msg.Type, sender, err)
+			if nodes.banList().misbehave(sender, scoreInvalidPayload, err.Error()) {
+				return
+			}
+		}
+	}
+}
+
+// handleMessage handles a single message of a connection
+func (nodes *Nodes) handleMessage(p *peerConn, chain *Blockchain, self Node, msg Message) error {
+	sender := p.node.getAddress()
+	switch msg.Type {
+	case msgPing:
+		return p.sendMessage(msgPong, msg.ID, map[string]interface{}{"length": chain.length()})
+	case msgPong:
+		p.answer(msg)
+	case msgInv:
+		var inv []Inventory
+		if err := json.Unmarshal(msg.Payload, &inv); err != nil {
+			return err
+		}
+		if wanted := chain.wantedInventory(nodes, sender, inv); len(wanted) > 0 {
+			return p.sendMessage(msgGetData, 0, wanted)
+		}
+	case msgGetData:
+		var inv []Inventory
+		if err := json.Unmarshal(msg.Payload, &inv); err != nil {
+			return err
+		}
+		blocks, transactions := chain.getData(inv)
+		for _, bl := range blocks {
+			if err := p.sendMessage(msgBlock, 0, bl); err != nil {
+				return err
+			}
+		}
+		for _, tr := range transactions {
+			if err := p.sendMessage(msgTx, 0, tr); err != nil {
+				return err
+			}
+		}
+	case msgBlock:
+		var bl Block
+		if err := json.Unmarshal(msg.Payload, &bl); err != nil {
+			return err
+		}
+		chain.receiveData(nodes, self, sender, []Block{bl}, nil)
+	case msgTx:
+		var tr Transaction
+		if err := json.Unmarshal(msg.Payload, &tr); err != nil {
+			return err
+		}
+		chain.receiveData(nodes, self, sender, nil, []Transaction{tr})
+	case msgGetAddr:
+		return p.sendMessage(msgAddr, 0, nodes.addressMessage(self))
+	case msgAddr:
+		var addresses []PeerAddress
+		if err := json.Unmarshal(msg.Payload, &addresses); err != nil {
+			return err
+		}
+		if len(addresses) > maxAddrPerMessage {
+			return fmt.Errorf("too many addresses (%d, at most %d)", len(addresses), maxAddrPerMessage)
+		}
+		for _, address := range addresses {
+			if address.getAddress() != self.getAddress() {
+				nodes.addressBook().add(address.Node, sender, address.LastSeen)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown message type %s", msg.Type)
+	}
+	return nil
+}
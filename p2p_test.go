@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMessageFraming(t *testing.T) {
+	var buf bytes.Buffer
+	msg, _ := newMessage(msgInv, 7, []Inventory{{Type: "block", Hash: "abc"}})
+	if err := writeMessage(&buf, msg); err != nil {
+		t.Fatalf("Could not write message: %s", err)
+	}
+	if size := binary.BigEndian.Uint32(buf.Bytes()); int(size) != buf.Len()-4 {
+		t.Errorf("Expected a length prefix of %d, got %d", buf.Len()-4, size)
+	}
+	read, err := readMessage(&buf)
+	if err != nil || read.Type != msgInv || read.ID != 7 || string(read.Payload) != string(msg.Payload) {
+		t.Errorf("Expected the message written, got %v (%v)", read, err)
+	}
+
+	var huge bytes.Buffer
+	binary.Write(&huge, binary.BigEndian, uint32(maxMessageSize+1))
+	if _, err := readMessage(&huge); err == nil {
+		t.Error("Message larger than the maximum should be refused")
+	}
+}
+
+func TestPeerConnection(t *testing.T) {
+	saveGlobals(t)
+
+	a := newTestChain("p2p-a")
+	b := forkTestChain(a, "p2p-b")
+	defer a.listenPeers(t).Close()
+	defer b.listenPeers(t).Close()
+	connect(a, b)
+
+	if err := b.nodes.dialPeer(a.me, b.bc, b.me); err != nil {
+		t.Fatalf("Could not connect to a: %s", err)
+	}
+	if !waitFor(func() bool { _, ok := a.nodes.connection(b.me); return ok }) {
+		t.Fatal("Connection of b should be accepted by a")
+	}
+	if info, ok := a.nodes.peerInfo(b.me); !ok || info.ChainID != hash(a.bc.Chain[0]) {
+		t.Errorf("Handshake of b should be recorded, got %v", info)
+	}
+	if removed := b.nodes.pingNodes(b.me); removed != 0 || b.nodes.getHealth(a.me).LastSeen == 0 {
+		t.Error("a should answer pings over the connection")
+	}
+
+	// blocks and transactions are gossiped over the connection
+	a.mine(t)
+	if !waitFor(func() bool { return b.length() == a.length() }) {
+		t.Fatalf("Block was not sent to b, got length %d, expected %d", len(b.bc.Chain), len(a.bc.Chain))
+	}
+	code := a.call(t, "POST", "/transaction", map[string]interface{}{
+		"sender":    a.me.Hash,
+		"recipient": b.me.Hash,
+		"amount":    1,
+	}, nil)
+	if code != http.StatusOK {
+		t.Fatalf("Could not add transaction, got %d", code)
+	}
+	tr := a.bc.Transactions[0]
+	if !waitFor(func() bool { return b.hasTransaction(tr) }) {
+		t.Error("Transaction was not sent to b")
+	}
+
+	// a removed node is disconnected on both sides
+	b.nodes.removeNode(a.me.getAddress())
+	if !waitFor(func() bool { _, ok := a.nodes.connection(b.me); return !ok }) {
+		t.Error("Connection should be closed once the node is removed")
+	}
+}
+
+func TestPeerConnectionRefused(t *testing.T) {
+	saveGlobals(t)
+
+	a := newTestChain("p2p-refuse-a")
+	stranger := a.newPeer("p2p-stranger")
+	defer a.listenPeers(t).Close()
+	defer stranger.listenPeers(t).Close()
+	stranger.nodes.addNode(&a.me)
+
+	// a does not know the stranger, it should greet over HTTP first
+	err := stranger.nodes.dialPeer(a.me, stranger.bc, stranger.me)
+	if err == nil || !strings.Contains(err.Error(), "unknown node") {
+		t.Errorf("Connection of an unknown node should be refused, got %v", err)
+	}
+	if _, ok := a.nodes.connection(stranger.me); ok {
+		t.Error("Unknown node should not be connected")
+	}
+
+	// a node with another identity key at a known address is refused
+	impostor := stranger.me
+	impostor.PublicKey = ""
+	impostor.createIdentity()
+	a.nodes.addNode(&impostor)
+	err = stranger.nodes.dialPeer(a.me, stranger.bc, stranger.me)
+	if err == nil || !strings.Contains(err.Error(), "another identity") {
+		t.Errorf("Connection with another identity should be refused, got %v", err)
+	}
+
+	if err = stranger.nodes.dialPeer(Node{Hostname: "127.0.0.1", Port: 1}, stranger.bc, stranger.me); err == nil {
+		t.Error("Node without a peer port can't be connected")
+	}
+}
+
+func TestPeerHandshakeChallenge(t *testing.T) {
+	saveGlobals(t)
+
+	a := newTestChain("p2p-challenge-a")
+	b := forkTestChain(a, "p2p-challenge-b")
+	defer a.listenPeers(t).Close()
+	defer b.listenPeers(t).Close()
+	connect(a, b)
+
+	// a greeting that signs another challenge, such as a greeting of an earlier connection, is refused
+	greeting, _ := newGreeting(b.me, b.bc.handshake(), "earlier")
+	if err := a.nodes.checkPeerGreeting(a.bc, greeting, "fresh"); err == nil || !strings.Contains(err.Error(), "challenge") {
+		t.Errorf("Greeting of another challenge should be refused, got %v", err)
+	}
+	if err := a.nodes.checkPeerGreeting(a.bc, greeting, "earlier"); err != nil {
+		t.Errorf("Greeting of the challenge should be accepted, got %s", err)
+	}
+
+	// before the handshake a message can't be larger than a greeting
+	conn, err := net.Dial("tcp", a.me.getPeerAddress())
+	if err != nil {
+		t.Fatalf("Could not connect: %s", err)
+	}
+	defer conn.Close()
+	if _, err := readChallenge(conn); err != nil {
+		t.Fatalf("Expected a challenge, got %s", err)
+	}
+	binary.Write(conn, binary.BigEndian, uint32(maxHandshakeSize+1))
+	if _, err := readGreeting(conn); err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Errorf("Large message before the handshake should be refused, got %v", err)
+	}
+}
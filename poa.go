@@ -0,0 +1,459 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grrrben/glog"
+)
+
+// Proof of authority is meant for private networks without mining. A fixed set of signers take turns to seal
+// a block every period, with their signature. The signers are sorted by their public key, signer n%signers is
+// in turn for block n. Other signers may seal the block out of turn a while later, if the in-turn signer doesn't.
+// An in-turn block weighs 2, an out of turn block 1, the heaviest chain is followed. A signer may only seal
+// one of every signers/2+1 blocks, so a minority of the signers can't take over the chain.
+// A signer can vote in the blocks it seals to add or remove a signer, a vote of a majority of the signers
+// is applied.
+
+// The difficulty of a block sealed by the in-turn signer
+const difficultyInTurn = 2
+
+// The difficulty of a block sealed by another signer
+const difficultyOutOfTurn = 1
+
+// SignerVote is a vote in a block to add (authorize) or remove a signer
+type SignerVote struct {
+	Signer    string `json:"signer"` // public key
+	Authorize bool   `json:"authorize"`
+}
+
+// signerSnapshot are the signers and their votes after a block
+type signerSnapshot struct {
+	Index   int64                      `json:"index"`
+	Signers []string                   `json:"signers"` // sorted
+	Recents map[int64]string           `json:"recents"` // the signers of the recent blocks, by index
+	Votes   map[string]map[string]bool `json:"votes"`   // the votes for or against a signer, by voter
+}
+
+// authority holds the signers at the genesis block and the snapshots by the hash of their block.
+// The engines of the nodes of one network can share it.
+type authority struct {
+	sync.Mutex
+	signers   []string
+	period    time.Duration
+	snapshots map[string]*signerSnapshot
+}
+
+// poaEngine seals blocks with the key of a signer
+type poaEngine struct {
+	*authority
+	key       *ecdsa.PrivateKey // nil if this node doesn't sign
+	signer    string            // public key of the key
+	proposals map[string]bool   // the votes we cast, by the signer voted on
+}
+
+func newAuthority(signers []string, period time.Duration) *authority {
+	sorted := append([]string{}, signers...)
+	sort.Strings(sorted)
+	return &authority{signers: sorted, period: period, snapshots: make(map[string]*signerSnapshot)}
+}
+
+// newSigner returns an engine that seals blocks with the key, it only verifies blocks if the key is nil
+func newSigner(a *authority, key *ecdsa.PrivateKey) *poaEngine {
+	e := &poaEngine{authority: a, key: key, proposals: make(map[string]bool)}
+	if key != nil {
+		e.signer = hex.EncodeToString(publicKeyBytes(key))
+	}
+	return e
+}
+
+// newPoaEngine returns a proof of authority engine with the signers, period and key of the settings
+func newPoaEngine(settings ConsensusSettings) (*poaEngine, error) {
+	if len(settings.Signers) == 0 {
+		return nil, errors.New("invalid consensus settings (proof of authority requires signers)")
+	}
+	if settings.Period <= 0 {
+		return nil, errors.New("invalid consensus settings (the period should be positive)")
+	}
+	for _, signer := range settings.Signers {
+		if !validPublicKey(signer) {
+			return nil, fmt.Errorf("invalid consensus settings (signer %s is not a public key)", signer)
+		}
+	}
+	var key *ecdsa.PrivateKey
+	if settings.KeyFile != "" {
+		var err error
+		if key, err = loadSignerKey(settings.KeyFile); err != nil {
+			return nil, err
+		}
+	}
+	return newSigner(newAuthority(settings.Signers, settings.Period), key), nil
+}
+
+// loadSignerKey reads a PEM encoded P-256 key
+func loadSignerKey(file string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("invalid signer key (no PEM data in %s)", file)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signer key (%s)", err)
+	}
+	if key.Curve != elliptic.P256() {
+		return nil, errors.New("invalid signer key (not a P-256 key)")
+	}
+	return key, nil
+}
+
+// validPublicKey tells if the key is a hex encoded uncompressed P-256 public key
+func validPublicKey(key string) bool {
+	b, err := hex.DecodeString(key)
+	if err != nil {
+		return false
+	}
+	x, _ := elliptic.Unmarshal(elliptic.P256(), b)
+	return x != nil
+}
+
+// sealHash is the hash of the header without it's signature, which is signed by the signer
+func sealHash(h BlockHeader) string {
+	h.Signature = ""
+	return h.hash()
+}
+
+// snapshot returns the signers after the parent; of the genesis block the signers of the authority
+func (a *authority) snapshot(parent BlockHeader) (*signerSnapshot, error) {
+	if parent.PreviousHash == zerohash {
+		return &signerSnapshot{
+			Index:   parent.Index,
+			Signers: append([]string{}, a.signers...),
+			Recents: make(map[int64]string),
+			Votes:   make(map[string]map[string]bool),
+		}, nil
+	}
+	a.Lock()
+	defer a.Unlock()
+	snap, ok := a.snapshots[parent.hash()]
+	if !ok {
+		return nil, fmt.Errorf("invalid seal (signers after block %d unknown)", parent.Index)
+	}
+	return snap, nil
+}
+
+// store keeps the signers after a block
+func (a *authority) store(h BlockHeader, snap *signerSnapshot) {
+	a.Lock()
+	defer a.Unlock()
+	a.snapshots[h.hash()] = snap
+}
+
+// isSigner tells if the key is one of the signers
+func (snap *signerSnapshot) isSigner(key string) bool {
+	i := sort.SearchStrings(snap.Signers, key)
+	return i < len(snap.Signers) && snap.Signers[i] == key
+}
+
+// inTurn tells if it is the turn of the signer to seal the block
+func (snap *signerSnapshot) inTurn(index int64, signer string) bool {
+	return snap.Signers[index%int64(len(snap.Signers))] == signer
+}
+
+// difficulty returns the difficulty of the block if the signer seals it
+func (snap *signerSnapshot) difficulty(index int64, signer string) int64 {
+	if snap.inTurn(index, signer) {
+		return difficultyInTurn
+	}
+	return difficultyOutOfTurn
+}
+
+// recentlySigned tells if the signer sealed one of the last signers/2 blocks before the block
+func (snap *signerSnapshot) recentlySigned(index int64, signer string) bool {
+	limit := int64(len(snap.Signers)/2 + 1)
+	for i, s := range snap.Recents {
+		if s == signer && index-i < limit {
+			return true
+		}
+	}
+	return false
+}
+
+// copy returns a copy that can be changed for the next block
+func (snap *signerSnapshot) copy() *signerSnapshot {
+	next := &signerSnapshot{
+		Index:   snap.Index,
+		Signers: append([]string{}, snap.Signers...),
+		Recents: make(map[int64]string, len(snap.Recents)),
+		Votes:   make(map[string]map[string]bool, len(snap.Votes)),
+	}
+	for i, s := range snap.Recents {
+		next.Recents[i] = s
+	}
+	for signer, votes := range snap.Votes {
+		next.Votes[signer] = make(map[string]bool, len(votes))
+		for voter, authorize := range votes {
+			next.Votes[signer][voter] = authorize
+		}
+	}
+	return next
+}
+
+// apply checks the signer, difficulty and vote of the header, and returns the signers after it
+func (snap *signerSnapshot) apply(h BlockHeader) (*signerSnapshot, error) {
+	if !snap.isSigner(h.Signer) {
+		return nil, fmt.Errorf("invalid seal (signer of block %d is not a signer)", h.Index)
+	}
+	if snap.recentlySigned(h.Index, h.Signer) {
+		return nil, fmt.Errorf("invalid seal (signer of block %d signed recently)", h.Index)
+	}
+	if h.Difficulty != snap.difficulty(h.Index, h.Signer) {
+		return nil, fmt.Errorf("invalid seal (wrong difficulty of block %d)", h.Index)
+	}
+	next := snap.copy()
+	next.Index = h.Index
+	next.Recents[h.Index] = h.Signer
+	if v := h.Vote; v != nil {
+		if !validPublicKey(v.Signer) || v.Authorize == snap.isSigner(v.Signer) {
+			return nil, fmt.Errorf("invalid vote (block %d votes for a change that is in effect)", h.Index)
+		}
+		if !v.Authorize && len(snap.Signers) == 1 {
+			return nil, fmt.Errorf("invalid vote (block %d votes to remove the last signer)", h.Index)
+		}
+		next.vote(h.Signer, *v)
+	}
+	limit := int64(len(next.Signers)/2 + 1)
+	for i := range next.Recents {
+		if i <= h.Index-limit {
+			delete(next.Recents, i)
+		}
+	}
+	return next, nil
+}
+
+// vote records the vote of a signer, and adds or removes the signer voted on if a majority agrees
+func (snap *signerSnapshot) vote(voter string, v SignerVote) {
+	if snap.Votes[v.Signer] == nil {
+		snap.Votes[v.Signer] = make(map[string]bool)
+	}
+	snap.Votes[v.Signer][voter] = v.Authorize
+	count := 0
+	for _, authorize := range snap.Votes[v.Signer] {
+		if authorize == v.Authorize {
+			count++
+		}
+	}
+	if count <= len(snap.Signers)/2 {
+		return
+	}
+	delete(snap.Votes, v.Signer)
+	if v.Authorize {
+		snap.Signers = append(snap.Signers, v.Signer)
+		sort.Strings(snap.Signers)
+		return
+	}
+	i := sort.SearchStrings(snap.Signers, v.Signer)
+	snap.Signers = append(snap.Signers[:i], snap.Signers[i+1:]...)
+	for signer, votes := range snap.Votes {
+		delete(votes, v.Signer) // the votes of a removed signer don't count
+		if len(votes) == 0 {
+			delete(snap.Votes, signer)
+		}
+	}
+}
+
+func (e *poaEngine) name() string {
+	return "poa"
+}
+
+// seal signs the block, with a vote if we proposed one
+func (e *poaEngine) seal(parent BlockHeader, bl *Block) error {
+	if e.key == nil {
+		return errors.New("invalid seal (this node is not a signer)")
+	}
+	snap, err := e.snapshot(parent)
+	if err != nil {
+		return err
+	}
+	if bl.Timestamp < parent.Timestamp+int64(e.period) {
+		return fmt.Errorf("invalid seal (block %d is too early)", bl.Index)
+	}
+	bl.Signer = e.signer
+	bl.Difficulty = snap.difficulty(bl.Index, e.signer)
+	bl.Vote = e.proposal(snap)
+	if _, err := snap.apply(bl.header()); err != nil {
+		return err
+	}
+	sig, err := sign(e.key, []byte(sealHash(bl.header())))
+	if err != nil {
+		return err
+	}
+	bl.Signature = hex.EncodeToString(sig)
+	return nil
+}
+
+// verifySeal checks the time, signature, signer, difficulty and vote of the header.
+// The signers after it are kept once the block is accepted.
+func (e *poaEngine) verifySeal(parent, h BlockHeader) error {
+	snap, err := e.snapshot(parent)
+	if err != nil {
+		return err
+	}
+	_, err = e.checkSeal(snap, parent, h)
+	return err
+}
+
+// verifyHeaders checks the seals of headers that follow the parent and each other, by the signers after
+// the headers before them
+func (e *poaEngine) verifyHeaders(parent BlockHeader, headers []BlockHeader) error {
+	snap, err := e.snapshot(parent)
+	if err != nil {
+		return err
+	}
+	for _, h := range headers {
+		if snap, err = e.checkSeal(snap, parent, h); err != nil {
+			return err
+		}
+		parent = h
+	}
+	return nil
+}
+
+// checkSeal checks the seal of the header by the signers after the parent, and returns the signers after it
+func (e *poaEngine) checkSeal(snap *signerSnapshot, parent, h BlockHeader) (*signerSnapshot, error) {
+	if h.Timestamp < parent.Timestamp+int64(e.period) {
+		return nil, fmt.Errorf("invalid seal (block %d is too early)", h.Index)
+	}
+	pub, err1 := hex.DecodeString(h.Signer)
+	sig, err2 := decodeSignature(h.Signature)
+	if err1 != nil || err2 != nil || !verifySignature(pub, []byte(sealHash(h)), sig) {
+		return nil, fmt.Errorf("invalid seal (signature of block %d invalid)", h.Index)
+	}
+	return snap.apply(h)
+}
+
+// accept keeps the signers after a block that is accepted, the seal of the block is verified already
+func (e *poaEngine) accept(parent, h BlockHeader) {
+	snap, err := e.snapshot(parent)
+	if err != nil {
+		return
+	}
+	if next, err := snap.apply(h); err == nil {
+		e.store(h, next)
+	}
+}
+
+// verifyBlock does nothing, the signers are known from the headers
+func (e *poaEngine) verifyBlock(chain []Block, bl Block) error {
+	return nil
+}
+
+// difficulty returns the difficulty of the block after the parent if we seal it, 0 if we can't
+func (e *poaEngine) difficulty(parent BlockHeader) int64 {
+	snap, err := e.snapshot(parent)
+	if err != nil || !snap.isSigner(e.signer) {
+		return 0
+	}
+	return snap.difficulty(parent.Index+1, e.signer)
+}
+
+// weight is the difficulty of the block
+func (e *poaEngine) weight(h BlockHeader) int64 {
+	return h.Difficulty
+}
+
+// forkChoice follows the heaviest branch, ours if they are equal
+func (e *poaEngine) forkChoice(ours, theirs []BlockHeader) bool {
+	return chainWeight(e, theirs) > chainWeight(e, ours)
+}
+
+// propose makes us vote to add (authorize) or remove a signer in the blocks we seal, until a majority agrees
+func (e *poaEngine) propose(signer string, authorize bool) error {
+	if !validPublicKey(signer) {
+		return errors.New("invalid vote (the signer is not a public key)")
+	}
+	e.Lock()
+	defer e.Unlock()
+	e.proposals[signer] = authorize
+	return nil
+}
+
+// proposal returns a vote of our proposals that is not in effect and we did not cast yet, nil if there is none
+func (e *poaEngine) proposal(snap *signerSnapshot) *SignerVote {
+	e.Lock()
+	defer e.Unlock()
+	signers := make([]string, 0, len(e.proposals))
+	for signer := range e.proposals {
+		signers = append(signers, signer)
+	}
+	sort.Strings(signers)
+	for _, signer := range signers {
+		authorize := e.proposals[signer]
+		if authorize == snap.isSigner(signer) {
+			continue
+		}
+		if voted, ok := snap.Votes[signer][e.signer]; ok && voted == authorize {
+			continue
+		}
+		return &SignerVote{Signer: signer, Authorize: authorize}
+	}
+	return nil
+}
+
+// delay returns the time to wait before we seal the block after the parent; period after the parent if
+// it is our turn, later if it's not. Returns false if we may not seal the block.
+func (e *poaEngine) delay(parent BlockHeader) (time.Duration, bool) {
+	snap, err := e.snapshot(parent)
+	if e.key == nil || err != nil || !snap.isSigner(e.signer) || snap.recentlySigned(parent.Index+1, e.signer) {
+		return 0, false
+	}
+	at := time.Unix(0, parent.Timestamp).Add(e.period)
+	if !snap.inTurn(parent.Index+1, e.signer) {
+		at = at.Add(e.period + time.Duration(rand.Int63n(int64(e.period)))) // give the in-turn signer a head start
+	}
+	return time.Until(at), true
+}
+
+// produceBlocks seals a block when it's our turn, or a while later if the in-turn signer doesn't.
+// It runs forever, if we are a signer.
+func (e *poaEngine) produceBlocks(chain *Blockchain) {
+	if e.key == nil {
+		return
+	}
+	for {
+		chain.Lock()
+		parent := chain.lastBlock()
+		chain.Unlock()
+		wait, ok := e.delay(parent.header())
+		if !ok {
+			time.Sleep(e.period)
+			continue
+		}
+		time.Sleep(wait)
+
+		chain.Lock()
+		changed := hash(chain.lastBlock()) != hash(parent)
+		chain.Unlock()
+		if changed {
+			continue // another signer sealed the block meanwhile
+		}
+		if _, err := chain.mine(); err != nil {
+			glog.Warningf("Could not seal block %d: %s", parent.Index+1, err)
+			time.Sleep(e.period)
+			continue
+		}
+	}
+}
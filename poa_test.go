@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The period of the proof of authority tests
+const testPeriod = time.Millisecond
+
+// newTestSigners returns the engines of n signers sharing one authority, sorted as the signers
+func newTestSigners(t *testing.T, n int) []*poaEngine {
+	var keys []*ecdsa.PrivateKey
+	var signers []string
+	for i := 0; i < n; i++ {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("Could not generate a key: %s", err)
+		}
+		keys = append(keys, key)
+		signers = append(signers, hex.EncodeToString(publicKeyBytes(key)))
+	}
+	a := newAuthority(signers, testPeriod)
+	var engines []*poaEngine
+	for _, key := range keys {
+		engines = append(engines, newSigner(a, key))
+	}
+	sort.Slice(engines, func(i, j int) bool { return engines[i].signer < engines[j].signer })
+	return engines
+}
+
+// sealWith seals the next block of the chain with the engine, once the period has passed
+func (c *testChain) sealWith(e *poaEngine) (Block, error) {
+	time.Sleep(testPeriod)
+	c.bc.engine = e
+	c.use()
+	return bc.mine()
+}
+
+// sealNext seals the next block with the in-turn signer, or another signer that may seal it
+func (c *testChain) sealNext(t *testing.T, engines []*poaEngine) Block {
+	parent := c.bc.lastBlock().header()
+	var signer *poaEngine
+	for _, e := range engines {
+		if _, ok := e.delay(parent); ok && (signer == nil || e.difficulty(parent) == difficultyInTurn) {
+			signer = e
+		}
+	}
+	if signer == nil {
+		t.Fatalf("No signer may seal block %d", parent.Index+1)
+	}
+	block, err := c.sealWith(signer)
+	if err != nil {
+		t.Fatalf("Could not seal block %d: %s", parent.Index+1, err)
+	}
+	return block
+}
+
+// resign signs the block again with the key of the engine
+func resign(t *testing.T, e *poaEngine, bl *Block) {
+	sig, err := sign(e.key, []byte(sealHash(bl.header())))
+	if err != nil {
+		t.Fatalf("Could not sign block %d: %s", bl.Index, err)
+	}
+	bl.Signature = hex.EncodeToString(sig)
+}
+
+func TestProofOfAuthority(t *testing.T) {
+	saveGlobals(t)
+
+	engines := newTestSigners(t, 3)
+	c := newTestChain("poa")
+
+	// block 2 is sealed in turn by signer 2, block 3 out of turn by signer 1
+	block, err := c.sealWith(engines[2])
+	if err != nil || block.Difficulty != difficultyInTurn || block.Signer != engines[2].signer {
+		t.Fatalf("Expected block 2 sealed in turn, got %v (%v)", block.Seal, err)
+	}
+	if block, err = c.sealWith(engines[1]); err != nil || block.Difficulty != difficultyOutOfTurn {
+		t.Fatalf("Expected block 3 sealed out of turn, got %v (%v)", block.Seal, err)
+	}
+	if _, err := c.sealWith(engines[1]); err == nil {
+		t.Error("Signer should not seal two blocks in a row")
+	}
+	outsider := newTestSigners(t, 1)[0]
+	if _, err := c.sealWith(newSigner(engines[0].authority, outsider.key)); err == nil {
+		t.Error("Block should only be sealed by a signer")
+	}
+	if _, err := c.sealWith(newSigner(engines[0].authority, nil)); err == nil {
+		t.Error("Node without a signer key should not seal blocks")
+	}
+	if _, err := c.sealWith(engines[2]); err != nil {
+		t.Fatalf("Could not seal block 4: %s", err)
+	}
+
+	// another node verifies the chain with the signers only
+	follower := &Blockchain{Chain: append([]Block{}, c.bc.Chain...), engine: newSigner(newAuthority(engines[0].authority.signers, testPeriod), nil)}
+	if !follower.validate() {
+		t.Fatal("Chain should be valid with the signers")
+	}
+	last := c.bc.lastBlock()
+	tampered := map[string]func(bl *Block){
+		"signature":  func(bl *Block) { bl.Signature = c.bc.Chain[1].Signature },
+		"encoding":   func(bl *Block) { bl.Signature = strings.ToUpper(bl.Signature) },
+		"difficulty": func(bl *Block) { bl.Difficulty = difficultyInTurn; resign(t, engines[2], bl) },
+		"time":       func(bl *Block) { bl.Timestamp = c.bc.Chain[2].Timestamp; resign(t, engines[2], bl) },
+		"signer":     func(bl *Block) { bl.Signer = outsider.signer; resign(t, outsider, bl) },
+	}
+	for name, tamper := range tampered {
+		bl := last
+		tamper(&bl)
+		follower.Chain[len(follower.Chain)-1] = bl
+		if follower.validate() {
+			t.Errorf("Block with another %s should be invalid", name)
+		}
+	}
+	// the signers after a block are kept only if the whole block is valid
+	invalid := last
+	invalid.Transactions = []Transaction{{Sender: zerohash, Recipient: zerohash, Amount: -1}}
+	resign(t, engines[2], &invalid)
+	follower.Chain[len(follower.Chain)-1] = invalid
+	if follower.validate() {
+		t.Error("Block with a negative coinbase should be invalid")
+	}
+	if _, err := follower.engine.(*poaEngine).snapshot(invalid.header()); err == nil {
+		t.Error("Signers after an invalid block should not be kept")
+	}
+
+	// an in-turn block weighs more than an out of turn block
+	parent := c.bc.Chain[len(c.bc.Chain)-2]
+	if engines[0].forkChoice([]BlockHeader{last.header()}, []BlockHeader{parent.header()}) || !engines[0].forkChoice([]BlockHeader{c.bc.Chain[2].header()}, []BlockHeader{c.bc.Chain[1].header()}) {
+		t.Error("Heavier branch should be preferred")
+	}
+}
+
+func TestSignerVotes(t *testing.T) {
+	saveGlobals(t)
+
+	engines := newTestSigners(t, 3)
+	newcomer := newSigner(engines[0].authority, newTestSigners(t, 1)[0].key)
+	c := newTestChain("poa-votes")
+	c.bc.engine = engines[0]
+	if code := c.call(t, "POST", "/signers/vote", SignerVote{Signer: "invalid", Authorize: true}, nil); code != http.StatusBadRequest {
+		t.Errorf("Vote for an invalid key should be refused, got %d", code)
+	}
+	for _, e := range engines[:2] {
+		c.bc.engine = e
+		if code := c.call(t, "POST", "/signers/vote", SignerVote{Signer: newcomer.signer, Authorize: true}, nil); code != http.StatusCreated {
+			t.Fatalf("Could not vote, got %d", code)
+		}
+	}
+
+	// a majority of 2 of the 3 signers adds the newcomer
+	type signersResponse struct {
+		Signers []string                   `json:"signers"`
+		Votes   map[string]map[string]bool `json:"votes"`
+	}
+	var resp signersResponse
+	for i := 0; i < 10 && len(resp.Signers) != 4; i++ {
+		c.sealNext(t, engines)
+		resp = signersResponse{}
+		c.call(t, "GET", "/signers", nil, &resp)
+		if len(resp.Signers) == 3 && len(resp.Votes[newcomer.signer]) > 1 {
+			t.Fatal("Votes should be applied once a majority agrees")
+		}
+	}
+	if len(resp.Signers) != 4 || len(resp.Votes) != 0 {
+		t.Fatalf("Newcomer should be added, got %d signers and votes %v", len(resp.Signers), resp.Votes)
+	}
+	engines = append(engines, newcomer)
+	if _, err := c.sealWith(newcomer); err != nil {
+		t.Errorf("Added signer should seal blocks: %s", err)
+	}
+
+	// 3 of the 4 signers are needed to remove it again
+	for _, e := range engines[:3] {
+		e.propose(newcomer.signer, false)
+	}
+	for i := 0; i < 10 && len(resp.Signers) != 3; i++ {
+		c.sealNext(t, engines)
+		resp = signersResponse{}
+		c.call(t, "GET", "/signers", nil, &resp)
+	}
+	if len(resp.Signers) != 3 {
+		t.Fatalf("Newcomer should be removed, got %d signers", len(resp.Signers))
+	}
+	if _, err := c.sealWith(newcomer); err == nil {
+		t.Error("Removed signer should not seal blocks")
+	}
+
+	follower := &Blockchain{Chain: c.bc.Chain, engine: newSigner(newAuthority(engines[0].authority.signers, testPeriod), nil)}
+	if !follower.validate() {
+		t.Error("Chain with votes should be valid")
+	}
+}
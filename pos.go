@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grrrben/glog"
+)
+
+// Proof of stake divides time in slots. The leader of a slot is chosen pseudo-randomly from the stakes, weighted
+// by their amount; the choice is deterministic, from the hash of the parent and the slot number. Only the leader
+// may seal a block in it's slot, with the key of it's stake. A slot without a block is skipped, the longest chain
+// is followed. A key that signs two blocks for one slot is slashed by anyone that sees both, see stake.
+// The stakers at the genesis block have a stake of genesisStake without coins, so the first slots have a leader.
+
+// The stake of the stakers at the genesis block
+const genesisStake = 1
+
+// The number of slots the headers are kept to detect double signs
+const evidenceSlots = 1000
+
+// slotSigner is a signer of a slot
+type slotSigner struct {
+	slot   int64
+	signer string
+}
+
+// posEngine seals the blocks of the slots we lead with the key of our stake
+type posEngine struct {
+	sync.Mutex
+	genesis  []string      // the stakers at the genesis block
+	slotTime time.Duration // the duration of a slot
+	key      *ecdsa.PrivateKey
+	staker   string                     // public key of the key, empty if we don't stake
+	signed   map[slotSigner]BlockHeader // the headers we have seen, to detect double signs
+	evidence map[string][]BlockHeader   // the double signs that are not slashed yet, by key
+}
+
+func newStaker(genesis []string, slotTime time.Duration, key *ecdsa.PrivateKey) *posEngine {
+	e := &posEngine{
+		genesis:  genesis,
+		slotTime: slotTime,
+		key:      key,
+		signed:   make(map[slotSigner]BlockHeader),
+		evidence: make(map[string][]BlockHeader),
+	}
+	if key != nil {
+		e.staker = hex.EncodeToString(publicKeyBytes(key))
+	}
+	return e
+}
+
+// newPosEngine returns a proof of stake engine with the stakers, slot and key of the settings
+func newPosEngine(settings ConsensusSettings) (*posEngine, error) {
+	if len(settings.Signers) == 0 {
+		return nil, errors.New("invalid consensus settings (proof of stake requires stakers at the genesis block)")
+	}
+	if settings.Period <= 0 {
+		return nil, errors.New("invalid consensus settings (the period should be positive)")
+	}
+	for _, staker := range settings.Signers {
+		if !validPublicKey(staker) {
+			return nil, fmt.Errorf("invalid consensus settings (staker %s is not a public key)", staker)
+		}
+	}
+	var key *ecdsa.PrivateKey
+	if settings.KeyFile != "" {
+		var err error
+		if key, err = loadSignerKey(settings.KeyFile); err != nil {
+			return nil, err
+		}
+	}
+	return newStaker(settings.Signers, settings.Period, key), nil
+}
+
+// slot returns the slot of a time (UnixNano)
+func (e *posEngine) slot(t int64) int64 {
+	return t / int64(e.slotTime)
+}
+
+// weights returns the amount of the stakes in the chain by key, with the stakers at the genesis block
+func (e *posEngine) weights(chain []Block) map[string]float64 {
+	weights := make(map[string]float64)
+	for _, key := range e.genesis {
+		weights[key] = genesisStake
+	}
+	for key, stake := range stakes(chain, nil) {
+		weights[key] += stake.Amount
+		if stake.Slashed || weights[key] <= 0 {
+			delete(weights, key)
+		}
+	}
+	return weights
+}
+
+// leader returns the key that leads the slot after the parent, chosen by the weights of the keys
+func leader(parent BlockHeader, slot int64, weights map[string]float64) string {
+	keys := make([]string, 0, len(weights))
+	var total float64
+	for key, weight := range weights {
+		keys = append(keys, key)
+		total += weight
+	}
+	if len(keys) == 0 {
+		return ""
+	}
+	sort.Strings(keys)
+	seed := sha256.Sum256([]byte(fmt.Sprintf("%s%d", parent.hash(), slot)))
+	r := float64(binary.BigEndian.Uint64(seed[:8])>>11) / (1 << 53) * total
+	for _, key := range keys {
+		if r -= weights[key]; r < 0 {
+			return key
+		}
+	}
+	return keys[len(keys)-1]
+}
+
+func (e *posEngine) name() string {
+	return "pos"
+}
+
+// seal signs the block for the slot of it's timestamp, the leader of the slot is checked by verifyBlock
+func (e *posEngine) seal(parent BlockHeader, bl *Block) error {
+	if e.key == nil {
+		return errors.New("invalid seal (this node does not stake)")
+	}
+	bl.Slot = e.slot(bl.Timestamp)
+	if bl.Slot <= parent.Slot {
+		return fmt.Errorf("invalid seal (block %d is too early)", bl.Index)
+	}
+	bl.Signer = e.staker
+	sig, err := sign(e.key, []byte(sealHash(bl.header())))
+	if err != nil {
+		return err
+	}
+	bl.Signature = hex.EncodeToString(sig)
+	return nil
+}
+
+// verifySeal checks the slot and signature of the header, and keeps it to detect double signs
+func (e *posEngine) verifySeal(parent, h BlockHeader) error {
+	if h.Slot <= parent.Slot || h.Slot != e.slot(h.Timestamp) {
+		return fmt.Errorf("invalid seal (block %d is not in a slot after it's parent)", h.Index)
+	}
+	if h.Timestamp > time.Now().Add(e.slotTime).UnixNano() {
+		return fmt.Errorf("invalid seal (block %d is in the future)", h.Index)
+	}
+	pub, err1 := hex.DecodeString(h.Signer)
+	sig, err2 := decodeSignature(h.Signature)
+	if err1 != nil || err2 != nil || !verifySignature(pub, []byte(sealHash(h)), sig) {
+		return fmt.Errorf("invalid seal (signature of block %d invalid)", h.Index)
+	}
+	e.record(h)
+	return nil
+}
+
+// verifyBlock checks that the signer of the block leads it's slot, by the stakes in the chain before it
+func (e *posEngine) verifyBlock(chain []Block, bl Block) error {
+	parent := chain[len(chain)-1]
+	if leader(parent.header(), bl.Slot, e.weights(chain)) != bl.Signer {
+		return fmt.Errorf("invalid seal (signer of block %d does not lead slot %d)", bl.Index, bl.Slot)
+	}
+	return nil
+}
+
+// difficulty is the same for every block
+func (e *posEngine) difficulty(parent BlockHeader) int64 {
+	return 1
+}
+
+// weight is the same for every block
+func (e *posEngine) weight(h BlockHeader) int64 {
+	return 1
+}
+
+// forkChoice follows the longest branch, ours if they are equal
+func (e *posEngine) forkChoice(ours, theirs []BlockHeader) bool {
+	return chainWeight(e, theirs) > chainWeight(e, ours)
+}
+
+// record keeps the header, if the signer signed another header for the slot it's evidence of a double sign
+func (e *posEngine) record(h BlockHeader) {
+	e.Lock()
+	defer e.Unlock()
+	seen := slotSigner{h.Slot, h.Signer}
+	if other, ok := e.signed[seen]; !ok {
+		e.signed[seen] = h
+	} else if _, known := e.evidence[h.Signer]; !known && sealHash(other) != sealHash(h) {
+		glog.Warningf("Double sign of slot %d, blocks %d and %d", h.Slot, other.Index, h.Index)
+		e.evidence[h.Signer] = []BlockHeader{other, h}
+	}
+	if len(e.signed) > evidenceSlots {
+		for s := range e.signed {
+			if s.slot < h.Slot-evidenceSlots {
+				delete(e.signed, s)
+			}
+		}
+	}
+}
+
+// slashTransactions returns the transactions that slash the double signs, which are not slashed yet
+func (e *posEngine) slashTransactions(chain []Block, transactions []Transaction) []Transaction {
+	e.Lock()
+	defer e.Unlock()
+	var trs []Transaction
+	current := stakes(chain, transactions)
+	for key, evidence := range e.evidence {
+		if stake, ok := current[key]; ok && stake.Slashed {
+			delete(e.evidence, key)
+			continue
+		}
+		tr := slashTransaction(key, evidence, chain, transactions)
+		tr.Time = time.Now().UnixNano()
+		trs = append(trs, tr)
+	}
+	return trs
+}
+
+// produceBlocks submits the evidence of double signs every slot, and seals a block in the slots we lead.
+// It runs forever.
+func (e *posEngine) produceBlocks(chain *Blockchain) {
+	for {
+		now := time.Now().UnixNano()
+		slot := e.slot(now) + 1
+		time.Sleep(time.Duration(slot*int64(e.slotTime) - now))
+
+		chain.Lock()
+		for _, tr := range e.slashTransactions(chain.Chain, chain.Transactions) {
+			if _, err := chain.newTransaction(tr); err == nil {
+				go chain.peers().distributeTransaction(tr)
+			}
+		}
+		lead := e.key != nil && leader(chain.lastBlock().header(), slot, e.weights(chain.Chain)) == e.staker
+		chain.Unlock()
+		if !lead {
+			continue
+		}
+		if _, err := chain.mine(); err != nil {
+			glog.Warningf("Could not seal a block in slot %d: %s", slot, err)
+			continue
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/elliptic"
+	"encoding/hex"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The slot of the proof of stake tests
+const testSlot = 20 * time.Millisecond
+
+// newTestStakers returns the engines of n stakers, with the first genesis of them staking at the genesis block
+func newTestStakers(t *testing.T, n, genesis int) []*posEngine {
+	signers := newTestSigners(t, n)
+	var stakers []string
+	for _, s := range signers[:genesis] {
+		stakers = append(stakers, s.signer)
+	}
+	var engines []*posEngine
+	for _, s := range signers {
+		engines = append(engines, newStaker(stakers, testSlot, s.key))
+	}
+	return engines
+}
+
+// mineSlot seals the next block in the first slot one of the engines leads
+func (c *testChain) mineSlot(t *testing.T, engines []*posEngine) Block {
+	parent := c.bc.lastBlock().header()
+	weights := engines[0].weights(c.bc.Chain)
+	slot := engines[0].slot(time.Now().UnixNano()) + 1
+	for end := slot + 1000; slot < end; slot++ {
+		for _, e := range engines {
+			if leader(parent, slot, weights) != e.staker {
+				continue
+			}
+			time.Sleep(time.Until(time.Unix(0, slot*int64(testSlot))))
+			c.bc.engine = e
+			c.mine(t)
+			return c.bc.lastBlock()
+		}
+	}
+	t.Fatalf("None of the engines leads a slot after block %d", parent.Index)
+	return Block{}
+}
+
+func TestProofOfStake(t *testing.T) {
+	saveGlobals(t)
+
+	engines := newTestStakers(t, 3, 2)
+	staker := engines[2]
+	c := newTestChain("pos")
+	for i := 0; i < 5; i++ {
+		c.mineSlot(t, engines)
+	}
+	follower := &Blockchain{Chain: append([]Block{}, c.bc.Chain...), engine: newStaker(staker.genesis, testSlot, nil)}
+	if !follower.validate() {
+		t.Fatal("Chain should be valid with the stakers at the genesis block")
+	}
+
+	// a block of a slot the signer doesn't lead is invalid
+	parent := c.bc.lastBlock()
+	bl := Block{Index: parent.Index + 1, PreviousHash: hash(parent)}
+	for slot := parent.Slot + 1; ; slot++ {
+		if leader(parent.header(), slot, engines[0].weights(c.bc.Chain)) != engines[0].staker {
+			bl.Timestamp = slot * int64(testSlot)
+			break
+		}
+	}
+	if err := engines[0].seal(parent.header(), &bl); err != nil {
+		t.Fatalf("Could not seal a block: %s", err)
+	}
+	if engines[0].verifyBlock(c.bc.Chain, bl) == nil {
+		t.Error("Block of a slot the signer doesn't lead should be invalid")
+	}
+
+	// the third staker stakes coins of the wallet of the node
+	c.bc.engine = staker
+	payload := map[string]interface{}{"wallet": c.me.Hash, "amount": 3}
+	if code := c.call(t, "POST", "/stake", payload, nil); code != http.StatusOK {
+		t.Fatalf("Could not stake, got %d", code)
+	}
+	c.mineSlot(t, engines[:2])
+	if weights := staker.weights(c.bc.Chain); weights[staker.staker] != 3 || len(weights) != 3 {
+		t.Fatalf("Staker should have a weight of it's stake, got %v", weights)
+	}
+	c.bc.engine = staker
+	if code := c.call(t, "POST", "/unstake", nil, nil); code != http.StatusUnprocessableEntity {
+		t.Errorf("Stake should not be unstaked before the unbonding blocks, got %d", code)
+	}
+	unstake := Transaction{
+		Sender:    stakeAddress,
+		Recipient: c.me.Hash,
+		Amount:    3,
+		Time:      time.Now().UnixNano(),
+		Stake:     &StakeUpdate{Action: "unstake", Key: staker.staker},
+	}
+	sig, _ := sign(staker.key, unstake.sigHash())
+	unstake.Witness = hex.EncodeToString(sig)
+	index := lastSigned(staker.staker, c.bc.Chain) + stakeUnbonding + 1
+	if err := checkStakeTransaction(unstake, c.bc.Chain, nil, index); err != nil {
+		t.Errorf("Stake should be unstaked after the unbonding blocks: %s", err)
+	}
+
+	// the staker signs two blocks for one slot, a follower sees both and slashes it
+	var double Block
+	for double.Signer != staker.staker {
+		double = c.mineSlot(t, engines)
+	}
+	other := double
+	if other.Timestamp = other.Slot * int64(testSlot); other.Timestamp == double.Timestamp {
+		other.Timestamp++
+	}
+	sig, _ = sign(staker.key, []byte(sealHash(other.header())))
+	other.Signature = hex.EncodeToString(sig)
+	observer := newStaker(staker.genesis, testSlot, nil)
+	parent = c.bc.Chain[len(c.bc.Chain)-2]
+	for _, h := range []BlockHeader{double.header(), other.header()} {
+		if err := observer.verifySeal(parent.header(), h); err != nil {
+			t.Fatalf("Seal should be valid: %s", err)
+		}
+	}
+	slashes := observer.slashTransactions(c.bc.Chain, c.bc.Transactions)
+	if len(slashes) != 1 || slashes[0].Amount != 3 {
+		t.Fatalf("Expected a slash of the stake, got %v", slashes)
+	}
+	if _, err := c.bc.newTransaction(slashes[0]); err != nil {
+		t.Fatalf("Slash should be valid: %s", err)
+	}
+	c.mineSlot(t, engines)
+	if stake := stakes(c.bc.Chain, nil)[staker.staker]; !stake.Slashed || stake.Amount != 0 {
+		t.Errorf("Stake should be slashed, got %v", stake)
+	}
+	if _, ok := staker.weights(c.bc.Chain)[staker.staker]; ok {
+		t.Error("Slashed staker should not lead slots")
+	}
+	if err := checkStakeTransaction(slashes[0], c.bc.Chain, nil, c.bc.lastBlock().Index+1); err == nil {
+		t.Error("Stake should not be slashed twice")
+	}
+	if len(observer.slashTransactions(c.bc.Chain, nil)) != 0 {
+		t.Error("Evidence of a slashed staker should be dropped")
+	}
+}
+
+func TestLeader(t *testing.T) {
+	weights := map[string]float64{"light": 1, "heavy": 9}
+	parent := BlockHeader{Index: 1, PreviousHash: zerohash}
+	led := make(map[string]int)
+	for slot := int64(1); slot <= 2000; slot++ {
+		led[leader(parent, slot, weights)]++
+	}
+	if led["light"] < 100 || led["light"] > 300 {
+		t.Errorf("Leaders should be picked by weight, got %v", led)
+	}
+	if leader(parent, 1, weights) != leader(parent, 1, weights) {
+		t.Error("Leader should be deterministic")
+	}
+}
+
+func TestCheckDoubleSignEncoding(t *testing.T) {
+	key := createWallet().key
+	signer := hex.EncodeToString(publicKeyBytes(key))
+	signed := func(h BlockHeader) BlockHeader {
+		h.Signer = signer
+		sig, _ := sign(key, []byte(sealHash(h)))
+		h.Signature = hex.EncodeToString(sig)
+		return h
+	}
+	h := signed(BlockHeader{Index: 2, Seal: Seal{Slot: 5}, PreviousHash: zerohash})
+	other := signed(BlockHeader{Index: 2, Seal: Seal{Slot: 5}, PreviousHash: strings.Repeat("ab", 32)})
+	if err := checkDoubleSign(signer, []BlockHeader{h, other}); err != nil {
+		t.Errorf("Two headers of one slot should be evidence: %s", err)
+	}
+
+	upper := h
+	upper.Signature = strings.ToUpper(h.Signature)
+	sig, _ := hex.DecodeString(h.Signature)
+	s := new(big.Int).SetBytes(sig[32:])
+	highS := h
+	highS.Signature = hex.EncodeToString(sig[:32]) + hex.EncodeToString(s.Sub(elliptic.P256().Params().N, s).Bytes())
+	for name, malleated := range map[string]BlockHeader{"an uppercase": upper, "a high s": highS} {
+		if err := checkDoubleSign(signer, []BlockHeader{h, malleated}); err == nil {
+			t.Errorf("A header with %s signature should not be evidence", name)
+		}
+	}
+}
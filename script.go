@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Scripts are a small, stack based and deliberately non Turing-complete language
+// used to lock coins. A wallet address is the sha256 hash of a locking script,
+// spending from it means revealing that script together with a witness (the
+// unlocking data) that makes the script evaluate to true.
+//
+// A script is a space separated list of tokens. Tokens starting with OP_ are
+// opcodes, all other tokens are hex encoded data that is pushed onto the stack.
+// There are no jumps or loops, every token is executed at most once.
+//
+// e.g. pay-to-pubkey-hash:
+// 	script:  OP_DUP OP_SHA256 <sha256 of the public key> OP_EQUALVERIFY OP_CHECKSIG
+// 	witness: <signature> <public key>
+
+// The maximum length of a script (or witness) in characters
+const maxScriptSize = 10000
+
+// The maximum number of tokens that are executed for a single script and witness
+const maxScriptSteps = 500
+
+// The maximum number of items on the stack
+const maxStackSize = 1000
+
+// The maximum size of a single stack item in bytes
+const maxStackItemSize = 520
+
+// The maximum number of public keys in an OP_CHECKMULTISIG
+const maxMultisigKeys = 16
+
+// Locktimes below this value are block heights, others are timestamps (UnixNano)
+const lockTimeThreshold int64 = 500000000
+
+// scriptContext holds the data of the transaction and chain a script is evaluated against.
+type scriptContext struct {
+	sigHash  []byte // the message that signatures commit to, the hash of the transaction
+	lockTime int64  // the LockTime of the transaction, which is enforced by the blocks
+}
+
+// scriptHash returns the address of a locking script
+func scriptHash(script string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(script)))
+}
+
+// payToPubKeyHashScript returns the standard locking script for a single public key
+func payToPubKeyHashScript(pubKey []byte) string {
+	return fmt.Sprintf("OP_DUP OP_SHA256 %x OP_EQUALVERIFY OP_CHECKSIG", sha256.Sum256(pubKey))
+}
+
+// multisigScript returns a locking script that needs m signatures of the given public keys.
+// The signatures in the witness should be in the same order as the public keys.
+func multisigScript(m int, pubKeys ...[]byte) string {
+	tokens := []string{scriptNumberToken(int64(m))}
+	for _, pub := range pubKeys {
+		tokens = append(tokens, hex.EncodeToString(pub))
+	}
+	tokens = append(tokens, scriptNumberToken(int64(len(pubKeys))), "OP_CHECKMULTISIG")
+	return strings.Join(tokens, " ")
+}
+
+// scriptNumberToken returns the token that pushes number n
+func scriptNumberToken(n int64) string {
+	if n >= 0 && n <= 16 {
+		return fmt.Sprintf("OP_%d", n)
+	}
+	return hex.EncodeToString(encodeScriptNumber(n))
+}
+
+// encodeScriptNumber encodes a non negative number as a minimal big endian byte slice
+func encodeScriptNumber(n int64) []byte {
+	var b []byte
+	for n > 0 {
+		b = append([]byte{byte(n & 0xff)}, b...)
+		n >>= 8
+	}
+	return b
+}
+
+// decodeScriptNumber reads a stack item as a big endian number of at most 8 bytes
+func decodeScriptNumber(b []byte) (int64, error) {
+	if len(b) > 8 || (len(b) == 8 && b[0]&0x80 != 0) {
+		return 0, errors.New("script error (number out of range)")
+	}
+	var n int64
+	for _, c := range b {
+		n = n<<8 | int64(c)
+	}
+	return n, nil
+}
+
+// isTrue tells if a stack item is considered true; anything but an empty item or only zero bytes.
+func isTrue(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// scriptStack is the data stack of the interpreter
+type scriptStack [][]byte
+
+func (s *scriptStack) push(b []byte) error {
+	if len(b) > maxStackItemSize {
+		return errors.New("script error (stack item too large)")
+	}
+	if len(*s) >= maxStackSize {
+		return errors.New("script error (stack overflow)")
+	}
+	*s = append(*s, b)
+	return nil
+}
+
+func (s *scriptStack) pop() ([]byte, error) {
+	if len(*s) == 0 {
+		return nil, errors.New("script error (stack underflow)")
+	}
+	b := (*s)[len(*s)-1]
+	*s = (*s)[:len(*s)-1]
+	return b, nil
+}
+
+func (s *scriptStack) popNumber() (int64, error) {
+	b, err := s.pop()
+	if err != nil {
+		return 0, err
+	}
+	return decodeScriptNumber(b)
+}
+
+// tokenize splits a script in it's tokens and checks the size limit
+func tokenize(script string) ([]string, error) {
+	if len(script) > maxScriptSize {
+		return nil, errors.New("script error (script too large)")
+	}
+	return strings.Fields(script), nil
+}
+
+// evalScript runs the witness followed by the locking script.
+// The witness may only push data. The script succeeds if the top of the stack is true when it ends.
+func evalScript(witness, script string, ctx scriptContext) error {
+	witnessTokens, err := tokenize(witness)
+	if err != nil {
+		return err
+	}
+	scriptTokens, err := tokenize(script)
+	if err != nil {
+		return err
+	}
+	if len(witnessTokens)+len(scriptTokens) > maxScriptSteps {
+		return errors.New("script error (too many steps)")
+	}
+
+	var stack scriptStack
+	for _, token := range witnessTokens {
+		if strings.HasPrefix(token, "OP_") && !isPushOpcode(token) {
+			return errors.New("script error (witness may only push data)")
+		}
+		if err := execToken(token, &stack, nil, ctx); err != nil {
+			return err
+		}
+	}
+
+	var conditions []bool
+	for _, token := range scriptTokens {
+		if err := execToken(token, &stack, &conditions, ctx); err != nil {
+			return err
+		}
+	}
+	if len(conditions) > 0 {
+		return errors.New("script error (unbalanced conditional)")
+	}
+
+	top, err := stack.pop()
+	if err != nil || !isTrue(top) {
+		return errors.New("script error (evaluated to false)")
+	}
+	return nil
+}
+
+// isPushOpcode tells if an opcode just pushes a number
+func isPushOpcode(op string) bool {
+	_, ok := pushOpcodeValue(op)
+	return ok
+}
+
+// pushOpcodeValue returns the number pushed by OP_0 to OP_16, OP_TRUE and OP_FALSE
+func pushOpcodeValue(op string) (int64, bool) {
+	switch op {
+	case "OP_FALSE":
+		return 0, true
+	case "OP_TRUE":
+		return 1, true
+	}
+	var n int64
+	if _, err := fmt.Sscanf(op, "OP_%d", &n); err == nil && n >= 0 && n <= 16 && op == fmt.Sprintf("OP_%d", n) {
+		return n, true
+	}
+	return 0, false
+}
+
+// executing tells if the current branch of the conditionals is being executed
+func executing(conditions []bool) bool {
+	for _, c := range conditions {
+		if !c {
+			return false
+		}
+	}
+	return true
+}
+
+// execToken executes a single token of a script.
+// conditions is the stack of OP_IF branches, nil when conditionals are not allowed.
+func execToken(token string, stack *scriptStack, conditions *[]bool, ctx scriptContext) error {
+	if conditions != nil {
+		switch token {
+		case "OP_IF", "OP_NOTIF":
+			branch := false
+			if executing(*conditions) {
+				top, err := stack.pop()
+				if err != nil {
+					return err
+				}
+				branch = isTrue(top) == (token == "OP_IF")
+			}
+			*conditions = append(*conditions, branch)
+			return nil
+		case "OP_ELSE":
+			if len(*conditions) == 0 {
+				return errors.New("script error (OP_ELSE without OP_IF)")
+			}
+			(*conditions)[len(*conditions)-1] = !(*conditions)[len(*conditions)-1]
+			return nil
+		case "OP_ENDIF":
+			if len(*conditions) == 0 {
+				return errors.New("script error (OP_ENDIF without OP_IF)")
+			}
+			*conditions = (*conditions)[:len(*conditions)-1]
+			return nil
+		}
+		if !executing(*conditions) {
+			return nil
+		}
+	}
+
+	if !strings.HasPrefix(token, "OP_") {
+		data, err := hex.DecodeString(token)
+		if err != nil {
+			return fmt.Errorf("script error (invalid data %s)", token)
+		}
+		return stack.push(data)
+	}
+
+	if n, ok := pushOpcodeValue(token); ok {
+		return stack.push(encodeScriptNumber(n))
+	}
+
+	switch token {
+	case "OP_DUP":
+		top, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		stack.push(top)
+		return stack.push(top)
+	case "OP_DROP":
+		_, err := stack.pop()
+		return err
+	case "OP_SWAP":
+		a, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		b, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		stack.push(a)
+		return stack.push(b)
+	case "OP_SHA256":
+		top, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(top)
+		return stack.push(sum[:])
+	case "OP_EQUAL", "OP_EQUALVERIFY":
+		a, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		b, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		if token == "OP_EQUALVERIFY" {
+			if !bytes.Equal(a, b) {
+				return errors.New("script error (OP_EQUALVERIFY failed)")
+			}
+			return nil
+		}
+		return stack.push(boolItem(bytes.Equal(a, b)))
+	case "OP_VERIFY":
+		top, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		if !isTrue(top) {
+			return errors.New("script error (OP_VERIFY failed)")
+		}
+		return nil
+	case "OP_RETURN":
+		return errors.New("script error (OP_RETURN)")
+	case "OP_CHECKSIG", "OP_CHECKSIGVERIFY":
+		pub, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		sig, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		valid := verifySignature(pub, ctx.sigHash, sig)
+		if token == "OP_CHECKSIGVERIFY" {
+			if !valid {
+				return errors.New("script error (OP_CHECKSIGVERIFY failed)")
+			}
+			return nil
+		}
+		return stack.push(boolItem(valid))
+	case "OP_CHECKMULTISIG":
+		return checkMultisig(stack, ctx)
+	case "OP_CHECKLOCKTIMEVERIFY":
+		// the top item stays on the stack, like in bitcoin, and is usually followed by an OP_DROP
+		if len(*stack) == 0 {
+			return errors.New("script error (stack underflow)")
+		}
+		lockTime, err := decodeScriptNumber((*stack)[len(*stack)-1])
+		if err != nil {
+			return err
+		}
+		// the transaction should be locked at least as long, blocks will not contain it before.
+		if (lockTime < lockTimeThreshold) != (ctx.lockTime < lockTimeThreshold) {
+			return errors.New("script error (locktime type mismatch)")
+		}
+		if ctx.lockTime < lockTime {
+			return fmt.Errorf("script error (locked until %d)", lockTime)
+		}
+		return nil
+	}
+	return fmt.Errorf("script error (unknown opcode %s)", token)
+}
+
+// checkMultisig executes OP_CHECKMULTISIG.
+// Expects on the stack: <sig 1> .. <sig m> <m> <pub 1> .. <pub n> <n>
+func checkMultisig(stack *scriptStack, ctx scriptContext) error {
+	n, err := stack.popNumber()
+	if err != nil {
+		return err
+	}
+	if n < 0 || n > maxMultisigKeys {
+		return errors.New("script error (invalid number of public keys)")
+	}
+	pubKeys := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		if pubKeys[i], err = stack.pop(); err != nil {
+			return err
+		}
+	}
+	m, err := stack.popNumber()
+	if err != nil {
+		return err
+	}
+	if m < 0 || m > n {
+		return errors.New("script error (invalid number of signatures)")
+	}
+	sigs := make([][]byte, m)
+	for i := m - 1; i >= 0; i-- {
+		if sigs[i], err = stack.pop(); err != nil {
+			return err
+		}
+	}
+
+	// signatures should be in the same order as the keys, each key is used once.
+	k := 0
+	for _, sig := range sigs {
+		for k < len(pubKeys) && !verifySignature(pubKeys[k], ctx.sigHash, sig) {
+			k++
+		}
+		if k == len(pubKeys) {
+			return stack.push(boolItem(false))
+		}
+		k++
+	}
+	return stack.push(boolItem(true))
+}
+
+// boolItem converts a bool to a stack item
+func boolItem(b bool) []byte {
+	if b {
+		return []byte{1}
+	}
+	return []byte{}
+}
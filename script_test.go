@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestEvalPayToPubKeyHash(t *testing.T) {
+	w := createWallet()
+	msg := []byte("transaction hash")
+	sig, err := sign(w.key, msg)
+	if err != nil {
+		t.Fatalf("Could not sign: %s", err)
+	}
+
+	witness := fmt.Sprintf("%x %x", sig, publicKeyBytes(w.key))
+	if err := evalScript(witness, w.script, scriptContext{sigHash: msg}); err != nil {
+		t.Errorf("Valid pay-to-pubkey-hash witness rejected: %s", err)
+	}
+
+	other := createWallet()
+	witness = fmt.Sprintf("%x %x", sig, publicKeyBytes(other.key))
+	if err := evalScript(witness, w.script, scriptContext{sigHash: msg}); err == nil {
+		t.Error("Witness with the wrong public key was accepted")
+	}
+}
+
+func TestEvalMultisig(t *testing.T) {
+	a, b, c := createWallet(), createWallet(), createWallet()
+	msg := []byte("transaction hash")
+	script := multisigScript(2, publicKeyBytes(a.key), publicKeyBytes(b.key), publicKeyBytes(c.key))
+
+	sigA, _ := sign(a.key, msg)
+	sigC, _ := sign(c.key, msg)
+
+	if err := evalScript(fmt.Sprintf("%x %x", sigA, sigC), script, scriptContext{sigHash: msg}); err != nil {
+		t.Errorf("2 of 3 multisig rejected: %s", err)
+	}
+	if err := evalScript(fmt.Sprintf("%x %x", sigC, sigA), script, scriptContext{sigHash: msg}); err == nil {
+		t.Error("Multisig with signatures out of order was accepted")
+	}
+	if err := evalScript(fmt.Sprintf("%x %x", sigA, sigA), script, scriptContext{sigHash: msg}); err == nil {
+		t.Error("Multisig with a signature used twice was accepted")
+	}
+}
+
+func TestEvalHashlockAndTimelock(t *testing.T) {
+	preimage := []byte("secret")
+	h := sha256.Sum256(preimage)
+	// spendable with the preimage, or by anyone after block 10
+	script := fmt.Sprintf("OP_IF OP_SHA256 %x OP_EQUAL OP_ELSE %s OP_CHECKLOCKTIMEVERIFY OP_DROP OP_TRUE OP_ENDIF", h, scriptNumberToken(10))
+
+	if err := evalScript(hex.EncodeToString(preimage)+" OP_TRUE", script, scriptContext{lockTime: 1}); err != nil {
+		t.Errorf("Hashlock with the right preimage rejected: %s", err)
+	}
+	if err := evalScript(hex.EncodeToString([]byte("wrong"))+" OP_TRUE", script, scriptContext{lockTime: 1}); err == nil {
+		t.Error("Hashlock with the wrong preimage accepted")
+	}
+	if err := evalScript("OP_FALSE", script, scriptContext{lockTime: 9}); err == nil {
+		t.Error("Timelock accepted before block 10")
+	}
+	if err := evalScript("OP_FALSE", script, scriptContext{lockTime: lockTimeThreshold + 10}); err == nil {
+		t.Error("Timelock on a block index accepted with a timestamp locktime")
+	}
+	if err := evalScript("OP_FALSE", script, scriptContext{lockTime: 10}); err != nil {
+		t.Errorf("Timelock rejected at block 10: %s", err)
+	}
+}
+
+func TestEvalLimits(t *testing.T) {
+	if err := evalScript("OP_DUP", "OP_TRUE", scriptContext{}); err == nil {
+		t.Error("Witness with an opcode other than a push was accepted")
+	}
+	if err := evalScript("", strings.Repeat("OP_1 OP_DROP ", maxScriptSteps)+"OP_1", scriptContext{}); err == nil {
+		t.Error("Script exceeding the step limit was accepted")
+	}
+	if err := evalScript("", "OP_1 OP_IF OP_1", scriptContext{}); err == nil {
+		t.Error("Script with an unbalanced OP_IF was accepted")
+	}
+	if err := evalScript("", "OP_UNKNOWN", scriptContext{}); err == nil {
+		t.Error("Script with an unknown opcode was accepted")
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// simNetwork runs a network of nodes in one process. Every node serves it's API on a test server and accepts
+// peer connections through a proxy, which can cut the link between two nodes (a partition), delay messages
+// and drop them.
+type simNetwork struct {
+	sync.Mutex
+	t      *testing.T
+	nodes  []*simNode
+	links  map[[2]int]*simLink
+	random *rand.Rand
+}
+
+// simNode is a node of the network
+type simNode struct {
+	*testChain
+	api      *httptest.Server
+	listener net.Listener // accepts the peer connections of the node
+	proxy    net.Listener // the peer address of the node, other nodes connect through it
+}
+
+// simLink is the link between two nodes
+type simLink struct {
+	down    bool
+	latency time.Duration // of every message
+	drop    float64       // the chance a message is dropped
+	conns   []net.Conn    // the proxied connections
+}
+
+// newSimNetwork starts n nodes on the same chain, they don't know each other yet.
+// The global chain is set to the first node, for the code that still uses it.
+func newSimNetwork(t *testing.T, n int) *simNetwork {
+	sim := &simNetwork{t: t, links: make(map[[2]int]*simLink), random: rand.New(rand.NewSource(1))}
+	first := newTestChain("sim-0")
+	for i := 0; i < n; i++ {
+		c := first
+		if i > 0 {
+			c = forkTestChain(first, fmt.Sprintf("sim-%d", i))
+		}
+		node := &simNode{testChain: c, api: c.server()}
+		var err error
+		if node.listener, err = net.Listen("tcp", "127.0.0.1:0"); err == nil {
+			node.proxy, err = net.Listen("tcp", "127.0.0.1:0")
+		}
+		if err != nil {
+			t.Fatalf("Could not listen: %s", err)
+		}
+		c.me = c.nodeAt(node.api)
+		c.me.P2PPort = uint16(node.proxy.Addr().(*net.TCPAddr).Port)
+		c.nodes = initNodes()
+		c.nodes.addNode(&c.me)
+		c.bind()
+		go c.nodes.listenPeers(node.listener, c.bc, c.me)
+		sim.nodes = append(sim.nodes, node)
+	}
+	for i := range sim.nodes {
+		go sim.serveProxy(i) // once all nodes are made, the proxies look them up
+	}
+	first.use()
+	t.Cleanup(sim.close)
+	return sim
+}
+
+// close stops all nodes
+func (sim *simNetwork) close() {
+	sim.Lock()
+	for _, link := range sim.links {
+		for _, conn := range link.conns {
+			conn.Close()
+		}
+	}
+	sim.Unlock()
+	for _, node := range sim.nodes {
+		node.proxy.Close()
+		node.listener.Close()
+		node.api.Close()
+	}
+}
+
+// link returns the link between two nodes
+func (sim *simNetwork) link(i, j int) *simLink {
+	if i > j {
+		i, j = j, i
+	}
+	sim.Lock()
+	defer sim.Unlock()
+	link, ok := sim.links[[2]int{i, j}]
+	if !ok {
+		link = &simLink{}
+		sim.links[[2]int{i, j}] = link
+	}
+	return link
+}
+
+// indexOf returns the index of the node at the address, -1 if there is none
+func (sim *simNetwork) indexOf(address string) int {
+	for i, node := range sim.nodes {
+		if node.me.getAddress() == address {
+			return i
+		}
+	}
+	return -1
+}
+
+// serveProxy accepts the connections to the peer address of a node, until the proxy is closed
+func (sim *simNetwork) serveProxy(to int) {
+	for {
+		in, err := sim.nodes[to].proxy.Accept()
+		if err != nil {
+			return
+		}
+		go sim.proxyConn(in, to)
+	}
+}
+
+// proxyConn passes the messages of a connection on to the node. The challenges of both sides are passed on
+// first, then the greeting tells which node connects.
+func (sim *simNetwork) proxyConn(in net.Conn, to int) {
+	out, err := net.Dial("tcp", sim.nodes[to].listener.Addr().String())
+	if err != nil {
+		in.Close()
+		return
+	}
+	var handshake Message
+	var g Greeting
+	if err = forward(in, out); err == nil {
+		err = forward(out, in)
+	}
+	if err == nil {
+		handshake, err = readMessage(in)
+	}
+	if err == nil {
+		err = json.Unmarshal(handshake.Payload, &g)
+	}
+	from := sim.indexOf(g.getAddress())
+	if err != nil || from < 0 {
+		in.Close()
+		out.Close()
+		return
+	}
+	link := sim.link(from, to)
+	sim.Lock()
+	down := link.down
+	link.conns = append(link.conns, in, out)
+	sim.Unlock()
+	if down || writeMessage(out, handshake) != nil {
+		in.Close()
+		out.Close()
+		return
+	}
+	go sim.pump(in, out, link)
+	go sim.pump(out, in, link)
+}
+
+// forward passes a single message from one connection to the other
+func forward(src, dst net.Conn) error {
+	msg, err := readMessage(src)
+	if err == nil {
+		err = writeMessage(dst, msg)
+	}
+	return err
+}
+
+// pump passes the messages from one side of a link to the other, delayed or dropped as the link says
+func (sim *simNetwork) pump(src, dst net.Conn, link *simLink) {
+	defer src.Close()
+	defer dst.Close()
+	for {
+		msg, err := readMessage(src)
+		if err != nil {
+			return
+		}
+		sim.Lock()
+		down, latency, drop := link.down, link.latency, sim.random.Float64() < link.drop
+		sim.Unlock()
+		if down {
+			return
+		}
+		time.Sleep(latency)
+		if drop && msg.Type != msgHandshake && msg.Type != msgReject {
+			continue
+		}
+		if writeMessage(dst, msg) != nil {
+			return
+		}
+	}
+}
+
+// connect makes two nodes known to each other and connects them, i dials j
+func (sim *simNetwork) connect(i, j int) {
+	a, b := sim.nodes[i], sim.nodes[j]
+	connect(a.testChain, b.testChain)
+	if err := a.nodes.dialPeer(b.me, a.bc, a.me); err != nil {
+		sim.t.Fatalf("Could not connect node %d to node %d: %s", i, j, err)
+	}
+	if !waitFor(func() bool { _, ok := b.nodes.connection(a.me); return ok }) {
+		sim.t.Fatalf("Connection of node %d not accepted by node %d", i, j)
+	}
+}
+
+// connectAll connects every node with every other node
+func (sim *simNetwork) connectAll() {
+	for i := range sim.nodes {
+		for j := i + 1; j < len(sim.nodes); j++ {
+			sim.connect(i, j)
+		}
+	}
+}
+
+// partition cuts the links between the groups of nodes; the nodes are disconnected and forget each other
+func (sim *simNetwork) partition(groups ...[]int) {
+	group := make(map[int]int)
+	for g, members := range groups {
+		for _, i := range members {
+			group[i] = g
+		}
+	}
+	for i := range sim.nodes {
+		for j := i + 1; j < len(sim.nodes); j++ {
+			if group[i] == group[j] {
+				continue
+			}
+			link := sim.link(i, j)
+			sim.Lock()
+			link.down = true
+			for _, conn := range link.conns {
+				conn.Close()
+			}
+			link.conns = nil
+			sim.Unlock()
+			sim.nodes[i].nodes.removeNode(sim.nodes[j].me.getAddress())
+			sim.nodes[j].nodes.removeNode(sim.nodes[i].me.getAddress())
+		}
+	}
+}
+
+// heal restores the links that are cut and connects the nodes again
+func (sim *simNetwork) heal() {
+	for i := range sim.nodes {
+		for j := i + 1; j < len(sim.nodes); j++ {
+			link := sim.link(i, j)
+			sim.Lock()
+			down := link.down
+			link.down = false
+			sim.Unlock()
+			if down {
+				sim.connect(i, j)
+			}
+		}
+	}
+}
+
+// setLatency delays every message between two nodes
+func (sim *simNetwork) setLatency(i, j int, latency time.Duration) {
+	link := sim.link(i, j)
+	sim.Lock()
+	link.latency = latency
+	sim.Unlock()
+}
+
+// setDrop drops messages between two nodes with the given chance
+func (sim *simNetwork) setDrop(i, j int, chance float64) {
+	link := sim.link(i, j)
+	sim.Lock()
+	link.drop = chance
+	sim.Unlock()
+}
+
+// mine mines a block on a node, which announces it to it's peers
+func (sim *simNetwork) mine(i int) Block {
+	block, err := sim.nodes[i].bc.mine()
+	if err != nil {
+		sim.t.Fatalf("Could not mine on node %d: %s", i, err)
+	}
+	return block
+}
+
+// tip returns the hash of the last block of a node
+func (sim *simNetwork) tip(i int) string {
+	chain := sim.nodes[i].bc
+	chain.Lock()
+	defer chain.Unlock()
+	return hash(chain.lastBlock())
+}
+
+// converged tells if the nodes have the same last block, all nodes if none are given
+func (sim *simNetwork) converged(nodes ...int) bool {
+	if len(nodes) == 0 {
+		for i := range sim.nodes {
+			nodes = append(nodes, i)
+		}
+	}
+	for _, i := range nodes[1:] {
+		if sim.tip(i) != sim.tip(nodes[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// waitConverged waits until the nodes have the same last block, all nodes if none are given
+func (sim *simNetwork) waitConverged(nodes ...int) {
+	if !waitFor(func() bool { return sim.converged(nodes...) }) {
+		for i, node := range sim.nodes {
+			sim.t.Logf("Node %d: length %d, tip %s", i, len(node.bc.Chain), sim.tip(i))
+		}
+		sim.t.Fatalf("Nodes %v did not converge", nodes)
+	}
+}
+
+func TestSimConverge(t *testing.T) {
+	saveGlobals(t)
+
+	sim := newSimNetwork(t, 4)
+	sim.connectAll()
+	sim.mine(2)
+	sim.waitConverged()
+	block := sim.mine(0)
+	sim.waitConverged()
+	if sim.tip(3) != hash(block) {
+		t.Error("Nodes should converge on the last block mined")
+	}
+}
+
+func TestSimPartition(t *testing.T) {
+	saveGlobals(t)
+
+	sim := newSimNetwork(t, 4)
+	sim.connectAll()
+	sim.partition([]int{0, 1}, []int{2, 3})
+
+	// both sides mine their own chain, the side of node 0 the longest
+	sim.mine(0)
+	sim.waitConverged(0, 1)
+	block := sim.mine(1)
+	sim.waitConverged(0, 1)
+	sim.mine(3)
+	sim.waitConverged(2, 3)
+	if sim.converged(1, 2) {
+		t.Fatal("Partitioned nodes should not converge")
+	}
+
+	// once healed, the nodes sync with the longest chain when they connect
+	sim.heal()
+	sim.waitConverged()
+	if sim.tip(2) != hash(block) {
+		t.Error("Nodes should converge on the longest chain")
+	}
+}
+
+func TestSimLatencyAndDrop(t *testing.T) {
+	saveGlobals(t)
+
+	// a line of nodes 0 - 1 - 2
+	sim := newSimNetwork(t, 3)
+	sim.connect(0, 1)
+	sim.connect(1, 2)
+
+	// a block takes an inv, getdata and block message to reach a peer
+	latency := 100 * time.Millisecond
+	sim.setLatency(0, 1, latency)
+	start := time.Now()
+	sim.mine(0)
+	sim.waitConverged()
+	if elapsed := time.Since(start); elapsed < 3*latency {
+		t.Errorf("Expected the block to take at least %s, took %s", 3*latency, elapsed)
+	}
+
+	// node 2 misses blocks while messages are dropped, and catches up once they are not
+	sim.setLatency(0, 1, 0)
+	sim.setDrop(1, 2, 1)
+	sim.mine(0)
+	sim.mine(0)
+	sim.waitConverged(0, 1)
+	if sim.converged(1, 2) {
+		t.Fatal("Node 2 should miss the blocks while messages are dropped")
+	}
+	sim.setDrop(1, 2, 0)
+	sim.mine(0)
+	sim.waitConverged()
+}
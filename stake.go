@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Wallets lock coins in a stake to lead slots of a proof of stake chain. A stake transaction moves coins from
+// the wallet to the stake address, for a key that signs the blocks. An unstake transaction, signed with that
+// key, moves the coins back to the wallet; only stakeUnbonding blocks after the last block the key signed, so
+// there is time to prove the key signed two blocks for one slot. With such evidence, a slash transaction burns
+// the stake, and the key can't stake again.
+
+// The address that holds the staked coins, no script unlocks it
+var stakeAddress = fmt.Sprintf("%x", sha256.Sum256([]byte("stake")))
+
+// The number of blocks after the last block a key signed, before it's stake can be unstaked
+const stakeUnbonding = 100
+
+// StakeUpdate stakes coins, unstakes them or slashes a stake; the Sender is the stake address for an unstake or slash.
+type StakeUpdate struct {
+	Action   string        `json:"action"`             // stake, unstake or slash
+	Key      string        `json:"key"`                // public key that signs the blocks of the stake
+	Evidence []BlockHeader `json:"evidence,omitempty"` // two headers of one slot, signed by the key (slash)
+}
+
+// Stake is the stake of a key
+type Stake struct {
+	Key     string  `json:"key"`
+	Wallet  string  `json:"wallet"`
+	Amount  float64 `json:"amount"`
+	Slashed bool    `json:"slashed"`
+}
+
+// stakes returns the stakes by key in the blocks and transactions given
+func stakes(chain []Block, transactions []Transaction) map[string]*Stake {
+	stakes := make(map[string]*Stake)
+	add := func(tr Transaction) {
+		if tr.Stake == nil || tr.payloads() > 1 {
+			return // not checked as a stake update, see checkStakeTransaction
+		}
+		stake, ok := stakes[tr.Stake.Key]
+		if !ok {
+			stake = &Stake{Key: tr.Stake.Key, Wallet: tr.Sender}
+			stakes[tr.Stake.Key] = stake
+		}
+		switch tr.Stake.Action {
+		case "stake":
+			stake.Amount += tr.Amount
+		case "unstake":
+			stake.Amount = 0
+		case "slash":
+			stake.Amount, stake.Slashed = 0, true
+		}
+	}
+	for _, block := range chain {
+		for _, tr := range block.Transactions {
+			add(tr)
+		}
+	}
+	for _, tr := range transactions {
+		add(tr)
+	}
+	return stakes
+}
+
+// lastSigned returns the index of the last block signed by the key, 0 if it signed none
+func lastSigned(key string, chain []Block) int64 {
+	for i := len(chain) - 1; i >= 0; i-- {
+		if chain[i].Signer == key {
+			return chain[i].Index
+		}
+	}
+	return 0
+}
+
+// checkDoubleSign checks that the evidence are two headers of one slot, signed by the key.
+// The headers should differ in what is signed, not only in the encoding of the signature.
+func checkDoubleSign(key string, evidence []BlockHeader) error {
+	if len(evidence) != 2 || evidence[0].Slot != evidence[1].Slot || sealHash(evidence[0]) == sealHash(evidence[1]) {
+		return errors.New("invalid evidence (not two headers of one slot)")
+	}
+	pub, err := hex.DecodeString(key)
+	if err != nil {
+		return errors.New("invalid evidence (invalid key)")
+	}
+	for _, h := range evidence {
+		sig, err := decodeSignature(h.Signature)
+		if h.Signer != key || err != nil || !verifySignature(pub, []byte(sealHash(h)), sig) {
+			return errors.New("invalid evidence (header not signed by the key)")
+		}
+	}
+	return nil
+}
+
+// checkStakeTransaction checks a stake, unstake or slash, which is placed after the given blocks and
+// transactions in the block with the given index. The coins of the stake address can only be moved by these.
+func checkStakeTransaction(tr Transaction, chain []Block, transactions []Transaction, index int64) error {
+	u := tr.Stake
+	if u == nil {
+		return errors.New("invalid stake (the stake address is locked)")
+	}
+	if !validPublicKey(u.Key) {
+		return errors.New("invalid stake (the key is not a public key)")
+	}
+	stake, staked := stakes(chain, transactions)[u.Key]
+
+	switch u.Action {
+	case "stake":
+		if tr.Recipient != stakeAddress || tr.Amount <= 0 || tr.Token != "" {
+			return errors.New("invalid stake (coins should be staked to the stake address)")
+		}
+		if staked && (stake.Slashed || stake.Wallet != tr.Sender) {
+			return errors.New("invalid stake (the key is slashed or staked by another wallet)")
+		}
+		return checkTransactionScript(tr)
+	case "unstake":
+		if tr.Sender != stakeAddress || !staked || stake.Slashed || stake.Amount == 0 {
+			return errors.New("invalid stake (no stake of the key)")
+		}
+		if tr.Recipient != stake.Wallet || math.Abs(tr.Amount-stake.Amount) > 1e-8 {
+			return errors.New("invalid stake (the stake should be unstaked to it's wallet)")
+		}
+		if index-lastSigned(u.Key, chain) <= stakeUnbonding {
+			return fmt.Errorf("invalid stake (the key signed a block less than %d blocks ago)", stakeUnbonding)
+		}
+		pub, _ := hex.DecodeString(u.Key)
+		sig, err := hex.DecodeString(tr.Witness)
+		if err != nil || !verifySignature(pub, tr.sigHash(), sig) {
+			return errors.New("invalid stake (unstake not signed by the key)")
+		}
+		return nil
+	case "slash":
+		// the stakers at the genesis block can be slashed as well, without coins
+		var amount float64
+		if staked {
+			amount = stake.Amount
+		}
+		if tr.Sender != stakeAddress || (staked && stake.Slashed) {
+			return errors.New("invalid stake (the key is slashed already)")
+		}
+		if tr.Recipient != zerohash || math.Abs(tr.Amount-amount) > 1e-8 {
+			return errors.New("invalid stake (the whole stake should be burned)")
+		}
+		return checkDoubleSign(u.Key, u.Evidence)
+	}
+	return fmt.Errorf("invalid stake (unknown action %s)", u.Action)
+}
+
+// slashTransaction returns the transaction that slashes the stake of the key with the evidence
+func slashTransaction(key string, evidence []BlockHeader, chain []Block, transactions []Transaction) Transaction {
+	var amount float64
+	if stake, ok := stakes(chain, transactions)[key]; ok {
+		amount = stake.Amount
+	}
+	return Transaction{
+		Sender:    stakeAddress,
+		Recipient: zerohash,
+		Amount:    amount,
+		Message:   "Slashed for signing two blocks in one slot",
+		Stake:     &StakeUpdate{Action: "slash", Key: key, Evidence: evidence},
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/grrrben/glog"
+)
+
+// Chains are synced headers first; the headers of a peer's chain are downloaded and validated,
+// starting at the fork point found with a locator. Only if the consensus engine prefers the chain of the headers
+// over ours, the blocks themselves are fetched, in batches from multiple peers at the same time.
+
+// The maximum number of headers served per request
+const maxHeadersPerRequest = 500
+
+// The number of blocks fetched per request
+const blocksPerRequest = 16
+
+// The maximum number of blocks served per locator request
+const maxBlocksPerLocator = 100
+
+// The number of requests for blocks that run at the same time
+const maxParallelRequests = 4
+
+// SyncReport shows the progress of syncing the chain.
+type SyncReport struct {
+	State   string `json:"state"` // idle, headers or blocks
+	Peer    string `json:"peer"`
+	Headers int    `json:"headers"` // the number of headers downloaded
+	Blocks  int    `json:"blocks"`  // the number of blocks downloaded
+	Target  int64  `json:"target"`  // the length of the chain that is synced
+}
+
+var syncStatus = struct {
+	sync.Mutex
+	report SyncReport
+}{report: SyncReport{State: "idle"}}
+
+// syncReport returns the current progress of syncing
+func syncReport() SyncReport {
+	syncStatus.Lock()
+	defer syncStatus.Unlock()
+	return syncStatus.report
+}
+
+// updateSyncReport changes the progress of syncing
+func updateSyncReport(update func(report *SyncReport)) {
+	syncStatus.Lock()
+	update(&syncStatus.report)
+	syncStatus.Unlock()
+}
+
+// locator returns hashes of blocks of the chain, starting at the last block. The first ten are
+// consecutive, after that the steps double. The hash of the genesis block is always the last.
+// A peer finds the fork point of both chains with it, the first hash it knows.
+func (bc *Blockchain) locator() []string {
+	var hashes []string
+	step := 1
+	for i := len(bc.Chain) - 1; i > 0; i -= step {
+		hashes = append(hashes, hash(bc.Chain[i]))
+		if len(hashes) >= 10 {
+			step *= 2
+		}
+	}
+	if len(bc.Chain) > 0 {
+		hashes = append(hashes, hash(bc.Chain[0]))
+	}
+	return hashes
+}
+
+// findFork returns the position in the chain of the first hash of the locator that is part of this chain.
+// Returns -1 if none of the hashes is known. The chain should be locked.
+func (bc *Blockchain) findFork(locator []string) int {
+	return bc.blockIndex().find(bc.Chain, locator)
+}
+
+// blockIndex holds the positions of the blocks of a chain by their hash, so a block is found without hashing
+// the whole chain. It follows the chain as it grows or is replaced; only the blocks after the last position
+// that still matches are hashed.
+type blockIndex struct {
+	sync.Mutex
+	hashes    []string       // by position
+	positions map[string]int // by hash
+}
+
+func newBlockIndex() *blockIndex {
+	return &blockIndex{positions: make(map[string]int)}
+}
+
+// blockIndex returns the index of the chain
+func (bc *Blockchain) blockIndex() *blockIndex {
+	if bc.index == nil {
+		bc.index = newBlockIndex()
+	}
+	return bc.index
+}
+
+// update makes the index match the chain. A block covers the hash of it's parent, so if the hash at a position
+// matches, so do the hashes before it. The index should be locked.
+func (idx *blockIndex) update(chain []Block) {
+	n := len(idx.hashes)
+	if n > len(chain) {
+		n = len(chain)
+	}
+	for n > 0 && idx.hashes[n-1] != hash(chain[n-1]) {
+		n--
+	}
+	if n == len(chain) {
+		return // the chain is (a part of) the indexed chain
+	}
+	for _, h := range idx.hashes[n:] {
+		delete(idx.positions, h)
+	}
+	idx.hashes = idx.hashes[:n]
+	for _, bl := range chain[n:] {
+		idx.positions[hash(bl)] = len(idx.hashes)
+		idx.hashes = append(idx.hashes, hash(bl))
+	}
+}
+
+// position returns the position of the block with the hash in the chain, or -1 if it is not part of it.
+// The index should be locked and match the chain.
+func (idx *blockIndex) position(chain []Block, h string) int {
+	if i, ok := idx.positions[h]; ok && i < len(chain) {
+		return i
+	}
+	return -1
+}
+
+// find returns the position in the chain of the first hash of the locator that is part of the chain
+func (idx *blockIndex) find(chain []Block, locator []string) int {
+	idx.Lock()
+	defer idx.Unlock()
+	idx.update(chain)
+	for _, h := range locator {
+		if i := idx.position(chain, h); i >= 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// headersAfter returns at most max headers that follow the fork point of the locator.
+func (bc *Blockchain) headersAfter(locator []string, max int) []BlockHeader {
+	headers := []BlockHeader{}
+	for i := bc.findFork(locator) + 1; i < len(bc.Chain) && len(headers) < max; i++ {
+		headers = append(headers, bc.Chain[i].header())
+	}
+	return headers
+}
+
+// blocksAfter returns the position of the fork point of the locator and at most max blocks that follow it.
+func (bc *Blockchain) blocksAfter(locator []string, max int) (int, []Block) {
+	fork := bc.findFork(locator)
+	blocks := []Block{}
+	for i := fork + 1; i < len(bc.Chain) && len(blocks) < max; i++ {
+		blocks = append(blocks, bc.Chain[i])
+	}
+	return fork, blocks
+}
+
+// blocksByHash returns the blocks of the chain with the given hashes, in the same order.
+// Unknown hashes are skipped.
+func (bc *Blockchain) blocksByHash(hashes []string) []Block {
+	blocks := []Block{}
+	for _, h := range hashes {
+		if i := bc.findFork([]string{h}); i >= 0 {
+			blocks = append(blocks, bc.Chain[i])
+		}
+	}
+	return blocks
+}
+
+// validateHeaders checks that the headers follow each other and the previous header, and their proofs.
+// prev is nil if the headers start with a genesis block.
+func (bc *Blockchain) validateHeaders(prev *BlockHeader, headers []BlockHeader) error {
+	first := prev
+	verifier, sequential := bc.consensus().(headerVerifier)
+	for _, h := range headers {
+		if prev == nil {
+			if h.Index != 1 || h.PreviousHash != zerohash {
+				return errors.New("invalid header (not a genesis block)")
+			}
+		} else {
+			if h.Index != prev.Index+1 || h.PreviousHash != prev.hash() {
+				return fmt.Errorf("invalid header (block %d does not follow block %d)", h.Index, prev.Index)
+			}
+			if !sequential {
+				if err := bc.consensus().verifySeal(*prev, h); err != nil {
+					return fmt.Errorf("invalid header (%s)", err)
+				}
+			}
+		}
+		if err := bc.finalityRules().checkHeader(h); err != nil {
+			return err
+		}
+		if err := bc.checkFutureTime(h); err != nil {
+			return fmt.Errorf("invalid header (%s)", err)
+		}
+		current := h
+		prev = &current
+	}
+	if sequential && len(headers) > 0 {
+		// each seal depends on the ones before it, e.g. the signers after them, which are not kept yet
+		parent, rest := headers[0], headers[1:]
+		if first != nil {
+			parent, rest = *first, headers
+		}
+		if err := verifier.verifyHeaders(parent, rest); err != nil {
+			return fmt.Errorf("invalid header (%s)", err)
+		}
+	}
+	return nil
+}
+
+// fetchHeaders requests the headers after the fork point of the locator from a node
+func fetchHeaders(node Node, locator []string) ([]BlockHeader, error) {
+	var resp struct {
+		Headers []BlockHeader `json:"headers"`
+	}
+	url := fmt.Sprintf("%s/headers?locator=%s", node.getAddress(), strings.Join(locator, ","))
+	r, err := httpClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	err = json.NewDecoder(r.Body).Decode(&resp)
+	return resp.Headers, err
+}
+
+// fetchBlocks requests the blocks with the given hashes from a node
+func fetchBlocks(node Node, hashes []string) ([]Block, error) {
+	var resp struct {
+		Blocks []Block `json:"blocks"`
+	}
+	payload, err := json.Marshal(map[string]interface{}{"hashes": hashes})
+	if err != nil {
+		return nil, err
+	}
+	r, err := httpClient.Post(fmt.Sprintf("%s/blocks", node.getAddress()), "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	err = json.NewDecoder(r.Body).Decode(&resp)
+	return resp.Blocks, err
+}
+
+// fetchBlocksAfter requests the blocks after the fork point of the locator from the node at the address.
+// Returns the hash of the fork point and the blocks.
+func fetchBlocksAfter(address string, locator []string) (string, []Block, error) {
+	var resp struct {
+		Fork   string  `json:"fork"`
+		Blocks []Block `json:"blocks"`
+	}
+	payload, err := json.Marshal(map[string]interface{}{"locator": locator})
+	if err != nil {
+		return "", nil, err
+	}
+	r, err := httpClient.Post(fmt.Sprintf("%s/blocks/locator", address), "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return "", nil, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("no common block (status %d)", r.StatusCode)
+	}
+	err = json.NewDecoder(r.Body).Decode(&resp)
+	return resp.Fork, resp.Blocks, err
+}
+
+// sync replaces the chain with a longer valid chain of a node in the network.
+// Returns true if the chain is replaced.
+func (bc *Blockchain) sync() bool {
+	defer updateSyncReport(func(report *SyncReport) { *report = SyncReport{State: "idle"} })
+
+	lengths := bc.chainLengthPerNode()
+	var peers []Node
+	for _, pair := range lengths {
+		peers = append(peers, pair.Key.(Node))
+	}
+	for _, pair := range lengths {
+		if pair.Value <= bc.length() {
+			break // sorted by length, the rest is not longer
+		}
+		if bc.syncWith(pair.Key.(Node), peers) {
+			return true
+		}
+	}
+	return false
+}
+
+// syncWith downloads the headers of the chain of a node, and if the consensus engine prefers their chain the
+// blocks, from the node and the other peers. Returns true if the chain is replaced.
+func (bc *Blockchain) syncWith(node Node, peers []Node) bool {
+	updateSyncReport(func(report *SyncReport) {
+		*report = SyncReport{State: "headers", Peer: node.getAddress()}
+	})
+
+	var headers []BlockHeader
+	bc.Lock()
+	locator := bc.locator()
+	bc.Unlock()
+	for {
+		batch, err := fetchHeaders(node, locator)
+		if err != nil {
+			glog.Warningf("Could not fetch headers from %s: %s", node.getAddress(), err)
+			return false
+		}
+		headers = append(headers, batch...)
+		updateSyncReport(func(report *SyncReport) { report.Headers = len(headers) })
+		if len(batch) < maxHeadersPerRequest {
+			break
+		}
+		locator = []string{batch[len(batch)-1].hash()}
+	}
+	if len(headers) == 0 {
+		return false
+	}
+
+	fork, err := bc.checkHeaders(node.getAddress(), headers)
+	if err != nil {
+		glog.Warningf("Headers of %s are not accepted: %s", node.getAddress(), err)
+		return false
+	}
+	target := int64(fork + 1 + len(headers))
+
+	updateSyncReport(func(report *SyncReport) {
+		report.State = "blocks"
+		report.Target = target
+	})
+	blocks, err := downloadBlocks(headers, append([]Node{node}, peers...))
+	if err != nil {
+		glog.Warningf("Could not download blocks: %s", err)
+		return false
+	}
+
+	candidate, err := bc.candidateAfter(headers[0].PreviousHash, blocks, node.getAddress())
+	if err != nil {
+		glog.Warningf("Chain of %s is not accepted: %s", node.getAddress(), err)
+		return false
+	}
+	if !candidate.validate() {
+		glog.Warningf("Chain of %s is invalid", node.getAddress())
+		return false
+	}
+
+	if !bc.replaceChain(candidate, blocks) {
+		return false
+	}
+	glog.Infof("Synced with %s\n", node.getAddress())
+	return true
+}
+
+// checkHeaders checks the headers of the chain of a peer, which start after the fork point or at a genesis block.
+// The consensus engine should prefer them and the finality rules should allow the reorg. Returns the fork point,
+// -1 for headers that start at a genesis block. The chain is locked while the headers are checked.
+func (bc *Blockchain) checkHeaders(peer string, headers []BlockHeader) (int, error) {
+	bc.Lock()
+	defer bc.Unlock()
+	fork := bc.findFork([]string{headers[0].PreviousHash})
+	var prev *BlockHeader
+	if fork >= 0 {
+		forkHeader := bc.Chain[fork].header()
+		prev = &forkHeader
+	} else if headers[0].PreviousHash != zerohash {
+		return fork, errors.New("the headers do not connect to the chain")
+	}
+	if err := bc.validateHeaders(prev, headers); err != nil {
+		return fork, err
+	}
+	if !bc.consensus().forkChoice(blockHeaders(bc.Chain[fork+1:]), headers) {
+		return fork, errors.New("the chain is not preferred")
+	}
+	return fork, bc.finalityRules().checkReorg(bc.Chain, fork, peer, headers[len(headers)-1])
+}
+
+// downloadBlocks fetches the blocks of the headers in batches, spread over the peers.
+// A batch that fails is retried with the next peer. The blocks should match their headers.
+func downloadBlocks(headers []BlockHeader, peers []Node) ([]Block, error) {
+	blocks := make([]Block, len(headers))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed error
+	semaphore := make(chan bool, maxParallelRequests)
+
+	for start, batch := 0, 0; start < len(headers); start, batch = start+blocksPerRequest, batch+1 {
+		end := start + blocksPerRequest
+		if end > len(headers) {
+			end = len(headers)
+		}
+		wg.Add(1)
+		go func(start, end, batch int) {
+			defer wg.Done()
+			semaphore <- true
+			defer func() { <-semaphore }()
+
+			hashes := make([]string, 0, end-start)
+			for _, h := range headers[start:end] {
+				hashes = append(hashes, h.hash())
+			}
+			for attempt := 0; attempt < len(peers); attempt++ {
+				peer := peers[(batch+attempt)%len(peers)]
+				fetched, err := fetchBlocks(peer, hashes)
+				if err != nil || len(fetched) != len(hashes) {
+					glog.Warningf("Could not fetch blocks %d to %d from %s", headers[start].Index, headers[end-1].Index, peer.getAddress())
+					continue
+				}
+				valid := true
+				for i, bl := range fetched {
+					valid = valid && hash(bl) == hashes[i]
+				}
+				if !valid {
+					glog.Warningf("Blocks from %s do not match their headers", peer.getAddress())
+					continue
+				}
+				copy(blocks[start:end], fetched)
+				updateSyncReport(func(report *SyncReport) { report.Blocks += len(fetched) })
+				return
+			}
+			mu.Lock()
+			failed = fmt.Errorf("no peer served blocks %d to %d", headers[start].Index, headers[end-1].Index)
+			mu.Unlock()
+		}(start, end, batch)
+	}
+	wg.Wait()
+	return blocks, failed
+}
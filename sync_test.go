@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSyncHeadersFirst(t *testing.T) {
+	saveGlobals(t)
+
+	a := newTestChain("sync-a")
+	a.mine(t)
+	b := forkTestChain(a, "sync-b")
+	a.mine(t) // a forks off after block 2
+	for i := 0; i < 2*blocksPerRequest+3; i++ {
+		b.mine(t)
+	}
+	c := forkTestChain(b, "sync-c")
+
+	serverB, serverC := b.server(), c.server()
+	defer serverB.Close()
+	defer serverC.Close()
+	nodeB, nodeC := serverNode(serverB), serverNode(serverC)
+	a.nodes.addNode(&nodeB)
+	a.nodes.addNode(&nodeC)
+
+	a.use()
+	if !bc.resolve() {
+		t.Fatal("Chain was not replaced by the longer chain")
+	}
+	if len(a.bc.Chain) != len(b.bc.Chain) || hash(a.bc.lastBlock()) != hash(b.bc.lastBlock()) {
+		t.Errorf("Synced chain differs, got length %d, expected %d", len(a.bc.Chain), len(b.bc.Chain))
+	}
+	if report := syncReport(); report.State != "idle" {
+		t.Errorf("Sync should be idle after syncing, got %s", report.State)
+	}
+	if bc.resolve() {
+		t.Error("Chain was replaced by a chain of the same length")
+	}
+}
+
+func TestLocator(t *testing.T) {
+	chain := &Blockchain{}
+	for i := int64(1); i <= 30; i++ {
+		chain.Chain = append(chain.Chain, Block{Index: i, Timestamp: i})
+	}
+	locator := chain.locator()
+	if locator[0] != hash(chain.Chain[29]) || locator[len(locator)-1] != hash(chain.Chain[0]) {
+		t.Error("Locator should start at the last block and end with the genesis block")
+	}
+	if len(locator) >= 20 {
+		t.Errorf("Locator should be spaced exponentially, got %d hashes for 30 blocks", len(locator))
+	}
+	if fork := chain.findFork([]string{"unknown", hash(chain.Chain[4])}); fork != 4 {
+		t.Errorf("Expected the fork at position 4, got %d", fork)
+	}
+	if headers := chain.headersAfter([]string{hash(chain.Chain[27])}, 10); len(headers) != 2 || headers[0].Index != 29 {
+		t.Errorf("Expected the headers of blocks 29 and 30, got %v", headers)
+	}
+
+	// the index follows the chain when it's replaced by a fork, or when a part of it is searched
+	old := hash(chain.Chain[29])
+	fork := Block{Index: 30, Timestamp: 100, PreviousHash: hash(chain.Chain[28])}
+	chain.Chain = append(append([]Block{}, chain.Chain[:29]...), fork)
+	if chain.findFork([]string{old}) != -1 || chain.findFork([]string{hash(fork)}) != 29 {
+		t.Error("Index should follow the fork that replaced the last block")
+	}
+	if i := chain.blockIndex().find(chain.Chain[:10], []string{hash(fork), hash(chain.Chain[9])}); i != 9 {
+		t.Errorf("Expected position 9 in the first 10 blocks, got %d", i)
+	}
+	if chain.findFork([]string{hash(fork)}) != 29 {
+		t.Error("Index should still hold the whole chain after a part is searched")
+	}
+}
+
+func TestValidateHeaders(t *testing.T) {
+	saveGlobals(t)
+
+	a := newTestChain("headers")
+	a.mine(t)
+	a.mine(t)
+	var headers []BlockHeader
+	for _, bl := range a.bc.Chain {
+		headers = append(headers, bl.header())
+	}
+	if err := a.bc.validateHeaders(nil, headers); err != nil {
+		t.Errorf("Valid headers rejected: %s", err)
+	}
+
+	headers[2].Proof++
+	if err := a.bc.validateHeaders(nil, headers); err == nil {
+		t.Error("Header with an invalid proof accepted")
+	}
+	headers[2].Proof--
+	headers[1].TransactionsHash = zerohash
+	if err := a.bc.validateHeaders(nil, headers); err == nil {
+		t.Error("Header with changed transactions accepted")
+	}
+}
+
+func TestAnalyseInvalidBlockOnFork(t *testing.T) {
+	saveGlobals(t)
+
+	a := newTestChain("fork-a")
+	a.mine(t)
+	b := forkTestChain(a, "fork-b")
+	a.mine(t)
+	a.mine(t)
+	for i := 0; i < maxBlocksPerLocator+5; i++ {
+		b.mine(t)
+	}
+	serverB := b.server()
+	defer serverB.Close()
+
+	var resp map[string]interface{}
+	code := a.announceBlock(t, b.nodeAt(serverB), b.bc.lastBlock(), &resp)
+	if code != http.StatusAccepted {
+		t.Fatalf("Block of a longer fork was not accepted: %v", resp)
+	}
+	if !waitFor(func() bool { return a.length() == b.length() }) || hash(a.bc.lastBlock()) != hash(b.bc.lastBlock()) {
+		t.Errorf("Chain was not replaced by the fork, got length %d, expected %d", len(a.bc.Chain), len(b.bc.Chain))
+	}
+
+	// a block of a shorter fork is rejected
+	c := forkTestChain(b, "fork-c")
+	c.bc.Chain = c.bc.Chain[:3]
+	c.mine(t)
+	serverC := c.server()
+	defer serverC.Close()
+	code = a.announceBlock(t, c.nodeAt(serverC), c.bc.lastBlock(), &resp)
+	if code != http.StatusConflict || len(a.bc.Chain) != len(b.bc.Chain) {
+		t.Errorf("Block of a shorter fork was accepted")
+	}
+}
+
+func TestBlocksAfterLocator(t *testing.T) {
+	saveGlobals(t)
+
+	a := newTestChain("locator")
+	for i := 0; i < 4; i++ {
+		a.mine(t)
+	}
+	var resp struct {
+		Fork   string  `json:"fork"`
+		Index  int64   `json:"index"`
+		Blocks []Block `json:"blocks"`
+	}
+	code := a.call(t, "POST", "/blocks/locator", map[string]interface{}{
+		"locator": []string{"unknown", hash(a.bc.Chain[2])},
+	}, &resp)
+	if code != http.StatusOK || resp.Fork != hash(a.bc.Chain[2]) || resp.Index != 3 || len(resp.Blocks) != 2 {
+		t.Errorf("Expected the fork at block 3 and 2 blocks, got %d, %d blocks", resp.Index, len(resp.Blocks))
+	}
+
+	code = a.call(t, "POST", "/blocks/locator", map[string]interface{}{"locator": []string{"unknown"}}, nil)
+	if code != http.StatusNotFound {
+		t.Errorf("Expected a 404 for an unknown locator, got %d", code)
+	}
+}
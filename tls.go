@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+)
+
+// A node can serve it's API and peer connections over TLS with a certificate and key, it's Protocol is
+// https:// then. Other nodes are contacted over TLS when their Protocol is https://, their certificates are
+// verified with our CA (or the system's CAs if no CA is set). In mutual TLS mode, nodes and clients should
+// present a certificate signed by our CA as well, so only nodes with such a certificate can join the network.
+
+// TLSSettings are the files and mode of TLS, set by flags
+type TLSSettings struct {
+	CertFile string // certificate of this node
+	KeyFile  string // key of the certificate
+	CAFile   string // CA that signs the certificates of the nodes
+	Mutual   bool   // require a certificate signed by the CA of nodes and clients
+}
+
+// The TLS configuration to serve with, nil to serve plain HTTP
+var serverTLS *tls.Config
+
+// The TLS configuration to contact other nodes with
+var clientTLS *tls.Config
+
+// The client all requests to other nodes are made with
+var httpClient = &http.Client{}
+
+// enabled tells if this node serves over TLS
+func (settings TLSSettings) enabled() bool {
+	return settings.CertFile != "" || settings.KeyFile != ""
+}
+
+// tlsConfigs loads the certificates and returns the configuration to serve with (nil without a certificate)
+// and the configuration to contact other nodes with.
+func (settings TLSSettings) tlsConfigs() (*tls.Config, *tls.Config, error) {
+	client := &tls.Config{MinVersion: tls.VersionTLS12}
+	if settings.CAFile != "" {
+		pem, err := ioutil.ReadFile(settings.CAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("invalid CA (no certificates in %s)", settings.CAFile)
+		}
+		client.RootCAs = pool
+	}
+	if !settings.enabled() {
+		if settings.Mutual {
+			return nil, nil, errors.New("invalid TLS settings (mutual TLS requires a certificate and key)")
+		}
+		return nil, client, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	server := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}
+	if settings.Mutual {
+		if client.RootCAs == nil {
+			return nil, nil, errors.New("invalid TLS settings (mutual TLS requires a CA)")
+		}
+		server.ClientAuth = tls.RequireAndVerifyClientCert
+		server.ClientCAs = client.RootCAs
+		client.Certificates = []tls.Certificate{cert}
+	}
+	return server, client, nil
+}
+
+// setupTLS loads the certificates and sets the configurations to serve with and to contact other nodes with
+func setupTLS(settings TLSSettings) error {
+	server, client, err := settings.tlsConfigs()
+	if err != nil {
+		return err
+	}
+	serverTLS, clientTLS = server, client
+	httpClient = &http.Client{Transport: &http.Transport{TLSClientConfig: client}}
+	return nil
+}
+
+// protocol returns the protocol this node serves it's API with
+func protocol() string {
+	if serverTLS != nil {
+		return "https://"
+	}
+	return "http://"
+}
+
+// dialNode connects to the peer address of a node, over TLS if the Protocol of the node is https://
+func dialNode(node Node) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: handshakeTimeout}
+	if node.Protocol != "https://" {
+		return dialer.Dial("tcp", node.getPeerAddress())
+	}
+	config := &tls.Config{}
+	if clientTLS != nil {
+		config = clientTLS.Clone()
+	}
+	config.ServerName = node.Hostname
+	return tls.DialWithDialer(dialer, "tcp", node.getPeerAddress(), config)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a CA that signs certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+// writePEM writes a PEM block to a file in the directory
+func writePEM(t *testing.T, dir, name, kind string, der []byte) string {
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+		t.Fatalf("Could not write %s: %s", name, err)
+	}
+	return file
+}
+
+// newTestCA creates a CA and writes it's certificate to the directory
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Could not create CA: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, file: writePEM(t, dir, name+".crt", "CERTIFICATE", der)}
+}
+
+// issue creates a certificate for 127.0.0.1 signed by the CA, and returns the files of the certificate and key
+func (ca *testCA) issue(t *testing.T, dir, name string) (string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Could not create certificate: %s", err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	return writePEM(t, dir, name+".crt", "CERTIFICATE", der), writePEM(t, dir, name+".key", "EC PRIVATE KEY", keyDer)
+}
+
+// listenPeersTLS accepts peer connections for the chain over TLS
+func (c *testChain) listenPeersTLS(t *testing.T, config *tls.Config) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+	c.me.Protocol, c.me.Hostname, c.me.Port, c.me.P2PPort = "https://", "127.0.0.1", port, port
+	c.nodes = initNodes()
+	c.nodes.addNode(&c.me)
+	go c.nodes.listenPeers(tls.NewListener(listener, config), c.bc, c.me)
+	return listener
+}
+
+func TestTLSSettings(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	cert, key := ca.issue(t, dir, "node")
+
+	server, client, err := TLSSettings{CertFile: cert, KeyFile: key, CAFile: ca.file, Mutual: true}.tlsConfigs()
+	if err != nil {
+		t.Fatalf("Could not load the TLS settings: %s", err)
+	}
+	if server.ClientAuth != tls.RequireAndVerifyClientCert || len(client.Certificates) != 1 || client.RootCAs == nil {
+		t.Error("Mutual TLS should require and present certificates")
+	}
+	if server, _, err := (TLSSettings{CAFile: ca.file}).tlsConfigs(); err != nil || server != nil {
+		t.Errorf("Without a certificate the node should serve plain HTTP, got %v", err)
+	}
+	if _, _, err := (TLSSettings{CAFile: ca.file, Mutual: true}).tlsConfigs(); err == nil {
+		t.Error("Mutual TLS without a certificate should be refused")
+	}
+	if _, _, err := (TLSSettings{CertFile: cert, KeyFile: key, Mutual: true}).tlsConfigs(); err == nil {
+		t.Error("Mutual TLS without a CA should be refused")
+	}
+	if _, _, err := (TLSSettings{CAFile: key}).tlsConfigs(); err == nil {
+		t.Error("CA file without certificates should be refused")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	saveGlobals(t)
+	prevServer, prevClient, prevHTTP := serverTLS, clientTLS, httpClient
+	defer func() { serverTLS, clientTLS, httpClient = prevServer, prevClient, prevHTTP }()
+
+	dir := t.TempDir()
+	ca, other := newTestCA(t, dir, "ca"), newTestCA(t, dir, "other-ca")
+	cert, key := ca.issue(t, dir, "node")
+	outsiderCert, outsiderKey := other.issue(t, dir, "outsider")
+	settings := TLSSettings{CertFile: cert, KeyFile: key, CAFile: ca.file, Mutual: true}
+	server, _, _ := settings.tlsConfigs()
+
+	a := newTestChain("tls-a")
+	a.use()
+	api := httptest.NewUnstartedServer(a.app.Router)
+	api.TLS = server
+	api.StartTLS()
+	defer api.Close()
+
+	// a node with a certificate of the CA is served
+	if err := setupTLS(settings); err != nil || protocol() != "https://" {
+		t.Fatalf("Could not set up TLS: %v", err)
+	}
+	resp, err := httpClient.Get(api.URL + "/ping")
+	if err != nil {
+		t.Fatalf("Node with a certificate of the CA should be served: %s", err)
+	}
+	resp.Body.Close()
+
+	// clients without a certificate, or with a certificate of another CA are refused
+	setupTLS(TLSSettings{CAFile: ca.file})
+	if resp, err := httpClient.Get(api.URL + "/ping"); err == nil {
+		resp.Body.Close()
+		t.Error("Client without a certificate should be refused")
+	}
+	setupTLS(TLSSettings{CertFile: outsiderCert, KeyFile: outsiderKey, CAFile: ca.file, Mutual: true})
+	if resp, err := httpClient.Get(api.URL + "/ping"); err == nil {
+		resp.Body.Close()
+		t.Error("Client with a certificate of another CA should be refused")
+	}
+
+	// peer connections over TLS
+	setupTLS(settings)
+	b := a.newPeer("tls-b")
+	defer a.listenPeersTLS(t, serverTLS).Close()
+	defer b.listenPeersTLS(t, serverTLS).Close()
+	connect(a, b)
+	if err := b.nodes.dialPeer(a.me, b.bc, b.me); err != nil {
+		t.Fatalf("Could not connect over TLS: %s", err)
+	}
+	if p, ok := b.nodes.connection(a.me); !ok {
+		t.Error("Connection over TLS should be established")
+	} else if _, isTLS := p.conn.(*tls.Conn); !isTLS {
+		t.Error("Connection with a https node should use TLS")
+	}
+
+	outsider := a.newPeer("tls-outsider")
+	outsiderServer, _, _ := TLSSettings{CertFile: outsiderCert, KeyFile: outsiderKey, CAFile: other.file, Mutual: true}.tlsConfigs()
+	defer outsider.listenPeersTLS(t, outsiderServer).Close()
+	connect(a, outsider)
+	setupTLS(TLSSettings{CertFile: outsiderCert, KeyFile: outsiderKey, CAFile: ca.file, Mutual: true})
+	if err := outsider.nodes.dialPeer(a.me, outsider.bc, outsider.me); err == nil {
+		t.Error("Node with a certificate of another CA should not be able to connect")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// The maximum number of decimals of a token
+const maxTokenDecimals = 8
+
+// TokenIssue defines a new token. A transaction with an Issue creates the token,
+// the ID of the token is the hash of that transaction and the Supply is credited to the Recipient.
+type TokenIssue struct {
+	Name     string  `json:"name"`
+	Decimals int     `json:"decimals"`
+	Supply   float64 `json:"supply"`
+}
+
+// Token is a custom asset issued on the chain.
+type Token struct {
+	ID       string  `json:"id"`
+	Name     string  `json:"name"`
+	Decimals int     `json:"decimals"`
+	Supply   float64 `json:"supply"`
+	Issuer   string  `json:"issuer"`
+}
+
+// tokenAmount returns the amount of the token that is moved by the transaction.
+// An empty token is the native coin.
+func (tr Transaction) tokenAmount(token string) (float64, bool) {
+	if tr.Issue != nil {
+		if token != "" && tr.getHash() == token {
+			return tr.Issue.Supply, true
+		}
+		return 0, false
+	}
+	return tr.Amount, tr.Token == token
+}
+
+// tokenCredits sums the credits of a token in a wallet, like walletCredits does for the native coin.
+func tokenCredits(hash, token string, chain []Block, transactions []Transaction, index int64) float64 {
+	var sum big.Float
+	add := func(tr Transaction, blockIndex int64) {
+		amount, ok := tr.tokenAmount(token)
+		if !ok {
+			return
+		}
+		if tr.Recipient == hash && (index < 0 || index-blockIndex >= tr.RelativeLock) {
+			sum.Add(&sum, big.NewFloat(amount))
+		}
+		if tr.Sender == hash && tr.Issue == nil {
+			sum.Sub(&sum, big.NewFloat(amount))
+		}
+	}
+
+	for _, block := range chain {
+		for _, transaction := range block.Transactions {
+			add(transaction, block.Index)
+		}
+	}
+	for _, pendingTransaction := range transactions {
+		add(pendingTransaction, index)
+	}
+
+	credits, _ := sum.Float64()
+	return credits
+}
+
+// getWalletTokens returns the credits per token of a wallet, including locked and pending credits.
+func getWalletTokens(hash string) map[string]float64 {
+	tokens := make(map[string]float64)
+	bc.Lock()
+	defer bc.Unlock()
+	transactions := append([]Transaction{}, bc.Transactions...)
+	for _, block := range bc.Chain {
+		transactions = append(transactions, block.Transactions...)
+	}
+
+	for _, tr := range transactions {
+		if tr.Recipient != hash && tr.Sender != hash {
+			continue
+		}
+		token := tr.Token
+		if tr.Issue != nil {
+			token = tr.getHash()
+		}
+		if _, done := tokens[token]; token != "" && !done {
+			tokens[token] = tokenCredits(hash, token, bc.Chain, bc.Transactions, -1)
+		}
+	}
+	return tokens
+}
+
+// findToken looks for the issuance of a token in the blocks and transactions given.
+func findToken(id string, chain []Block, transactions []Transaction) (Token, bool) {
+	for _, block := range chain {
+		for _, tr := range block.Transactions {
+			if tr.Issue != nil && tr.getHash() == id {
+				return tr.token(), true
+			}
+		}
+	}
+	for _, tr := range transactions {
+		if tr.Issue != nil && tr.getHash() == id {
+			return tr.token(), true
+		}
+	}
+	return Token{}, false
+}
+
+// token returns the token that is issued by the transaction.
+func (tr Transaction) token() Token {
+	return Token{
+		ID:       tr.getHash(),
+		Name:     tr.Issue.Name,
+		Decimals: tr.Issue.Decimals,
+		Supply:   tr.Issue.Supply,
+		Issuer:   tr.Sender,
+	}
+}
+
+// checkTokenTransaction checks the issuance or transfer of a token that is placed after the given
+// blocks and transactions. Transactions of the native coin are always valid here.
+func checkTokenTransaction(tr Transaction, chain []Block, transactions []Transaction, index int64) error {
+	if tr.Issue == nil && tr.Token == "" {
+		return nil
+	}
+	if tr.Sender == zerohash {
+		return errors.New("invalid transaction (tokens can not be minted)")
+	}
+
+	if tr.Issue != nil {
+		if tr.Token != "" || tr.Amount != 0 {
+			return errors.New("invalid transaction (an issue can not transfer an amount)")
+		}
+		if tr.Issue.Name == "" || tr.Issue.Decimals < 0 || tr.Issue.Decimals > maxTokenDecimals {
+			return errors.New("invalid transaction (invalid token)")
+		}
+		if tr.Issue.Supply <= 0 || !hasDecimals(tr.Issue.Supply, tr.Issue.Decimals) {
+			return errors.New("invalid transaction (invalid token supply)")
+		}
+		return nil
+	}
+
+	token, found := findToken(tr.Token, chain, transactions)
+	if !found {
+		return errors.New("invalid transaction (unknown token)")
+	}
+	if !hasDecimals(tr.Amount, token.Decimals) {
+		return fmt.Errorf("invalid transaction (token %s has %d decimals)", token.Name, token.Decimals)
+	}
+	if tokenCredits(tr.Sender, tr.Token, chain, transactions, index) < tr.Amount {
+		return errors.New("invalid transaction (insufficient token credit)")
+	}
+	return nil
+}
+
+// hasDecimals tells if an amount has at most the given number of decimals
+func hasDecimals(amount float64, decimals int) bool {
+	scaled := amount * math.Pow10(decimals)
+	return math.Abs(scaled-math.Round(scaled)) < 1e-6
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestIssueAndTransferToken(t *testing.T) {
+	saveGlobals(t)
+
+	c := newTestChain("chain-tokens")
+	issuer := c.me.Hash
+	recipient := createWallet().hash
+
+	code := c.call(t, "POST", "/transaction", Transaction{
+		Sender:    issuer,
+		Recipient: issuer,
+		Issue:     &TokenIssue{Name: "points", Decimals: 1, Supply: 100},
+	}, nil)
+	if code != http.StatusOK {
+		t.Fatalf("Could not issue token, got status %d", code)
+	}
+
+	var wallet struct {
+		Tokens map[string]float64 `json:"tokens"`
+	}
+	c.call(t, "GET", "/wallet/"+issuer+"/tokens", nil, &wallet)
+	if len(wallet.Tokens) != 1 {
+		t.Fatalf("Expected 1 token in the wallet of the issuer, got %d", len(wallet.Tokens))
+	}
+	var id string
+	for id = range wallet.Tokens {
+	}
+	if wallet.Tokens[id] != 100 {
+		t.Errorf("Expected the supply of 100 in the wallet of the issuer, got %f", wallet.Tokens[id])
+	}
+
+	transfer := Transaction{Sender: issuer, Recipient: recipient, Amount: 2.5, Token: id}
+	if code = c.call(t, "POST", "/transaction", transfer, nil); code != http.StatusOK {
+		t.Errorf("Could not transfer token, got status %d", code)
+	}
+	transfer.Amount = 2.55
+	if code = c.call(t, "POST", "/transaction", transfer, nil); code == http.StatusOK {
+		t.Error("Transfer with more decimals than the token has was accepted")
+	}
+	transfer.Amount = 98
+	if code = c.call(t, "POST", "/transaction", transfer, nil); code == http.StatusOK {
+		t.Error("Transfer of more tokens than the wallet has was accepted")
+	}
+	transfer.Token = zerohash
+	transfer.Amount = 1
+	if code = c.call(t, "POST", "/transaction", transfer, nil); code == http.StatusOK {
+		t.Error("Transfer of an unknown token was accepted")
+	}
+
+	c.mine(t)
+	if !bc.validate() {
+		t.Error("Chain with token transactions is invalid")
+	}
+	if credits := tokenCredits(recipient, id, bc.Chain, nil, -1); credits != 2.5 {
+		t.Errorf("Expected 2.5 tokens in the wallet of the recipient, got %f", credits)
+	}
+	if credits := getWalletCredits(recipient); credits != 0 {
+		t.Errorf("Tokens should not count as credits, got %f", credits)
+	}
+
+	var resp struct {
+		Token Token `json:"token"`
+	}
+	c.call(t, "GET", "/token/"+id, nil, &resp)
+	if resp.Token.Name != "points" || resp.Token.Issuer != issuer {
+		t.Errorf("Unexpected token definition %v", resp.Token)
+	}
+}
+
+func TestCheckTokenTransaction(t *testing.T) {
+	issue := Transaction{Sender: zerohash, Recipient: zerohash, Issue: &TokenIssue{Name: "minted", Supply: 1}}
+	if err := checkTokenTransaction(issue, nil, nil, 1); err == nil {
+		t.Error("Tokens issued by the coinbase were accepted")
+	}
+
+	issue.Sender = "fad5e7a92f1c43b1523614336a07f98b894bb80fee06b6763b50ab03b597d5f4"
+	issue.Amount = 1
+	if err := checkTokenTransaction(issue, nil, nil, 1); err == nil {
+		t.Error("Issue with an amount of the native coin was accepted")
+	}
+
+	issue.Amount = 0
+	issue.Issue.Decimals = maxTokenDecimals + 1
+	if err := checkTokenTransaction(issue, nil, nil, 1); err == nil {
+		t.Error("Issue with too many decimals was accepted")
+	}
+}
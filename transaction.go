@@ -1,14 +1,10 @@
 package main
 
 import (
-	"bytes"
 	"crypto/sha256"
-	"encoding/json"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"net/http"
-
-	"github.com/grrrben/glog"
 )
 
 type Transaction struct {
@@ -17,6 +13,21 @@ type Transaction struct {
 	Amount    float64 `json:"amount"`
 	Message   string  `json:"message"`
 	Time      int64   `json:"time"`
+	Script    string  `json:"script,omitempty"`  // the locking script of the Sender, it's hash should equal the Sender
+	Witness   string  `json:"witness,omitempty"` // data that unlocks the Script, e.g. a signature and public key
+	// LockTime keeps the transaction out of blocks until it matures.
+	// Below lockTimeThreshold it is a block index, otherwise a timestamp (UnixNano).
+	LockTime int64 `json:"lockTime,omitempty"`
+	// RelativeLock is the number of blocks the Recipient has to wait before the Amount can be spent.
+	RelativeLock int64 `json:"relativeLock,omitempty"`
+	// Token is the ID of the token that is transferred, empty for the native coin.
+	Token string `json:"token,omitempty"`
+	// Issue defines a new token, the Supply is credited to the Recipient.
+	Issue *TokenIssue `json:"issue,omitempty"`
+	// Channel closes, disputes or settles a payment channel, the Sender is the channel.
+	Channel *ChannelUpdate `json:"channel,omitempty"`
+	// Stake stakes coins, unstakes them or slashes a stake.
+	Stake *StakeUpdate `json:"stake,omitempty"`
 }
 
 type hashable interface {
@@ -26,59 +37,146 @@ type hashable interface {
 // getHash a unique hash for a transaction
 func (tr Transaction) getHash() string {
 	str := fmt.Sprintf("%s%s%.8f%d", tr.Sender, tr.Recipient, tr.Amount, tr.Time)
+	if tr.LockTime != 0 || tr.RelativeLock != 0 {
+		str += fmt.Sprintf("%d%d", tr.LockTime, tr.RelativeLock)
+	}
+	if tr.Token != "" {
+		str += tr.Token
+	}
+	if tr.Issue != nil {
+		str += fmt.Sprintf("%s%d%.8f", tr.Issue.Name, tr.Issue.Decimals, tr.Issue.Supply)
+	}
+	if tr.Channel != nil {
+		str += fmt.Sprintf("%s%x", tr.Channel.Action, tr.Channel.State.hash())
+	}
+	if tr.Stake != nil {
+		str += tr.Stake.Action + tr.Stake.Key
+		for _, h := range tr.Stake.Evidence {
+			str += h.hash()
+		}
+	}
 	sha := sha256.New()
 	sha.Write([]byte(str))
 	return fmt.Sprintf("%x", sha.Sum(nil))
 
 }
 
+// payloads returns the number of payloads the transaction carries; a token issue, a channel update, a stake
+// update or a HTLC script. Each payload is checked on it's own, so a transaction may carry only one.
+func (tr Transaction) payloads() int {
+	count := 0
+	for _, carries := range []bool{tr.Issue != nil, tr.Channel != nil, tr.Stake != nil, tr.isHTLC()} {
+		if carries {
+			count++
+		}
+	}
+	return count
+}
+
+// isHTLC tells if the transaction spends from a HTLC
+func (tr Transaction) isHTLC() bool {
+	if tr.Script == "" {
+		return false
+	}
+	_, err := parseHTLC(tr.Script)
+	return err == nil
+}
+
+// sigHash is the message that is signed to spend from the Sender.
+// The Script and Witness are not part of the hash, the Witness holds the signature itself.
+func (tr Transaction) sigHash() []byte {
+	b, _ := hex.DecodeString(tr.getHash())
+	return b
+}
+
+// isFinal tells if a transaction may be added to a block with the given index and timestamp.
+func (tr Transaction) isFinal(index, timestamp int64) bool {
+	if tr.LockTime == 0 {
+		return true
+	}
+	if tr.LockTime < lockTimeThreshold {
+		return tr.LockTime <= index
+	}
+	return tr.LockTime <= timestamp
+}
+
 // checkHashesEqual checks if the hashes of 2 objects are the same
 // objects should have interface hashable.
 func checkHashesEqual(first, second hashable) bool {
 	return first.getHash() == second.getHash()
 }
 
-// checkTransaction performs multiple checks on a transaction
+// checkTransaction performs multiple checks on a transaction, against the chain of this node
 func checkTransaction(tr Transaction) (success bool, err error) {
-	if !validHash(tr.Sender) {
-		return false, errors.New("invalid transaction (sender invalid)")
-	} else if !validHash(tr.Recipient) {
-		return false, errors.New("invalid transaction (recipient invalid)")
-	} else if tr.Sender != zerohash && getWalletCredits(tr.Sender) < tr.Amount {
+	return bc.checkTransaction(tr)
+}
+
+// checkTransaction performs multiple checks on a transaction, against the chain and it's pending transactions
+func (bc *Blockchain) checkTransaction(tr Transaction) (success bool, err error) {
+	if err := checkTransactionFormat(tr); err != nil {
+		return false, err
+	} else if chainTransactions(bc.Chain)[tr.getHash()] {
+		return false, errors.New("invalid transaction (already in the chain)")
+	} else if tr.Token == "" && walletCredits(tr.Sender, bc.Chain, bc.Transactions, int64(len(bc.Chain)+1)) < tr.Amount {
 		return false, errors.New("invalid transaction (insufficient credit)")
+	} else if err := checkTokenTransaction(tr, bc.Chain, bc.Transactions, int64(len(bc.Chain)+1)); err != nil {
+		return false, err
+	} else if tr.Channel != nil {
+		if err := checkChannelTransaction(tr, bc.Chain, bc.Transactions, int64(len(bc.Chain)+1)); err != nil {
+			return false, err
+		}
+	} else if tr.Stake != nil || tr.Sender == stakeAddress {
+		if err := checkStakeTransaction(tr, bc.Chain, bc.Transactions, int64(len(bc.Chain)+1)); err != nil {
+			return false, err
+		}
 	}
 	return true, nil
 }
 
-// announceTransaction distributes new transaction in the network
-// It is preferably done in a goroutine.
-func announceTransaction(node Node, tr Transaction) {
-	defer glog.Flush()
-	url := fmt.Sprintf("%s/transaction/distributed", node.getAddress())
-
-	transactionAndSender := make(map[string]interface{}, 2)
-	transactionAndSender["transaction"] = tr
-	transactionAndSender["sender"] = me.getAddress()
-	glog.Infof("transactionAndSender to be distributed:\n %v", transactionAndSender)
-	payload, err := json.Marshal(transactionAndSender)
-	if err != nil {
-		glog.Errorf("Could not marshall transaction or node. Msg: %s", err)
+// checkTransactionFormat performs the checks of a transaction that don't depend on the chain, it's fields and
+// the script of the sender. A transaction that fails these is invalid on any chain.
+func checkTransactionFormat(tr Transaction) error {
+	if !validHash(tr.Sender) {
+		return errors.New("invalid transaction (sender invalid)")
+	} else if tr.Sender == zerohash {
+		return errors.New("invalid transaction (only a mined block can pay from the coinbase)")
+	} else if !validHash(tr.Recipient) {
+		return errors.New("invalid transaction (recipient invalid)")
+	} else if tr.Amount < 0 || tr.LockTime < 0 || tr.RelativeLock < 0 {
+		return errors.New("invalid transaction (negative value)")
+	} else if tr.payloads() > 1 {
+		return errors.New("invalid transaction (more than one payload)")
+	} else if tr.Channel == nil && tr.Stake == nil && tr.Sender != stakeAddress {
+		// channel and stake transactions are checked by the rules of the channel or stake
+		return checkTransactionScript(tr)
 	}
+	return nil
+}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
-	if err != nil {
-		glog.Errorf("Request setup error: %s", err)
-	} else {
-		req.Header.Set("Content-Type", "application/json")
-		client := &http.Client{}
-		resp, err := client.Do(req)
-		if err != nil {
-			glog.Warningf("POST request error: %s", err)
-			// I don't want to panic here, but it might be a good idea to
-			// remove the node from the list (todo)
-		} else {
-			defer resp.Body.Close()
-			glog.Info("Transaction distributed")
+// chainTransactions returns the hashes of all transactions in the chain. A transaction is signed by it's hash,
+// so a transaction that is in the chain already is a replay.
+func chainTransactions(chain []Block) map[string]bool {
+	hashes := make(map[string]bool)
+	for _, bl := range chain {
+		for _, tr := range bl.Transactions {
+			hashes[tr.getHash()] = true
 		}
 	}
+	return hashes
+}
+
+// checkTransactionScript checks if the transaction is allowed to spend from the Sender.
+// The Script should hash to the Sender and the Witness has to unlock it.
+func checkTransactionScript(tr Transaction) error {
+	if tr.Script == "" || scriptHash(tr.Script) != tr.Sender {
+		return errors.New("invalid transaction (script does not match sender)")
+	}
+	ctx := scriptContext{
+		sigHash:  tr.sigHash(),
+		lockTime: tr.LockTime,
+	}
+	if err := evalScript(tr.Witness, tr.Script, ctx); err != nil {
+		return fmt.Errorf("invalid transaction (%s)", err)
+	}
+	return nil
 }
@@ -1,18 +1,21 @@
 package main
 
 import (
+	"encoding/hex"
+	"net/http"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetHash(t *testing.T) {
 
 	transaction := Transaction{
-		"sender",
-		"recipient",
-		1.2,
-		"message",
-		0,
+		Sender:    "sender",
+		Recipient: "recipient",
+		Amount:    1.2,
+		Message:   "message",
+		Time:      0,
 	}
 
 	hash := transaction.getHash()
@@ -25,11 +28,11 @@ func TestGetHash(t *testing.T) {
 func TestCheckTransaction(t *testing.T) {
 	// an invalid transaction
 	tr := Transaction{
-		"sender",
-		"recipient",
-		1.2,
-		"message",
-		0,
+		Sender:    "sender",
+		Recipient: "recipient",
+		Amount:    1.2,
+		Message:   "message",
+		Time:      0,
 	}
 
 	successSenderInvalid, errSenderInvalid := checkTransaction(tr)
@@ -55,3 +58,131 @@ func TestCheckTransaction(t *testing.T) {
 		t.Errorf("Expected error 'recipient invalid', got %s.", errRecipientInvalid.Error())
 	}
 }
+
+func TestCheckTransactionScript(t *testing.T) {
+	w := createWallet()
+	tr := Transaction{
+		Sender:    w.hash,
+		Recipient: "fad5e7a92f1c43b1523614336a07f98b894bb80fee06b6763b50ab03b597d5f4",
+		Amount:    1,
+		Time:      1234567890,
+	}
+
+	if err := checkTransactionScript(tr); err == nil {
+		t.Error("checkTransactionScript: a transaction without a script should be invalid.")
+	}
+
+	if err := w.signTransaction(&tr); err != nil {
+		t.Fatalf("Could not sign transaction: %s", err)
+	}
+	if err := checkTransactionScript(tr); err != nil {
+		t.Errorf("checkTransactionScript: a signed transaction should be valid, got %s.", err)
+	}
+
+	// changing the amount invalidates the signature
+	tr.Amount = 2
+	if err := checkTransactionScript(tr); err == nil {
+		t.Error("checkTransactionScript: a tampered transaction should be invalid.")
+	}
+}
+
+func TestIsFinal(t *testing.T) {
+	tr := Transaction{LockTime: 5}
+	if tr.isFinal(4, 0) {
+		t.Error("Transaction locked until block 5 is final in block 4.")
+	}
+	if !tr.isFinal(5, 0) {
+		t.Error("Transaction locked until block 5 is not final in block 5.")
+	}
+
+	tr.LockTime = 1600000000000000000
+	if tr.isFinal(1000, 1500000000000000000) {
+		t.Error("Transaction locked until a timestamp is final before it.")
+	}
+	if !tr.isFinal(1000, 1600000000000000000) {
+		t.Error("Transaction locked until a timestamp is not final at it.")
+	}
+}
+
+func TestReplayedTransaction(t *testing.T) {
+	saveGlobals(t)
+
+	c := newTestChain("replay")
+	c.mine(t)
+	c.mine(t)
+	w, _ := getWallet(c.me.Hash)
+	payment := func() Transaction {
+		tr := Transaction{Sender: w.hash, Recipient: strings.Repeat("ab", 32), Amount: minersIncentive, Time: time.Now().UnixNano()}
+		w.signTransaction(&tr)
+		return tr
+	}
+	tr := payment()
+	if _, err := c.bc.newTransaction(tr); err != nil {
+		t.Fatalf("Could not add a transaction: %s", err)
+	}
+	c.mine(t)
+
+	if _, err := c.bc.newTransaction(tr); err == nil || !strings.Contains(err.Error(), "already in the chain") {
+		t.Errorf("Mined transaction should not be accepted again, got %v", err)
+	}
+	twice := payment()
+	blocks := map[string]Block{
+		"a mined transaction":        {Index: int64(len(c.bc.Chain) + 1), Transactions: []Transaction{tr}},
+		"the same transaction twice": {Index: int64(len(c.bc.Chain) + 1), Transactions: []Transaction{twice, twice}},
+	}
+	for name, bl := range blocks {
+		if err := bl.checkTransactions(c.bc.Chain); err == nil {
+			t.Errorf("Block with %s should be invalid", name)
+		}
+	}
+}
+
+func TestTransactionPayloads(t *testing.T) {
+	saveGlobals(t)
+
+	c := newTestChain("payloads")
+	c.mine(t)
+	victim := hex.EncodeToString(publicKeyBytes(createWallet().key))
+	// a channel close that slashes a staker
+	tr := Transaction{
+		Sender:    strings.Repeat("ab", 32),
+		Recipient: zerohash,
+		Time:      time.Now().UnixNano(),
+		Channel:   &ChannelUpdate{Action: "close"},
+		Stake:     &StakeUpdate{Action: "slash", Key: victim},
+	}
+	if _, err := c.bc.newTransaction(tr); err == nil || !strings.Contains(err.Error(), "more than one payload") {
+		t.Errorf("Transaction with a channel and a stake update should be refused, got %v", err)
+	}
+	bl := Block{Index: int64(len(c.bc.Chain) + 1), Transactions: []Transaction{tr}}
+	if err := bl.checkTransactions(c.bc.Chain); err == nil {
+		t.Error("Block with a transaction with a channel and a stake update should be invalid")
+	}
+	if _, ok := stakes([]Block{bl}, nil)[victim]; ok {
+		t.Error("Stake update of a transaction with another payload should be ignored")
+	}
+
+	if (Transaction{Issue: &TokenIssue{}}).payloads() != 1 || (Transaction{}).payloads() != 0 {
+		t.Error("Expected a token issue to be a single payload")
+	}
+}
+
+func TestCoinbaseTransactionRefused(t *testing.T) {
+	saveGlobals(t)
+
+	c := newTestChain("coinbase")
+	c.mine(t)
+	mint := Transaction{Sender: zerohash, Recipient: c.me.Hash, Amount: 1000}
+	if code := c.call(t, "POST", "/transaction", mint, nil); code == http.StatusOK {
+		t.Error("Transaction from the coinbase should be refused by the API")
+	}
+	if _, err := c.bc.newTransaction(mint); err == nil || !strings.Contains(err.Error(), "coinbase") {
+		t.Errorf("Transaction from the coinbase should be refused, got %v", err)
+	}
+
+	c.mine(t)
+	block := c.bc.lastBlock()
+	if n := len(block.Transactions); n != 1 || block.Transactions[0].Amount != minersIncentive {
+		t.Errorf("Expected only the miners incentive in the block, got %v", block.Transactions)
+	}
+}
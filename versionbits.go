@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Rule changes are deployed as soft forks; a new rule is only enforced once enough miners signal they are
+// ready, so nodes can upgrade one by one. A miner signals for a deployment by setting it's bit in the version
+// of the blocks it mines. The state of a deployment changes at the start of a window of blocks, by the window
+// before it:
+//
+//	defined   until the median time past reaches the start time, then started
+//	started   until the threshold of the blocks of a window signal, then locked in
+//	locked in for one window, then active; the rules of the deployment are enforced from then on
+//	failed    if the median time past reaches the timeout before the deployment is locked in
+//
+// Active and failed are final. The deployments are set per network.
+
+// The top bits of the version of a block that signals, the bits of the deployments follow
+const (
+	versionBitsTopBits = 0x20000000
+	versionBitsTopMask = 0xe0000000
+)
+
+// The states of a deployment
+const (
+	stateDefined  = "defined"
+	stateStarted  = "started"
+	stateLockedIn = "locked_in"
+	stateActive   = "active"
+	stateFailed   = "failed"
+)
+
+// The deployment that limits the coinbase of a block to the subsidy
+const deploymentSubsidy = "subsidy"
+
+// Deployment is a rule change that miners signal for with a bit of the block version
+type Deployment struct {
+	Name      string `json:"name"`
+	Bit       uint   `json:"bit"`       // 0 to 28
+	StartTime int64  `json:"startTime"` // median time past (UnixNano) from which miners signal
+	Timeout   int64  `json:"timeout"`   // median time past at which the deployment fails if it isn't locked in
+}
+
+// VersionBits are the deployments of a network and the windows in which the signals are counted
+type VersionBits struct {
+	Window      int // the number of blocks of a window
+	Threshold   int // the number of blocks of a window that should signal
+	Deployments []Deployment
+}
+
+// deploymentStates holds the state of the deployments after a window, by the hash of the last block of the window
+var deploymentStates = struct {
+	sync.Mutex
+	states map[string]string
+}{states: make(map[string]string)}
+
+// deploymentState returns the state of the deployment for the block that follows the chain
+func deploymentState(chain []Block, d Deployment) string {
+	window := network.VersionBits.Window
+	if window <= 0 {
+		return stateDefined
+	}
+	key := func(end int) string { return fmt.Sprintf("%s/%s/%s", network.Name, d.Name, hash(chain[end-1])) }
+
+	deploymentStates.Lock()
+	defer deploymentStates.Unlock()
+	// walk back to a window of which the state is known, the state before the first window is defined
+	state := stateDefined
+	var ends []int
+	for end := len(chain) - len(chain)%window; end > 0; end -= window {
+		if known, ok := deploymentStates.states[key(end)]; ok {
+			state = known
+			break
+		}
+		ends = append(ends, end)
+	}
+	for i := len(ends) - 1; i >= 0; i-- {
+		state = nextState(state, d, chain[:ends[i]])
+		deploymentStates.states[key(ends[i])] = state
+	}
+	return state
+}
+
+// nextState returns the state of the deployment after the last window of the chain
+func nextState(state string, d Deployment, chain []Block) string {
+	vb := network.VersionBits
+	mtp := medianTimePast(chain)
+	switch state {
+	case stateDefined:
+		if mtp >= d.Timeout {
+			return stateFailed
+		}
+		if mtp >= d.StartTime {
+			return stateStarted
+		}
+	case stateStarted:
+		if mtp >= d.Timeout {
+			return stateFailed
+		}
+		if signalCount(chain[len(chain)-vb.Window:], d) >= vb.Threshold {
+			return stateLockedIn
+		}
+	case stateLockedIn:
+		return stateActive
+	}
+	return state
+}
+
+// signals tells if a block version signals for the deployment
+func signals(version int32, d Deployment) bool {
+	return uint32(version)&versionBitsTopMask == versionBitsTopBits && uint32(version)&(1<<d.Bit) != 0
+}
+
+// signalCount returns the number of blocks that signal for the deployment
+func signalCount(blocks []Block, d Deployment) int {
+	count := 0
+	for _, bl := range blocks {
+		if signals(bl.Version, d) {
+			count++
+		}
+	}
+	return count
+}
+
+// blockVersion returns the version of the block that follows the chain, it signals for the deployments that
+// are started or locked in
+func blockVersion(chain []Block) int32 {
+	version := uint32(versionBitsTopBits)
+	for _, d := range network.VersionBits.Deployments {
+		if state := deploymentState(chain, d); state == stateStarted || state == stateLockedIn {
+			version |= 1 << d.Bit
+		}
+	}
+	return int32(version)
+}
+
+// deploymentActive tells if the rules of the deployment are enforced for the block that follows the chain
+func deploymentActive(chain []Block, name string) bool {
+	for _, d := range network.VersionBits.Deployments {
+		if d.Name == name {
+			return deploymentState(chain, d) == stateActive
+		}
+	}
+	return false
+}
+
+// checkDeployments checks the rules of the active deployments on a block that follows the chain
+func checkDeployments(chain []Block, bl Block) error {
+	if deploymentActive(chain, deploymentSubsidy) {
+		// one coinbase, that pays at most the subsidy and never a negative amount
+		coinbases := 0
+		for _, tr := range bl.Transactions {
+			if tr.Sender != zerohash || tr.Stake != nil {
+				continue
+			}
+			if coinbases++; coinbases > 1 || tr.Amount < 0 || tr.Amount > minersIncentive {
+				return fmt.Errorf("invalid block (block %d pays more than the subsidy to it's miner)", bl.Index)
+			}
+		}
+	}
+	return nil
+}
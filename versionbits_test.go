@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestVersionBits(t *testing.T) {
+	saveGlobals(t)
+
+	c := newTestChain("versionbits")
+	network = networks["regtest"]
+	settings, _ := network.Genesis.consensusSettings()
+	c.bc.engine, _ = newConsensusEngine(settings)
+	subsidy := network.VersionBits.Deployments[0]
+
+	var resp struct {
+		Deployments []struct {
+			Name    string `json:"name"`
+			State   string `json:"state"`
+			Signals int    `json:"signals"`
+		} `json:"deployments"`
+		Version int32 `json:"version"`
+	}
+	// the state changes at the start of a window of 20 blocks
+	for _, step := range []struct {
+		blocks  int
+		state   string
+		signals int
+	}{{18, stateDefined, 0}, {1, stateStarted, 0}, {5, stateStarted, 5}, {15, stateLockedIn, 0}, {20, stateActive, 0}} {
+		if code := c.call(t, "POST", "/generate", map[string]interface{}{"blocks": step.blocks}, nil); code != http.StatusOK {
+			t.Fatalf("Could not generate %d blocks, got %d", step.blocks, code)
+		}
+		if code := c.call(t, "GET", "/deployments", nil, &resp); code != http.StatusOK || len(resp.Deployments) != 1 {
+			t.Fatalf("Expected the deployments, got %d: %v", code, resp)
+		}
+		if d := resp.Deployments[0]; d.Name != subsidy.Name || d.State != step.state || d.Signals != step.signals {
+			t.Errorf("Expected %s with %d signals at length %d, got %v", step.state, step.signals, len(c.bc.Chain), d)
+		}
+		if signalling := step.state == stateStarted || step.state == stateLockedIn; signals(resp.Version, subsidy) != signalling {
+			t.Errorf("Next block should signal only while %s is started or locked in, got version %x", subsidy.Name, resp.Version)
+		}
+	}
+	if signals(c.bc.Chain[19].Version, subsidy) || !signals(c.bc.Chain[20].Version, subsidy) {
+		t.Error("Mined blocks should signal from the first window the deployment is started")
+	}
+	if !c.bc.validate() {
+		t.Error("Chain with an active deployment should be valid")
+	}
+
+	// once active a block may pay only the subsidy to it's miner
+	coinbase := Transaction{Sender: zerohash, Recipient: strings.Repeat("ab", 32), Amount: minersIncentive}
+	greedy := coinbase
+	greedy.Amount = 2 * minersIncentive
+	blocks := map[string][]Transaction{"more than the subsidy": {greedy}, "two coinbases": {coinbase, coinbase}}
+	for name, transactions := range blocks {
+		bl := Block{Index: int64(len(c.bc.Chain) + 1), Transactions: transactions}
+		if err := checkDeployments(c.bc.Chain, bl); err == nil {
+			t.Errorf("Block with %s should be invalid once the deployment is active", name)
+		}
+		if err := checkDeployments(c.bc.Chain[:40], bl); err != nil {
+			t.Errorf("Block with %s should be valid before the deployment is active: %s", name, err)
+		}
+	}
+	if err := checkDeployments(c.bc.Chain, Block{Transactions: []Transaction{coinbase}}); err != nil {
+		t.Errorf("Block that pays the subsidy should be valid: %s", err)
+	}
+	c.bc.Transactions = append(c.bc.Transactions, greedy)
+	c.mine(t)
+	if coinbases := len(c.bc.lastBlock().Transactions); coinbases != 1 {
+		t.Errorf("Pending coinbase should not be mined once the deployment is active, got %d transactions", coinbases)
+	}
+}
+
+func TestDeploymentStates(t *testing.T) {
+	saveGlobals(t)
+
+	network = networks["regtest"]
+	network.VersionBits = VersionBits{Window: 4, Threshold: 3}
+	d := Deployment{Name: "test", Bit: 5, StartTime: 100, Timeout: 200}
+	window := func(ts int64, signalling int) []Block {
+		var blocks []Block
+		for i := 0; i < 4; i++ {
+			bl := Block{Timestamp: ts, Version: versionBitsTopBits}
+			if i < signalling {
+				bl.Version |= 1 << d.Bit
+			}
+			blocks = append(blocks, bl)
+		}
+		return blocks
+	}
+
+	transitions := []struct {
+		from, to string
+		chain    []Block
+	}{
+		{stateDefined, stateDefined, window(50, 4)},
+		{stateDefined, stateStarted, window(100, 0)},
+		{stateStarted, stateStarted, window(150, 2)},
+		{stateStarted, stateLockedIn, window(150, 3)},
+		{stateStarted, stateFailed, window(200, 4)},
+		{stateDefined, stateFailed, window(200, 0)},
+		{stateLockedIn, stateActive, window(250, 0)},
+		{stateActive, stateActive, window(250, 0)},
+		{stateFailed, stateFailed, window(150, 4)},
+	}
+	for _, tr := range transitions {
+		if state := nextState(tr.from, d, tr.chain); state != tr.to {
+			t.Errorf("Expected %s to become %s, got %s", tr.from, tr.to, state)
+		}
+	}
+
+	if !signals(versionBitsTopBits|1<<d.Bit, d) || signals(versionBitsTopBits, d) || signals(1<<d.Bit, d) {
+		t.Error("A version signals with the top bits and the bit of the deployment only")
+	}
+	network.VersionBits.Window = 0
+	if state := deploymentState(window(150, 4), d); state != stateDefined {
+		t.Errorf("Without windows a deployment should stay defined, got %s", state)
+	}
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
-	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/sha256"
-	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"math/big"
-	"time"
+	"sync"
 
 	"github.com/grrrben/glog"
 )
@@ -14,48 +16,135 @@ import (
 type wallet struct {
 	hash   string
 	credit float64
+	key    *ecdsa.PrivateKey
+	script string
 }
 
-// createWallet creates a wallet with a hash and 0 credits
+// keystore holds the wallets that are created on this node, so the node can sign transactions for them.
+var keystore = struct {
+	sync.Mutex
+	wallets map[string]wallet
+}{wallets: make(map[string]wallet)}
+
+// createWallet creates a wallet with a new key pair and 0 credits.
+// The hash of the wallet is the address of a pay-to-pubkey-hash script of the public key.
 func createWallet() wallet {
-	var buf bytes.Buffer
-	err := binary.Write(&buf, binary.BigEndian, time.Now().Unix())
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		glog.Warningf("Could not createWallet. Msg: %s", err)
 	}
 
+	script := payToPubKeyHashScript(publicKeyBytes(key))
 	w := wallet{
-		hash:   fmt.Sprintf("%x", sha256.Sum256(buf.Bytes())),
+		hash:   scriptHash(script),
 		credit: 0,
+		key:    key,
+		script: script,
 	}
+
+	keystore.Lock()
+	keystore.wallets[w.hash] = w
+	keystore.Unlock()
 	return w
 }
 
+// getWallet returns a wallet of the keystore of this node.
+func getWallet(hash string) (wallet, bool) {
+	keystore.Lock()
+	defer keystore.Unlock()
+	w, ok := keystore.wallets[hash]
+	return w, ok
+}
+
+// publicKeyBytes returns the uncompressed public key of a key pair
+func publicKeyBytes(key *ecdsa.PrivateKey) []byte {
+	return elliptic.Marshal(elliptic.P256(), key.PublicKey.X, key.PublicKey.Y)
+}
+
+// halfOrder is half the order of the curve, a signature with a larger s is not canonical
+var halfOrder = new(big.Int).Rsh(elliptic.P256().Params().N, 1)
+
+// sign signs a message (e.g. the hash of a transaction) and returns the signature as r||s.
+// The signature is canonical, with a low s, as r||(N-s) is a valid signature as well.
+func sign(key *ecdsa.PrivateKey, msg []byte) ([]byte, error) {
+	digest := sha256.Sum256(msg)
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	if s.Cmp(halfOrder) > 0 {
+		s.Sub(elliptic.P256().Params().N, s)
+	}
+	sig := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[32-len(rb):32], rb)
+	copy(sig[64-len(sb):], sb)
+	return sig, nil
+}
+
+// verifySignature checks a canonical r||s signature of the message against an uncompressed public key
+func verifySignature(pubKey, msg, sig []byte) bool {
+	if len(sig) != 64 {
+		return false
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), pubKey)
+	if x == nil {
+		return false
+	}
+	digest := sha256.Sum256(msg)
+	pub := ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	if s.Cmp(halfOrder) > 0 {
+		return false
+	}
+	return ecdsa.Verify(&pub, digest[:], r, s)
+}
+
+// decodeSignature decodes a signature in lowercase hex, the only encoding that is accepted
+// as the signature is part of a hash (e.g. of a block header).
+func decodeSignature(signature string) ([]byte, error) {
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return nil, err
+	}
+	if hex.EncodeToString(sig) != signature {
+		return nil, fmt.Errorf("signature %s is not in lowercase hex", signature)
+	}
+	return sig, nil
+}
+
+// signTransaction adds the script and a pay-to-pubkey-hash witness to a transaction sent from this wallet.
+func (w wallet) signTransaction(tr *Transaction) error {
+	sig, err := sign(w.key, tr.sigHash())
+	if err != nil {
+		return err
+	}
+	tr.Script = w.script
+	tr.Witness = fmt.Sprintf("%s %s", hex.EncodeToString(sig), hex.EncodeToString(publicKeyBytes(w.key)))
+	return nil
+}
+
 // getWalletCredits Loops all blocks/transactions and checks for the credits that are send or received.
 // Also loops the current pending transactions that are not mined yet. Of _this_ node...
-// returns the total amount of credits that are currently in the wallet
+// returns the total amount of credits that are currently in the wallet, including locked credits.
 func getWalletCredits(hash string) float64 {
-	var sum big.Float
-	for _, block := range bc.Chain {
-		for _, transaction := range block.Transactions {
-			if transaction.Recipient == hash {
-				sum.Add(&sum, big.NewFloat(transaction.Amount))
-			}
-			if transaction.Sender == hash {
-				sum.Sub(&sum, big.NewFloat(transaction.Amount))
-			}
-		}
-	}
-
-	for _, pendingTransactions := range bc.Transactions {
-		if pendingTransactions.Recipient == hash {
-			sum.Add(&sum, big.NewFloat(pendingTransactions.Amount))
-		}
-		if pendingTransactions.Sender == hash {
-			sum.Sub(&sum, big.NewFloat(pendingTransactions.Amount))
-		}
-	}
-
-	credits, _ := sum.Float64()
-	return credits
+	bc.Lock()
+	defer bc.Unlock()
+	return walletCredits(hash, bc.Chain, bc.Transactions, -1)
+}
+
+// getSpendableCredits returns the credits of a wallet that can be spent in the next block.
+func getSpendableCredits(hash string) float64 {
+	bc.Lock()
+	defer bc.Unlock()
+	return walletCredits(hash, bc.Chain, bc.Transactions, int64(len(bc.Chain)+1))
+}
+
+// walletCredits sums the credits of a wallet in the blocks and transactions given.
+// Received amounts with a RelativeLock are only counted if they are mature in the block with the given index,
+// the transactions (not in a block yet) are counted as if they are part of that block.
+// A negative index counts all credits, locked or not.
+func walletCredits(hash string, chain []Block, transactions []Transaction, index int64) float64 {
+	return tokenCredits(hash, "", chain, transactions, index)
 }
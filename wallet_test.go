@@ -17,3 +17,40 @@ func TestCreateWallet(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestSignAndVerify(t *testing.T) {
+	wallet := createWallet()
+	msg := []byte("message")
+
+	sig, err := sign(wallet.key, msg)
+	if err != nil {
+		t.Fatalf("Could not sign message: %s", err)
+	}
+	if !verifySignature(publicKeyBytes(wallet.key), msg, sig) {
+		t.Error("Valid signature could not be verified.")
+	}
+	if verifySignature(publicKeyBytes(wallet.key), []byte("other message"), sig) {
+		t.Error("Signature of another message was verified.")
+	}
+	if wallet.hash != scriptHash(wallet.script) {
+		t.Error("Wallet hash is not the hash of it's script.")
+	}
+}
+
+func TestWalletCreditsRelativeLock(t *testing.T) {
+	hash := "fad5e7a92f1c43b1523614336a07f98b894bb80fee06b6763b50ab03b597d5f4"
+	chain := []Block{
+		{Index: 1, Transactions: []Transaction{{Sender: zerohash, Recipient: hash, Amount: 2}}},
+		{Index: 2, Transactions: []Transaction{{Sender: zerohash, Recipient: hash, Amount: 3, RelativeLock: 5}}},
+	}
+
+	if credits := walletCredits(hash, chain, nil, 6); credits != 2 {
+		t.Errorf("Expected 2 spendable credits in block 6, got %f", credits)
+	}
+	if credits := walletCredits(hash, chain, nil, 7); credits != 5 {
+		t.Errorf("Expected 5 spendable credits in block 7, got %f", credits)
+	}
+	if credits := walletCredits(hash, chain, nil, -1); credits != 5 {
+		t.Errorf("Expected 5 credits in total, got %f", credits)
+	}
+}